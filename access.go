@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// -allow and -deny decide who may start a test, by address, so an instance
+// can be open to the LAN and closed to the internet without a firewall.
+// Everyone can still see the pages and open result links; the tests are what
+// cost bandwidth. deny wins over allow, and with no -allow every address not
+// denied may test.
+
+// testPaths are the ones that cost bandwidth or create a result.
+var testPaths = []string{"/download", "/upload", "/api/upload", "/multi", "/start", "/demo.bin", "/ndt/v7", "/pair"}
+
+func isTestPath(p string) bool {
+	for _, t := range testPaths {
+		if p == t || strings.HasPrefix(p, t+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// lanNets is what "lan" stands for in a list: private, shared (CGNAT),
+// loopback and link-local ranges.
+var lanNets = []string{
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"fc00::/7", "fe80::/10", "::1/128",
+}
+
+// netList is a comma-separated list of CIDRs, bare addresses and "lan".
+type netList []netip.Prefix
+
+func (l *netList) String() string {
+	s := make([]string, len(*l))
+	for i, p := range *l {
+		s[i] = p.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *netList) Set(s string) error {
+	var out netList
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		switch {
+		case f == "":
+		case f == "lan":
+			for _, n := range lanNets {
+				out = append(out, netip.MustParsePrefix(n))
+			}
+		case strings.Contains(f, "/"):
+			p, err := netip.ParsePrefix(f)
+			if err != nil {
+				return fmt.Errorf("invalid network %q", f)
+			}
+			out = append(out, p.Masked())
+		default:
+			a, err := netip.ParseAddr(f)
+			if err != nil {
+				return fmt.Errorf("invalid address %q", f)
+			}
+			out = append(out, netip.PrefixFrom(a, a.BitLen()))
+		}
+	}
+	*l = out
+	return nil
+}
+
+func (l netList) has(a netip.Addr) bool {
+	for _, p := range l {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// testerAddr is the address -allow and -deny judge. A client's own
+// X-Forwarded-For is easy to make up, so it only counts behind a reverse
+// proxy on this machine, and then only the entry the proxy added last.
+func testerAddr(r *http.Request) netip.Addr {
+	h, _, _ := net.SplitHostPort(r.RemoteAddr)
+	a, _ := netip.ParseAddr(h)
+	a = a.Unmap()
+	if x := r.Header.Get("X-Forwarded-For"); x != "" && a.IsLoopback() {
+		if i := strings.LastIndexByte(x, ','); i >= 0 {
+			x = x[i+1:]
+		}
+		if f, err := netip.ParseAddr(strings.TrimSpace(x)); err == nil {
+			a = f.Unmap()
+		}
+	}
+	return a
+}
+
+// limitIP is testerAddr as the limits key it, anonymized like getIP, so a
+// made-up X-Forwarded-For doesn't buy a fresh allowance.
+func limitIP(r *http.Request) string { return anonIP(testerAddr(r).String()) }
+
+func mayTest(r *http.Request) bool { return mayTestFrom(testerAddr(r)) }
+
+// mayTestFrom is the -allow and -deny verdict on a, for listeners like
+// -tcp-addr that have no HTTP request to go by.
+func mayTestFrom(a netip.Addr) bool {
+	if cfg().Deny.has(a) {
+		return false
+	}
+	return len(cfg().Allow) == 0 || cfg().Allow.has(a)
+}
+
+func access(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(cfg().Allow)+len(cfg().Deny) == 0 || mayTest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch {
+		case r.URL.Path == "/" || r.URL.Path == "/multi":
+			refusedPage(w, r)
+		case isTestPath(r.URL.Path):
+			http.Error(w, "This instance doesn't run tests for your network.", http.StatusForbidden)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func refusedPage(w http.ResponseWriter, r *http.Request) {
+	b := brandFor(r)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	io.WriteString(w, `<!doctype html>
+<html><head><meta charset="utf-8"><title>`+b.name()+` (not available)</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Arial;max-width:760px;margin:1rem}</style>
+</head><body>
+<h2>`+b.heading(b.name())+`</h2>
+<p>Sorry — this instance only runs speed tests for the networks its operator has opened it to, and yours isn't one of them.</p>
+<p>Result links shared with you still work. If you think you should be able to test here, ask whoever runs it.</p>
+`+b.about()+`</body></html>`)
+}
+
+// sameOrigin refuses a form another site posts: a browser sends Origin
+// (or at least Sec-Fetch-Site) with every cross-site POST.
+func sameOrigin(r *http.Request) bool {
+	if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+		return false
+	}
+	if o := r.Header.Get("Origin"); o != "" {
+		u, err := url.Parse(o)
+		return err == nil && u.Host == r.Host
+	}
+	return true
+}
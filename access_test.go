@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// withConfig applies f to the settings for the rest of the test and puts
+// them back afterwards.
+func withConfig(t testing.TB, f func(*config)) {
+	old := settings
+	tune(f)
+	t.Cleanup(func() { tune(func(c *config) { *c = old }) })
+}
+
+func TestTesterAddr(t *testing.T) {
+	for _, c := range []struct {
+		remote, xff, want string
+	}{
+		{"203.0.113.5:1234", "", "203.0.113.5"},
+		// only a proxy on this machine gets its X-Forwarded-For believed
+		{"203.0.113.5:1234", "198.51.100.1", "203.0.113.5"},
+		{"127.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"[::1]:1234", "198.51.100.1", "198.51.100.1"},
+		// and then only the entry it added itself, the last
+		{"127.0.0.1:1234", "10.9.9.9, 198.51.100.1", "198.51.100.1"},
+		{"127.0.0.1:1234", "198.51.100.1,2001:db8::1", "2001:db8::1"},
+		{"127.0.0.1:1234", "not an address", "127.0.0.1"},
+		{"[::ffff:203.0.113.5]:1234", "", "203.0.113.5"},
+		{"[::ffff:127.0.0.1]:1234", "198.51.100.1", "198.51.100.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if got := testerAddr(r).String(); got != c.want {
+			t.Errorf("testerAddr(%s, XFF %q) = %s, want %s", c.remote, c.xff, got, c.want)
+		}
+	}
+}
+
+func TestLimitIP(t *testing.T) {
+	withConfig(t, func(c *config) { c.Anonymize = "truncate" })
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.77:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := limitIP(r); got != "203.0.113.0" {
+		t.Errorf("limitIP = %q, want 203.0.113.0", got)
+	}
+}
+
+func TestNetList(t *testing.T) {
+	var l netList
+	if err := l.Set("lan, 203.0.113.0/24,2001:db8::1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		addr string
+		want bool
+	}{
+		{"192.168.1.10", true},
+		{"100.64.0.1", true},
+		{"fe80::1", true},
+		{"203.0.113.200", true},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+		{"198.51.100.1", false},
+	} {
+		if got := l.has(netip.MustParseAddr(c.addr)); got != c.want {
+			t.Errorf("has(%s) = %t, want %t", c.addr, got, c.want)
+		}
+	}
+	// a network given with host bits set still matches the whole network
+	if err := l.Set("203.0.113.9/24"); err != nil || l.String() != "203.0.113.0/24" {
+		t.Errorf("Set(203.0.113.9/24) = %v, %q", err, l.String())
+	}
+	for _, bad := range []string{"300.1.1.1", "10.0.0.0/33", "lan,example.com"} {
+		if err := l.Set(bad); err == nil {
+			t.Errorf("Set(%q) took it", bad)
+		}
+	}
+}
+
+func TestMayTest(t *testing.T) {
+	list := func(s string) netList {
+		var l netList
+		if err := l.Set(s); err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	for _, c := range []struct {
+		allow, deny, addr string
+		want              bool
+	}{
+		{"", "", "198.51.100.1", true},
+		{"lan", "", "192.168.1.10", true},
+		{"lan", "", "198.51.100.1", false},
+		{"", "198.51.100.0/24", "198.51.100.1", false},
+		{"", "198.51.100.0/24", "198.51.101.1", true},
+		// deny wins over allow
+		{"lan", "192.168.1.10", "192.168.1.10", false},
+		{"lan", "192.168.1.10", "192.168.1.11", true},
+	} {
+		t.Run(c.allow+"|"+c.deny+"|"+c.addr, func(t *testing.T) {
+			withConfig(t, func(cf *config) { cf.Allow, cf.Deny = list(c.allow), list(c.deny) })
+			if got := mayTestFrom(netip.MustParseAddr(c.addr)); got != c.want {
+				t.Errorf("mayTestFrom = %t, want %t", got, c.want)
+			}
+		})
+	}
+}
+
+func TestAccess(t *testing.T) {
+	var l netList
+	l.Set("lan")
+	withConfig(t, func(c *config) { c.Allow = l })
+	h := access(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, c := range []struct {
+		path, remote, xff string
+		want              int
+	}{
+		{"/download", "192.168.1.10:1", "", http.StatusOK},
+		{"/download", "198.51.100.1:1", "", http.StatusForbidden},
+		{"/pair", "198.51.100.1:1", "", http.StatusForbidden},
+		{"/", "198.51.100.1:1", "", http.StatusForbidden},
+		// result pages stay open to everyone
+		{"/r/0123456789abcdef", "198.51.100.1:1", "", http.StatusOK},
+		// a made-up X-Forwarded-For doesn't get a visitor in
+		{"/download", "198.51.100.1:1", "192.168.1.10", http.StatusForbidden},
+		// a proxy on this machine passes its visitor on
+		{"/download", "127.0.0.1:1", "198.51.100.1", http.StatusForbidden},
+		{"/download", "127.0.0.1:1", "192.168.1.10", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", c.path, nil)
+		r.RemoteAddr = c.remote
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s from %s (XFF %q): %d, want %d", c.path, c.remote, c.xff, w.Code, c.want)
+		}
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	for _, c := range []struct {
+		origin, site string
+		want         bool
+	}{
+		{"", "", true},
+		{"http://example.com", "", true},
+		{"http://example.com:8080", "", false},
+		{"http://evil.test", "", false},
+		{"", "cross-site", false},
+		{"", "same-origin", true},
+		{"::bad", "", false},
+	} {
+		r := httptest.NewRequest("POST", "http://example.com/admin/reload", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if c.site != "" {
+			r.Header.Set("Sec-Fetch-Site", c.site)
+		}
+		if got := sameOrigin(r); got != c.want {
+			t.Errorf("sameOrigin(Origin %q, Sec-Fetch-Site %q) = %t, want %t", c.origin, c.site, got, c.want)
+		}
+	}
+}
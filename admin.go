@@ -0,0 +1,189 @@
+//go:build !minimal && !noadmin
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	register(subsystem{
+		name: "admin",
+		flags: func() {
+			flag.StringVar(&settings.AdminUser, "admin-user", settings.AdminUser, "user name for HTTP basic auth on /admin and everything under it (with -admin-password)")
+			flag.StringVar(&settings.AdminPassword, "admin-password", settings.AdminPassword, "password for -admin-user")
+			flag.StringVar(&settings.AdminToken, "admin-token", settings.AdminToken, "bearer token that also opens /admin and everything under it, for scripts and \"blurr top -token\"")
+		},
+		start: func() {
+			if (cfg().AdminUser == "") != (cfg().AdminPassword == "") {
+				mustFix("-admin-user and -admin-password: only one is set", "Set both for basic auth, or neither.")
+			}
+		},
+		wrap: adminWrap,
+		routes: func(m *http.ServeMux) {
+			m.HandleFunc("/admin", admin)
+			m.HandleFunc("/admin/api", adminAPI)
+			m.HandleFunc("/admin/purge", adminPurge)
+			m.HandleFunc("/admin/reload", adminReload)
+		},
+		cmd: "top",
+		run: runTop,
+	})
+}
+
+// adminStatus is what /admin/api reports, for "blurr top" and other tools.
+type adminStatus struct {
+	Version string   `json:"version"`
+	Active  int      `json:"active"`
+	Waiting int      `json:"waiting"`
+	Today   int64    `json:"traffic_today_bytes"`
+	Budget  int64    `json:"daily_budget_bytes,omitempty"`
+	Running []result `json:"running"`
+	Recent  []result `json:"recent"`
+}
+
+func adminAPI(w http.ResponseWriter, r *http.Request) {
+	st := adminStatus{Version: version, Today: budget.today(), Budget: int64(cfg().DailyBytes)}
+	st.Active, st.Waiting = q.stats()
+	st.Running, st.Recent = recentResults(20)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&st)
+}
+
+func admin(w http.ResponseWriter, r *http.Request) {
+	active, waiting := q.stats()
+	fragments := ""
+	eachSubsystem(func(s subsystem) {
+		if s.admin != nil {
+			fragments += s.admin()
+		}
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, `<!doctype html>
+<html><head><meta charset="utf-8"><title>Blurr admin</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Arial;max-width:760px;margin:1rem}td{padding:0 1rem 0 0}</style>
+</head><body>
+<h2>Blurr admin</h2>
+`+fragments+`<table>
+<tr><td>Version</td><td>`+html.EscapeString(version)+`</td></tr>
+<tr><td>Active tests</td><td>`+strconv.Itoa(active)+`</td></tr>
+<tr><td>Waiting in line</td><td>`+strconv.Itoa(waiting)+`</td></tr>
+<tr><td>Traffic today</td><td>`+budgetUse()+`</td></tr>
+</table>
+<h3>Stored results</h3>
+<form method="post" action="/admin/purge">Delete every result older than <input name="days" size="3" value="`+strconv.Itoa(cfg().RetentionDays)+`"> days (0 = all of them) <button>Purge now</button></form>
+`+reloadForm()+`</body></html>`)
+}
+
+func reloadForm() string {
+	if configPath == "" {
+		return ""
+	}
+	return `<h3>Configuration</h3>
+<form method="post" action="/admin/reload">Read <code>` + html.EscapeString(configPath) + `</code> again and apply the changes <button>Reload</button></form>
+`
+}
+
+// adminReload is SIGHUP over HTTP; it answers in plain text, for scripts
+// and the form alike.
+func adminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	changed, restart, err := reloadConfig()
+	if err != nil {
+		http.Error(w, "reload failed: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "changed: "+listOrNone(changed)+"\n")
+	if len(restart) > 0 {
+		io.WriteString(w, "needs a restart: "+strings.Join(restart, ", ")+"\n")
+	}
+}
+
+func adminPurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil || days < 0 {
+		http.Error(w, "days must be a whole number, 0 or more", http.StatusBadRequest)
+		return
+	}
+	n := purgeOlder(days)
+	log.Printf("admin: purged %d results older than %d days req=%s", n, days, requestID(r))
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// adminLocked reports whether /admin asks for credentials. Without any it
+// only answers callers on the same machine.
+func adminLocked() bool { return cfg().AdminToken != "" || cfg().AdminUser != "" }
+
+// adminAuthed reports whether r carries the -admin-token as a bearer token
+// or -admin-user and -admin-password as basic auth.
+func adminAuthed(r *http.Request) bool {
+	same := func(a, b string) bool { return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1 }
+	if t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return cfg().AdminToken != "" && same(t, cfg().AdminToken)
+	}
+	u, p, ok := r.BasicAuth()
+	// both compared, so a wrong user name takes as long as a wrong password
+	return ok && cfg().AdminUser != "" && same(u, cfg().AdminUser) && same(p, cfg().AdminPassword)
+}
+
+// adminWrap guards /admin and everything under it: the dashboard, its API,
+// the purge, reload and capture forms and the profiles. A form posted from
+// another site is refused, locked or not, since the browser would send the
+// basic auth along or, unlocked, is itself on the same machine.
+func adminWrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin" && !strings.HasPrefix(r.URL.Path, "/admin/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !sameOrigin(r) {
+			http.Error(w, "Cross-site request refused", http.StatusForbidden)
+			return
+		}
+		if !adminLocked() {
+			if !testerAddr(r).IsLoopback() {
+				http.Error(w, "Forbidden: without -admin-user or -admin-token, /admin only answers this machine", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !adminAuthed(r) {
+			if cfg().AdminUser != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="blurr admin", charset="UTF-8"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="blurr admin"`)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func budgetUse() string {
+	s := fmtBytes(budget.today())
+	if cfg().DailyBytes > 0 {
+		s += " of " + fmtBytes(int64(cfg().DailyBytes))
+	}
+	return s
+}
@@ -0,0 +1,67 @@
+//go:build !minimal && !noadmin
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminWrap(t *testing.T) {
+	h := adminWrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	type req struct {
+		method, path, remote, xff, origin, token, user, pass string
+		want                                                 int
+	}
+	run := func(t *testing.T, cases []req) {
+		for _, c := range cases {
+			r := httptest.NewRequest(c.method, "http://blurr.test"+c.path, nil)
+			r.RemoteAddr = c.remote
+			for k, v := range map[string]string{"X-Forwarded-For": c.xff, "Origin": c.origin} {
+				if v != "" {
+					r.Header.Set(k, v)
+				}
+			}
+			if c.token != "" {
+				r.Header.Set("Authorization", "Bearer "+c.token)
+			}
+			if c.user != "" {
+				r.SetBasicAuth(c.user, c.pass)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != c.want {
+				t.Errorf("%+v: %d", c, w.Code)
+			}
+		}
+	}
+	const local, remote = "127.0.0.1:1", "198.51.100.1:1"
+	t.Run("unlocked", func(t *testing.T) {
+		withConfig(t, func(c *config) { c.AdminToken, c.AdminUser, c.AdminPassword = "", "", "" })
+		run(t, []req{
+			{method: "GET", path: "/admin", remote: local, want: http.StatusOK},
+			{method: "POST", path: "/admin/reload", remote: local, origin: "http://blurr.test", want: http.StatusOK},
+			{method: "GET", path: "/admin", remote: remote, want: http.StatusForbidden},
+			// a reverse proxy's visitor isn't on this machine
+			{method: "GET", path: "/admin", remote: local, xff: "198.51.100.1", want: http.StatusForbidden},
+			// a page elsewhere can't post the forms through the operator's browser
+			{method: "POST", path: "/admin/purge", remote: local, origin: "http://evil.test", want: http.StatusForbidden},
+			{method: "GET", path: "/", remote: remote, want: http.StatusOK},
+		})
+	})
+	t.Run("locked", func(t *testing.T) {
+		withConfig(t, func(c *config) { c.AdminToken, c.AdminUser, c.AdminPassword = "tok", "root", "pw" })
+		run(t, []req{
+			{method: "GET", path: "/admin", remote: remote, want: http.StatusUnauthorized},
+			{method: "GET", path: "/admin", remote: remote, token: "tok", want: http.StatusOK},
+			{method: "GET", path: "/admin/api", remote: remote, token: "nope", want: http.StatusUnauthorized},
+			{method: "GET", path: "/admin", remote: remote, user: "root", pass: "pw", want: http.StatusOK},
+			{method: "GET", path: "/admin", remote: remote, user: "root", pass: "tok", want: http.StatusUnauthorized},
+			{method: "POST", path: "/admin/reload", remote: remote, token: "tok", origin: "http://blurr.test", want: http.StatusOK},
+			{method: "POST", path: "/admin/reload", remote: remote, user: "root", pass: "pw", origin: "http://evil.test", want: http.StatusForbidden},
+			// /administrator isn't under /admin
+			{method: "GET", path: "/administrator", remote: remote, want: http.StatusOK},
+		})
+	})
+}
@@ -0,0 +1,140 @@
+//go:build !minimal && !noapitokens
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// -api-tokens restricts the endpoints scripts use on their own (the raw
+// upload, payload hashes, /demo.bin, ndt7, the stats and server lists) to
+// holders of a token, each with its own hourly request limit, so monitoring
+// can keep its access on a public instance without opening it to everyone.
+// The browser test and the pages around it stay open, and so do a result's
+// JSON and samples: like its page, knowing the ID is access enough.
+var apiPaths = []string{"/api/upload", "/api/v1/payload-hash", "/api/v1/servers", "/api/v1/links", "/api/stats", "/demo.bin", "/ndt/"}
+
+type apiToken struct {
+	name, secret string
+	perHour      int
+	hits         *sliding
+	requests     atomic.Int64
+	refused      atomic.Int64
+}
+
+var apiTokens []*apiToken
+
+func init() {
+	register(subsystem{
+		name: "apitokens",
+		flags: func() {
+			flag.StringVar(&settings.APITokens, "api-tokens", settings.APITokens, "restrict the scripted endpoints to these tokens: name:token[:requests-per-hour],... (0 or none = unlimited)")
+		},
+		start:   parseAPITokens,
+		wrap:    apiWrap,
+		metrics: apiMetrics,
+	})
+}
+
+func parseAPITokens() {
+	if cfg().APITokens == "" {
+		return
+	}
+	seen := map[string]bool{}
+	for _, spec := range strings.Split(cfg().APITokens, ",") {
+		f := strings.Split(strings.TrimSpace(spec), ":")
+		t := &apiToken{}
+		var err error
+		switch {
+		case len(f) < 2 || len(f) > 3 || f[0] == "" || f[1] == "":
+			err = errors.New("want name:token[:requests-per-hour]")
+		case seen[f[0]]:
+			err = errors.New("name used twice")
+		case len(f) == 3:
+			t.perHour, err = strconv.Atoi(f[2])
+			if err == nil && t.perHour < 0 {
+				err = errors.New("negative limit")
+			}
+		}
+		if err != nil {
+			mustFix("-api-tokens "+strconv.Quote(f[0])+": "+err.Error(), "List tokens as name:token or name:token:requests-per-hour, separated by commas.")
+			continue
+		}
+		seen[f[0]] = true
+		t.name, t.secret = f[0], f[1]
+		n := t.perHour
+		t.hits = &sliding{hits: map[string][]time.Time{}, window: time.Hour, max: func() int { return n }}
+		apiTokens = append(apiTokens, t)
+	}
+}
+
+func apiRestricted(path string) bool {
+	for _, p := range apiPaths {
+		if path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenOf finds the token r carries as "Authorization: Bearer".
+func tokenOf(r *http.Request) *apiToken {
+	s, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+	var found *apiToken
+	for _, t := range apiTokens {
+		// every token compared, so the time taken doesn't tell which matched
+		if subtle.ConstantTimeCompare([]byte(s), []byte(t.secret)) == 1 {
+			found = t
+		}
+	}
+	return found
+}
+
+func apiWrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(apiTokens) == 0 || !apiRestricted(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		t := tokenOf(r)
+		if t == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="blurr api"`)
+			http.Error(w, "This endpoint needs an API token (Authorization: Bearer ...).", http.StatusUnauthorized)
+			return
+		}
+		t.requests.Add(1)
+		if !t.hits.allow(t.name) {
+			t.refused.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(t.hits.wait(t.name).Seconds())+1))
+			http.Error(w, "token "+t.name+" is over its "+strconv.Itoa(t.perHour)+" requests per hour", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func apiMetrics(w io.Writer) {
+	if len(apiTokens) == 0 {
+		return
+	}
+	io.WriteString(w, "# TYPE blurr_api_requests_total counter\n")
+	for _, t := range apiTokens {
+		fmt.Fprintf(w, "blurr_api_requests_total{token=%s} %d\n", strconv.Quote(t.name), t.requests.Load())
+	}
+	io.WriteString(w, "# TYPE blurr_api_refused_total counter\n")
+	for _, t := range apiTokens {
+		fmt.Fprintf(w, "blurr_api_refused_total{token=%s} %d\n", strconv.Quote(t.name), t.refused.Load())
+	}
+}
@@ -0,0 +1,186 @@
+//go:build !minimal && !noasn
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// With -asn-db the server looks up which network each client tests from,
+// in a local copy of the iptoasn.com ip2asn-combined.tsv(.gz) table (start,
+// end, AS number, country, name per line), shows it on the result and
+// keeps per-ISP totals for the admin page. Nothing is looked up remotely.
+type asnRange struct {
+	start, end net.IP // 16-byte form
+	asn        int
+	name       string
+}
+
+var asnDB struct {
+	once   sync.Once
+	ranges []asnRange
+
+	mu    sync.Mutex
+	stats map[int]*ispStat
+}
+
+// ispStat is what the admin page shows per network since the server started.
+type ispStat struct {
+	name     string
+	tests    int
+	down, up float64 // sums
+}
+
+const maxISPs = 10000
+
+const asnFix = "Download ip2asn-combined.tsv.gz from https://iptoasn.com/ and point -asn-db at it, or drop -asn-db."
+
+func init() {
+	register(subsystem{
+		name: "asn",
+		flags: func() {
+			flag.StringVar(&settings.ASNDB, "asn-db", settings.ASNDB, "ip2asn-combined.tsv(.gz) file to look up each client's network (ASN and ISP name)")
+		},
+		start:  func() { asnDB.once.Do(loadASN) },
+		begin:  asnSession,
+		result: asnRow,
+		done:   asnDone,
+		admin:  asnAdmin,
+	})
+}
+
+// A database that won't load is a startup problem; past startup, tests
+// go on without network names and /readyz shows asn degraded.
+func asnFailed(err error) {
+	degraded("asn-db: "+err.Error(), asnFix)
+	setHealth("asn", err)
+}
+
+func loadASN() {
+	if cfg().ASNDB == "" {
+		return
+	}
+	f, err := os.Open(cfg().ASNDB)
+	if err != nil {
+		asnFailed(err)
+		return
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(cfg().ASNDB, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			asnFailed(err)
+			return
+		}
+		r = gz
+	}
+	var rs []asnRange
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		f := strings.Split(sc.Text(), "\t")
+		if len(f) < 5 {
+			continue
+		}
+		start, end := net.ParseIP(f[0]), net.ParseIP(f[1])
+		asn, err := strconv.Atoi(f[2])
+		if start == nil || end == nil || err != nil || asn == 0 {
+			continue // "Not routed" ranges have AS 0
+		}
+		rs = append(rs, asnRange{start.To16(), end.To16(), asn, f[4]})
+	}
+	if err := sc.Err(); err != nil {
+		asnFailed(err)
+		return
+	}
+	sort.Slice(rs, func(i, j int) bool { return bytes.Compare(rs[i].start, rs[j].start) < 0 })
+	asnDB.ranges = rs
+	log.Printf("asn-db: %d ranges", len(rs))
+	setHealth("asn", nil)
+}
+
+func lookupASN(ip net.IP) (int, string) {
+	asnDB.once.Do(loadASN)
+	ip = ip.To16()
+	rs := asnDB.ranges
+	i := sort.Search(len(rs), func(i int) bool { return bytes.Compare(rs[i].start, ip) > 0 }) - 1
+	if i < 0 || bytes.Compare(ip, rs[i].end) > 0 {
+		return 0, ""
+	}
+	return rs[i].asn, rs[i].name
+}
+
+func asnSession(s *session) {
+	if cfg().ASNDB == "" {
+		return
+	}
+	ip := net.ParseIP(s.addr)
+	if ip == nil {
+		return
+	}
+	if asn, name := lookupASN(ip); asn != 0 {
+		s.update(func(r *result) { r.ASN, r.ISP = asn, name })
+	}
+}
+
+func asnRow(res *result) string {
+	if res.ASN == 0 {
+		return ""
+	}
+	return "<p>Network: AS" + strconv.Itoa(res.ASN) + " " + html.EscapeString(res.ISP) + "</p>\n"
+}
+
+func asnDone(_ *http.Request, res *result) {
+	if res.ASN == 0 {
+		return
+	}
+	asnDB.mu.Lock()
+	defer asnDB.mu.Unlock()
+	if asnDB.stats == nil {
+		asnDB.stats = map[int]*ispStat{}
+	}
+	st := asnDB.stats[res.ASN]
+	if st == nil {
+		if len(asnDB.stats) >= maxISPs {
+			return
+		}
+		st = &ispStat{name: res.ISP}
+		asnDB.stats[res.ASN] = st
+	}
+	st.tests++
+	st.down += res.Down
+	st.up += res.Up
+}
+
+func asnAdmin() string {
+	asnDB.mu.Lock()
+	defer asnDB.mu.Unlock()
+	if len(asnDB.stats) == 0 {
+		return ""
+	}
+	asns := make([]int, 0, len(asnDB.stats))
+	for a := range asnDB.stats {
+		asns = append(asns, a)
+	}
+	sort.Slice(asns, func(i, j int) bool { return asnDB.stats[asns[i]].tests > asnDB.stats[asns[j]].tests })
+	s := "<h3>Networks since start</h3>\n<table>\n<tr><th>Network</th><th>Tests</th><th>Average download</th><th>Average upload</th></tr>\n"
+	for _, a := range asns[:min(len(asns), 20)] {
+		st := asnDB.stats[a]
+		n := float64(st.tests)
+		s += "<tr><td>AS" + strconv.Itoa(a) + " " + html.EscapeString(st.name) + "</td><td>" + strconv.Itoa(st.tests) + "</td><td>" + mibps(st.down/n) + "</td><td>" + mibps(st.up/n) + "</td></tr>\n"
+	}
+	return s + "</table>\n"
+}
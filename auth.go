@@ -0,0 +1,164 @@
+//go:build !minimal && !noauth
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// -auth-user and -auth-password, or an htpasswd file of bcrypt lines, put
+// basic auth in front of every page and test, for private instances that a
+// reverse proxy exposes. /readyz stays open for the proxy's health checks,
+// and /admin keeps its own credentials when it has any. Scripts pass the
+// credentials as usual, e.g. curl -u user:pass.
+//
+// authUsers maps a name to its bcrypt hash, from -auth-file. authSeen
+// remembers passwords bcrypt has already passed, keyed by the file line
+// they matched, so a test's pings don't each pay for a hash and a changed
+// line stops matching at once; authSlots keeps wrong guesses from tying up
+// every CPU.
+var (
+	authMu    sync.Mutex
+	authUsers map[string]string
+	authSeen  = map[[32]byte]bool{}
+	authSlots = make(chan struct{}, 2)
+)
+
+// authSeenCap bounds authSeen; when it fills up it starts over.
+const authSeenCap = 1024
+
+func init() {
+	register(subsystem{
+		name: "auth",
+		flags: func() {
+			flag.StringVar(&settings.AuthUser, "auth-user", settings.AuthUser, "user name for HTTP basic auth on the whole site (with -auth-password)")
+			flag.StringVar(&settings.AuthPassword, "auth-password", settings.AuthPassword, "password for -auth-user")
+			flag.StringVar(&settings.AuthFile, "auth-file", settings.AuthFile, "htpasswd file of user:bcrypt lines (htpasswd -B) for HTTP basic auth on the whole site")
+		},
+		start:  loadAuth,
+		wrap:   authWrap,
+		reload: reloadAuth,
+	})
+}
+
+func loadAuth() {
+	if (cfg().AuthUser == "") != (cfg().AuthPassword == "") {
+		mustFix("-auth-user and -auth-password: only one is set", "Set both for basic auth, or neither.")
+	}
+	if cfg().AuthFile != "" {
+		setAuthUsers(readAuthFile(cfg().AuthFile, mustFix))
+	}
+}
+
+// reloadAuth reads -auth-file again on a reload, so users added, changed or
+// removed with htpasswd take effect without a restart. A file that no
+// longer reads cleanly keeps the users from before.
+func reloadAuth() {
+	if cfg().AuthFile == "" {
+		return
+	}
+	var bad string
+	users := readAuthFile(cfg().AuthFile, func(what, _ string) {
+		if bad == "" {
+			bad = what
+		}
+	})
+	if bad != "" {
+		log.Printf("reload: %s; keeping the users from before", bad)
+		return
+	}
+	setAuthUsers(users)
+}
+
+func setAuthUsers(users map[string]string) {
+	authMu.Lock()
+	authUsers = users
+	clear(authSeen)
+	authMu.Unlock()
+}
+
+// readAuthFile reads an htpasswd file, telling bad about each line it
+// can't use.
+func readAuthFile(path string, bad func(what, fix string)) map[string]string {
+	f, err := os.Open(path)
+	if err != nil {
+		bad("-auth-file: "+err.Error(), "Point -auth-file at a file made with \"htpasswd -B -c FILE USER\".")
+		return nil
+	}
+	defer f.Close()
+	users := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		user, hash, _ := strings.Cut(line, ":")
+		if _, _, _, err := parseBcrypt(hash); user == "" || err != nil {
+			bad("-auth-file "+path+" line "+strconv.Itoa(n)+": want user:bcrypt hash", "Only bcrypt lines work; add or update users with \"htpasswd -B FILE USER\".")
+			continue
+		}
+		users[user] = hash
+	}
+	if len(users) == 0 {
+		bad("-auth-file "+path+": no users", "Add one with \"htpasswd -B FILE USER\".")
+	}
+	return users
+}
+
+func authOn() bool { return cfg().siteAuth() }
+
+func authOK(user, pass string) bool {
+	same := func(a, b string) bool { return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1 }
+	if cfg().AuthUser != "" && same(user, cfg().AuthUser) && same(pass, cfg().AuthPassword) {
+		return true
+	}
+	authMu.Lock()
+	hash, found := authUsers[user]
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + pass))
+	seen := authSeen[key]
+	authMu.Unlock()
+	if !found {
+		return false
+	}
+	if seen {
+		return true
+	}
+	authSlots <- struct{}{}
+	ok := bcryptOK(hash, pass)
+	<-authSlots
+	if ok {
+		authMu.Lock()
+		if len(authSeen) >= authSeenCap {
+			clear(authSeen)
+		}
+		authSeen[key] = true
+		authMu.Unlock()
+	}
+	return ok
+}
+
+func authWrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin := r.URL.Path == "/admin" || strings.HasPrefix(r.URL.Path, "/admin/")
+		if !authOn() || r.URL.Path == "/readyz" || admin && (cfg().AdminUser != "" || cfg().AdminToken != "") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if u, p, ok := r.BasicAuth(); !ok || !authOK(u, p) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+strings.ReplaceAll(brandFor(r).plain(), `"`, "'")+`", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
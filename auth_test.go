@@ -0,0 +1,136 @@
+//go:build !minimal && !noauth
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// authGet is the status h answers a GET of path with, as user if any; a
+// 401 without a challenge comes back as 0.
+func authGet(h http.Handler, path, user, pass string) int {
+	r := httptest.NewRequest("GET", path, nil)
+	if user != "" {
+		r.SetBasicAuth(user, pass)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+		return 0
+	}
+	return w.Code
+}
+
+func TestAuthWrap(t *testing.T) {
+	withConfig(t, func(c *config) { c.AuthUser, c.AuthPassword, c.AdminToken = "ann", "secret", "" })
+	h := authWrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, c := range []struct {
+		path, user, pass string
+		want             int
+	}{
+		{"/", "", "", http.StatusUnauthorized},
+		{"/download", "ann", "wrong", http.StatusUnauthorized},
+		{"/download", "bob", "secret", http.StatusUnauthorized},
+		{"/download", "ann", "secret", http.StatusOK},
+		{"/readyz", "", "", http.StatusOK},
+		// /admin is behind the site's auth until it has its own
+		{"/admin", "", "", http.StatusUnauthorized},
+	} {
+		if got := authGet(h, c.path, c.user, c.pass); got != c.want {
+			t.Errorf("%s as %q/%q: %d, want %d", c.path, c.user, c.pass, got, c.want)
+		}
+	}
+	withConfig(t, func(c *config) { c.AdminToken = "t" })
+	if got := authGet(h, "/admin/reload", "", ""); got != http.StatusOK {
+		t.Errorf("/admin with its own token: %d, want it passed on to adminWrap", got)
+	}
+	withConfig(t, func(c *config) { c.AuthUser, c.AuthPassword = "", "" })
+	if got := authGet(h, "/", "", ""); got != http.StatusOK {
+		t.Errorf("auth off: %d", got)
+	}
+}
+
+func TestAuthFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "U*U" and "U*U*" from the bcrypt vectors
+	write("# users\nann:$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW\n")
+	withConfig(t, func(c *config) { c.AuthUser, c.AuthPassword, c.AuthFile = "", "", path })
+	t.Cleanup(func() { setAuthUsers(nil) })
+	var problems []string
+	setAuthUsers(readAuthFile(path, func(what, _ string) { problems = append(problems, what) }))
+	if len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	h := authWrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 2; i++ {
+		// the second time from the cache
+		if got := authGet(h, "/", "ann", "U*U"); got != http.StatusOK {
+			t.Fatalf("right password, try %d: %d", i+1, got)
+		}
+	}
+	if got := authGet(h, "/", "ann", "U*U*"); got != http.StatusUnauthorized {
+		t.Errorf("wrong password: %d", got)
+	}
+	// a changed password works, and the old one stops working, on reload
+	write("ann:$2a$05$CCCCCCCCCCCCCCCCCCCCC.VGOzA784oUp/Z0DY336zx7pLYAy0lwK\n")
+	reloadAuth()
+	if authGet(h, "/", "ann", "U*U") != http.StatusUnauthorized || authGet(h, "/", "ann", "U*U*") != http.StatusOK {
+		t.Error("the reloaded file didn't take")
+	}
+	// a file that no longer reads keeps the users from before
+	write("ann:{SHA}nope\n")
+	reloadAuth()
+	if got := authGet(h, "/", "ann", "U*U*"); got != http.StatusOK {
+		t.Errorf("after a broken reload: %d", got)
+	}
+}
+
+func TestAuthFileProblems(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []struct{ name, body string }{
+		{"md5", "ann:$apr1$abc$def\n"},
+		{"no user", ":$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW\n"},
+		{"empty", "# nobody\n"},
+	} {
+		path := filepath.Join(dir, c.name)
+		os.WriteFile(path, []byte(c.body), 0o600)
+		n := 0
+		readAuthFile(path, func(string, string) { n++ })
+		if n == 0 {
+			t.Errorf("%s: no problem reported", c.name)
+		}
+	}
+	n := 0
+	readAuthFile(filepath.Join(dir, "missing"), func(string, string) { n++ })
+	if n != 1 {
+		t.Errorf("missing file: %d problems, want 1", n)
+	}
+}
+
+func TestAuthSeenCap(t *testing.T) {
+	t.Cleanup(func() { setAuthUsers(nil) })
+	setAuthUsers(map[string]string{"ann": "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"})
+	authMu.Lock()
+	for i := 0; i < authSeenCap; i++ {
+		authSeen[[32]byte{byte(i), byte(i >> 8), 1}] = true
+	}
+	authMu.Unlock()
+	if !authOK("ann", "U*U") {
+		t.Fatal("right password refused")
+	}
+	authMu.Lock()
+	n := len(authSeen)
+	authMu.Unlock()
+	if n > authSeenCap {
+		t.Errorf("authSeen grew to %d, past its cap of %d", n, authSeenCap)
+	}
+}
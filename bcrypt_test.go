@@ -0,0 +1,40 @@
+//go:build !minimal && !noauth
+
+package main
+
+import "testing"
+
+// Known answers from OpenBSD's and Openwall's bcrypt test vectors.
+var bcryptVectors = []struct{ password, hash string }{
+	{"U*U", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+	{"U*U*", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.VGOzA784oUp/Z0DY336zx7pLYAy0lwK"},
+	{"U*U*U", "$2a$05$XXXXXXXXXXXXXXXXXXXXXOAcXxm9kjPGEMsLznoKqmqw7tc8WCx4a"},
+	{"", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.7uG0VCzI2bS7j6ymqJi9CdcdxiRTWNy"},
+	{"0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789chars after 72 are ignored", "$2a$05$abcdefghijklmnopqrstuu5s2v8.iXieOjg/.AySBTTZIIVFJeBui"},
+	{"U*U", "$2y$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+	{"U*U", "$2b$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+}
+
+func TestBcrypt(t *testing.T) {
+	for _, v := range bcryptVectors {
+		if !bcryptOK(v.hash, v.password) {
+			t.Errorf("bcryptOK(%q, %q) = false, want true", v.hash, v.password)
+		}
+	}
+}
+
+func TestBcryptWrong(t *testing.T) {
+	for _, c := range []struct{ password, hash string }{
+		{"U*V", bcryptVectors[0].hash},
+		{"U*U ", bcryptVectors[0].hash},
+		{"U*U", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRByh0XouQYb4YMJKvyOeW"},
+		{"U*U", "$2a$06$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+		{"U*U", "$1$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+		{"U*U", "$2a$03$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+		{"U*U", ""},
+	} {
+		if bcryptOK(c.hash, c.password) {
+			t.Errorf("bcryptOK(%q, %q) = true, want false", c.hash, c.password)
+		}
+	}
+}
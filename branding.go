@@ -0,0 +1,99 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"strings"
+)
+
+// A brand is what a public instance says about itself on the index and
+// result pages: its name, who runs it, a footer line and a disclaimer
+// (terms of use, what's logged), set with -site-name, -contact, -footer
+// and -disclaimer. All of it is plain text; a blank line in the
+// disclaimer starts a new paragraph.
+type brand struct {
+	Name, Logo, Contact, Footer, Disclaimer string
+}
+
+// brandFor is the brand r's pages carry: the flags', with whatever the
+// vhost r came in for (see -config "hosts") sets instead.
+func brandFor(r *http.Request) *brand {
+	b := &brand{cfg().SiteName, cfg().Logo, cfg().Contact, cfg().Footer, cfg().Disclaimer}
+	v := hostOf(r)
+	if v == nil {
+		return b
+	}
+	set := func(to *string, from string) {
+		if from != "" {
+			*to = from
+		}
+	}
+	set(&b.Name, v.SiteName)
+	set(&b.Logo, v.Logo)
+	set(&b.Contact, v.Contact)
+	set(&b.Footer, v.Footer)
+	set(&b.Disclaimer, v.Disclaimer)
+	return b
+}
+
+func (b *brand) or() *brand {
+	if b == nil {
+		return &brand{Name: cfg().SiteName, Logo: cfg().Logo}
+	}
+	return b
+}
+
+// name is the site's name, escaped for HTML.
+func (b *brand) name() string { return html.EscapeString(b.plain()) }
+
+// heading puts the logo, if there is one, in front of a page heading
+// already escaped for HTML.
+func (b *brand) heading(title string) string {
+	if l := b.or().Logo; l != "" {
+		return `<img src="` + html.EscapeString(l) + `" alt="" height="32" style="vertical-align:middle"> ` + title
+	}
+	return title
+}
+
+func (b *brand) plain() string {
+	if n := b.or().Name; n != "" {
+		return n
+	}
+	return "Blurr"
+}
+
+// about is the disclaimer, then who to contact.
+func (b *brand) about() string {
+	b = b.or()
+	s := ""
+	for _, p := range strings.Split(strings.ReplaceAll(b.Disclaimer, "\r\n", "\n"), "\n\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			s += "<p><small>" + html.EscapeString(p) + "</small></p>\n"
+		}
+	}
+	if c := b.Contact; c != "" {
+		link := c
+		switch {
+		case strings.HasPrefix(c, "https://") || strings.HasPrefix(c, "http://"):
+		case strings.Contains(c, "@") && !strings.ContainsAny(c, " <>"):
+			link = "mailto:" + c
+		default:
+			link = ""
+		}
+		if link != "" {
+			c = `<a href="` + html.EscapeString(link) + `">` + html.EscapeString(c) + `</a>`
+		} else {
+			c = html.EscapeString(c)
+		}
+		s += "<p><small>Run by " + c + "</small></p>\n"
+	}
+	return s
+}
+
+// footer is -footer, or the project's own line.
+func (b *brand) footer() string {
+	if f := b.or().Footer; f != "" {
+		return "<p>" + html.EscapeString(f) + "</p>\n"
+	}
+	return `<span>Donations are not needed. Instead, <a href="https://github.com/gigirassy/Blurr/">consider contributing to the CC0 code</a>.</span>` + "\n"
+}
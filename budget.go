@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// dayBudget counts test traffic (download and upload bytes) per calendar day
+// in the -timezone the pages show, and reports when the configured budget is used up.
+type dayBudget struct {
+	mu   sync.Mutex
+	day  string
+	used int64
+}
+
+var budget dayBudget
+
+func (b *dayBudget) roll() {
+	if d := time.Now().In(cfg().zone()).Format("2006-01-02"); d != b.day {
+		b.day, b.used = d, 0
+	}
+}
+
+func (b *dayBudget) add(n int64) {
+	b.mu.Lock()
+	b.roll()
+	b.used += n
+	b.mu.Unlock()
+}
+
+func (b *dayBudget) today() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	return b.used
+}
+
+func (b *dayBudget) exhausted() bool {
+	return cfg().DailyBytes > 0 && b.today() >= int64(cfg().DailyBytes)
+}
+
+func budgetReset() time.Time {
+	y, m, d := time.Now().In(cfg().zone()).Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, cfg().zone())
+}
+
+func budgetPage(w http.ResponseWriter, r *http.Request) {
+	b := brandFor(r)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	io.WriteString(w, `<!doctype html>
+<html><head><meta charset="utf-8"><title>`+b.name()+` (daily limit reached)</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Arial;max-width:760px;margin:1rem}</style>
+</head><body>
+<h2>`+b.heading(b.name())+`</h2>
+<p>This instance has used its bandwidth allowance of `+fmtBytes(int64(cfg().DailyBytes))+` for today, so tests are paused.</p>
+<p>Testing resumes at `+budgetReset().Format("15:04 MST")+`.</p>
+</body></html>`)
+}
@@ -0,0 +1,286 @@
+//go:build !minimal && !noadmin && !nocapture
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"html"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// With -capture the admin page can record a session's packets for a while
+// and offer them as a pcap file, for looking at a misbehaving client
+// without a shell on the box. It reads every interface through an
+// AF_PACKET socket, which needs root or CAP_NET_RAW, and keeps the first
+// captureSnap bytes of each TCP packet between the client's address and
+// one of our listening ports.
+const (
+	captureSnap  = 256
+	captureMax   = 16 << 20
+	captureKeep  = 5
+	captureLimit = time.Minute
+)
+
+type capture struct {
+	id      int
+	sid, ip string
+	start   time.Time
+	dur     time.Duration
+	packets int
+	data    bytes.Buffer
+	done    bool
+	err     string
+}
+
+var captures struct {
+	sync.Mutex
+	list []*capture
+	next int
+}
+
+func init() {
+	register(subsystem{
+		name: "capture",
+		flags: func() {
+			flag.BoolVar(&settings.Capture, "capture", settings.Capture, "let /admin record a session's packets as a pcap file (needs CAP_NET_RAW)")
+		},
+		routes: func(m *http.ServeMux) {
+			m.HandleFunc("/admin/capture", startCapture)
+			m.HandleFunc("/admin/capture/", captureFile)
+		},
+		start: func() {
+			if !cfg().Capture {
+				return
+			}
+			fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
+			if err != nil {
+				degraded("capture: "+err.Error(), "Run as root or give the binary CAP_NET_RAW (setcap cap_net_raw+ep blurr), or drop -capture.")
+				tune(func(c *config) { c.Capture = false })
+				return
+			}
+			syscall.Close(fd)
+		},
+		admin: captureAdmin,
+		purge: purgeCaptures,
+	})
+}
+
+// purgeCaptures drops finished captures of the tests being purged; the
+// results themselves live elsewhere.
+func purgeCaptures(keep func(*result) bool) []string {
+	captures.Lock()
+	defer captures.Unlock()
+	kept := captures.list[:0]
+	for _, c := range captures.list {
+		if !c.done || keep(&result{ID: c.sid, Time: c.start}) {
+			kept = append(kept, c)
+		}
+	}
+	clear(captures.list[len(kept):])
+	captures.list = kept
+	return nil
+}
+
+func startCapture(w http.ResponseWriter, r *http.Request) {
+	if !cfg().Capture {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	s := getSession(r.FormValue("sid"))
+	if s == nil {
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+	secs, _ := strconv.Atoi(r.FormValue("secs"))
+	dur := min(max(time.Duration(secs)*time.Second, time.Second), captureLimit)
+	captures.Lock()
+	for _, c := range captures.list {
+		if !c.done {
+			captures.Unlock()
+			http.Error(w, "a capture is already running", http.StatusConflict)
+			return
+		}
+	}
+	captures.next++
+	c := &capture{id: captures.next, sid: s.res.ID, ip: s.addr, start: time.Now(), dur: dur}
+	captures.list = append(captures.list, c)
+	if len(captures.list) > captureKeep {
+		captures.list = captures.list[1:]
+	}
+	captures.Unlock()
+	go c.run()
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+func (c *capture) run() {
+	err := c.capture()
+	captures.Lock()
+	defer captures.Unlock()
+	if err != nil {
+		c.err = err.Error()
+		log.Printf("capture %d: %v", c.id, err)
+	}
+	c.done = true
+}
+
+func (c *capture) capture() error {
+	ip := net.ParseIP(c.ip)
+	if ip == nil {
+		return &net.AddrError{Err: "not an IP address", Addr: c.ip}
+	}
+	ports := listenPorts()
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	tv := syscall.NsecToTimeval(int64(200 * time.Millisecond))
+	syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+
+	captures.Lock()
+	// pcap file header: microsecond timestamps, version 2.4, Ethernet
+	hdr := []byte{0xd4, 0xc3, 0xb2, 0xa1, 2, 0, 4, 0}
+	hdr = binary.LittleEndian.AppendUint64(hdr, 0)
+	hdr = binary.LittleEndian.AppendUint32(hdr, captureSnap)
+	hdr = binary.LittleEndian.AppendUint32(hdr, 1)
+	c.data.Write(hdr)
+	captures.Unlock()
+
+	b := make([]byte, 65536)
+	for until := c.start.Add(c.dur); time.Now().Before(until); {
+		n, from, err := syscall.Recvfrom(fd, b, 0)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// loopback shows every packet leaving and arriving; keep one copy
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Hatype == syscall.ARPHRD_LOOPBACK && ll.Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+		if !capturePacket(b[:n], ip, ports) {
+			continue
+		}
+		now := time.Now()
+		rec := binary.LittleEndian.AppendUint32(nil, uint32(now.Unix()))
+		rec = binary.LittleEndian.AppendUint32(rec, uint32(now.Nanosecond()/1000))
+		rec = binary.LittleEndian.AppendUint32(rec, uint32(min(n, captureSnap)))
+		rec = binary.LittleEndian.AppendUint32(rec, uint32(n))
+		captures.Lock()
+		full := c.data.Len()+len(rec)+min(n, captureSnap) > captureMax
+		if !full {
+			c.data.Write(rec)
+			c.data.Write(b[:min(n, captureSnap)])
+			c.packets++
+		}
+		captures.Unlock()
+		if full {
+			return nil
+		}
+	}
+	return nil
+}
+
+// capturePacket reports whether an Ethernet frame is TCP between ip and
+// one of ports on our side.
+func capturePacket(f []byte, ip net.IP, ports map[uint16]bool) bool {
+	if len(f) < 14 {
+		return false
+	}
+	var src, dst net.IP
+	var tcp []byte
+	switch binary.BigEndian.Uint16(f[12:]) {
+	case 0x0800:
+		p := f[14:]
+		if len(p) < 20 || p[9] != syscall.IPPROTO_TCP {
+			return false
+		}
+		src, dst, tcp = p[12:16], p[16:20], p[int(p[0]&0xf)*4:]
+	case 0x86dd:
+		p := f[14:]
+		if len(p) < 40 || p[6] != syscall.IPPROTO_TCP {
+			return false
+		}
+		src, dst, tcp = p[8:24], p[24:40], p[40:]
+	default:
+		return false
+	}
+	if len(tcp) < 4 {
+		return false
+	}
+	sp, dp := binary.BigEndian.Uint16(tcp), binary.BigEndian.Uint16(tcp[2:])
+	return ip.Equal(src) && ports[dp] || ip.Equal(dst) && ports[sp]
+}
+
+func listenPorts() map[uint16]bool {
+	ports := map[uint16]bool{}
+	for _, a := range strings.Split(cfg().Addr, ",") {
+		if _, p, err := net.SplitHostPort(a); err == nil {
+			if n, err := strconv.Atoi(p); err == nil {
+				ports[uint16(n)] = true
+			}
+		}
+	}
+	return ports
+}
+
+func htons(v uint16) uint16 { return v<<8 | v>>8 }
+
+func captureFile(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/capture/"), ".pcap"))
+	captures.Lock()
+	defer captures.Unlock()
+	for _, c := range captures.list {
+		if c.id == id && c.done && c.err == "" {
+			w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+			w.Header().Set("Content-Disposition", `attachment; filename="blurr-`+c.sid+`.pcap"`)
+			holdOpen(w, cfg().TransferTimeout)
+			w.Write(c.data.Bytes())
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func captureAdmin() string {
+	if !cfg().Capture {
+		return ""
+	}
+	s := `<h3>Packet capture</h3>
+<form method="post" action="/admin/capture">Session <input name="sid" size="18"> for <input name="secs" value="30" size="3"> seconds <button>Capture</button></form>
+`
+	captures.Lock()
+	defer captures.Unlock()
+	if len(captures.list) == 0 {
+		return s
+	}
+	s += "<ul>\n"
+	for i := len(captures.list) - 1; i >= 0; i-- {
+		c := captures.list[i]
+		s += "<li>" + c.start.Format("15:04:05") + " " + html.EscapeString(c.sid) + " (" + html.EscapeString(c.ip) + ", " + c.dur.String() + "): "
+		switch {
+		case c.err != "":
+			s += "failed: " + html.EscapeString(c.err)
+		case !c.done:
+			s += "running, " + strconv.Itoa(c.packets) + " packets so far"
+		default:
+			s += `<a href="/admin/capture/` + strconv.Itoa(c.id) + `.pcap">` + strconv.Itoa(c.packets) + " packets</a>"
+		}
+		s += "</li>\n"
+	}
+	return s + "</ul>\n"
+}
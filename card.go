@@ -0,0 +1,211 @@
+//go:build !minimal && !nocard
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"unicode"
+)
+
+// /r/<id>.png is a result card: the speeds, ping, time and server drawn
+// on a 600x315 PNG (the shape link previews use), for pasting into a chat
+// or a forum post where a link alone would go unread. There's no font
+// library in the standard one, so it's lettered in a 5x7 pixel font,
+// capitals only. Like the result page it never shows the client address.
+const cardW, cardH = 600, 315
+
+var cardPalette = color.Palette{
+	color.RGBA{0xff, 0xff, 0xff, 0xff}, // background
+	color.RGBA{0x26, 0x32, 0x38, 0xff}, // band, text
+	color.RGBA{0x78, 0x90, 0x9c, 0xff}, // labels
+	color.RGBA{0x15, 0x65, 0xc0, 0xff}, // download, as on the gauges
+	color.RGBA{0x2e, 0x7d, 0x32, 0xff}, // upload
+	color.RGBA{0xec, 0xef, 0xf1, 0xff}, // on the band
+}
+
+const (
+	cardBG = iota
+	cardInk
+	cardGrey
+	cardDown
+	cardUp
+	cardLight
+)
+
+// cardFont has one byte per row, top to bottom, bit 4 the leftmost pixel.
+var cardFont = map[rune][7]byte{
+	'A':  {0x0e, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'B':  {0x1e, 0x11, 0x11, 0x1e, 0x11, 0x11, 0x1e},
+	'C':  {0x0e, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0e},
+	'D':  {0x1e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x1e},
+	'E':  {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x1f},
+	'F':  {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x10},
+	'G':  {0x0e, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0f},
+	'H':  {0x11, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'I':  {0x0e, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'J':  {0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0c},
+	'K':  {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11},
+	'L':  {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1f},
+	'M':  {0x11, 0x1b, 0x15, 0x15, 0x11, 0x11, 0x11},
+	'N':  {0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11},
+	'O':  {0x0e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'P':  {0x1e, 0x11, 0x11, 0x1e, 0x10, 0x10, 0x10},
+	'Q':  {0x0e, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0d},
+	'R':  {0x1e, 0x11, 0x11, 0x1e, 0x14, 0x12, 0x11},
+	'S':  {0x0f, 0x10, 0x10, 0x0e, 0x01, 0x01, 0x1e},
+	'T':  {0x1f, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04},
+	'U':  {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'V':  {0x11, 0x11, 0x11, 0x11, 0x11, 0x0a, 0x04},
+	'W':  {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0a},
+	'X':  {0x11, 0x11, 0x0a, 0x04, 0x0a, 0x11, 0x11},
+	'Y':  {0x11, 0x11, 0x0a, 0x04, 0x04, 0x04, 0x04},
+	'Z':  {0x1f, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1f},
+	'0':  {0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e},
+	'1':  {0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'2':  {0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f},
+	'3':  {0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e},
+	'4':  {0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02},
+	'5':  {0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e},
+	'6':  {0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e},
+	'7':  {0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8':  {0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e},
+	'9':  {0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c},
+	'.':  {0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x0c},
+	',':  {0x00, 0x00, 0x00, 0x00, 0x0c, 0x04, 0x08},
+	':':  {0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x0c, 0x00},
+	'-':  {0x00, 0x00, 0x00, 0x1f, 0x00, 0x00, 0x00},
+	'+':  {0x00, 0x04, 0x04, 0x1f, 0x04, 0x04, 0x00},
+	'/':  {0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x00},
+	'(':  {0x02, 0x04, 0x08, 0x08, 0x08, 0x04, 0x02},
+	')':  {0x08, 0x04, 0x02, 0x02, 0x02, 0x04, 0x08},
+	'%':  {0x18, 0x19, 0x02, 0x04, 0x08, 0x13, 0x03},
+	'_':  {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1f},
+	'\'': {0x04, 0x04, 0x08, 0x00, 0x00, 0x00, 0x00},
+	'&':  {0x0c, 0x12, 0x14, 0x08, 0x15, 0x12, 0x0d},
+	'?':  {0x0e, 0x11, 0x01, 0x02, 0x04, 0x00, 0x04},
+	'#':  {0x0a, 0x0a, 0x1f, 0x0a, 0x1f, 0x0a, 0x0a},
+	'=':  {0x00, 0x00, 0x1f, 0x00, 0x1f, 0x00, 0x00},
+}
+
+func init() {
+	register(subsystem{
+		name: "card",
+		result: func(res *result) string {
+			if !res.Done {
+				return ""
+			}
+			return `<p><a href="/r/` + res.ID + `.png">Result card</a> (an image to share)</p>` + "\n"
+		},
+	})
+	resultCard = writeCard
+}
+
+// cardText letters s at x, y, scale pixels to a dot, and returns where it
+// ends.
+func cardText(img *image.Paletted, x, y, scale int, c uint8, s string) int {
+	for _, ch := range s {
+		g, ok := cardFont[unicode.ToUpper(ch)]
+		if !ok && ch != ' ' {
+			g = cardFont['?']
+		}
+		for row, bits := range g {
+			for col := 0; col < 5; col++ {
+				if bits&(0x10>>col) == 0 {
+					continue
+				}
+				for dy := 0; dy < scale; dy++ {
+					for dx := 0; dx < scale; dx++ {
+						img.SetColorIndex(x+col*scale+dx, y+row*scale+dy, c)
+					}
+				}
+			}
+		}
+		x += 6 * scale
+	}
+	return x
+}
+
+func cardWidth(s string, scale int) int { return len([]rune(s)) * 6 * scale }
+
+// cardFit is the largest scale up to most at which s fits in width.
+func cardFit(s string, width, most int) int {
+	return max(1, min(most, width/max(1, cardWidth(s, 1))))
+}
+
+// cardClip shortens s to what fits in width at scale.
+func cardClip(s string, width, scale int) string {
+	r := []rune(s)
+	if n := width / (6 * scale); len(r) > n {
+		return string(r[:max(n-2, 0)]) + ".."
+	}
+	return s
+}
+
+func cardSpeed(img *image.Paletted, x int, name string, bps float64, c uint8, u unit, l *locale) {
+	cardText(img, x, 82, 2, cardGrey, name)
+	v := "-"
+	if bps > 0 {
+		v = l.num(u.num(bps), 2)
+	}
+	scale := cardFit(v, 270, 7)
+	cardText(img, x, 108+(7-scale)*7/2, scale, c, v)
+	cardText(img, x, 166, 2, cardGrey, u.label())
+}
+
+func writeCard(w http.ResponseWriter, r *http.Request, res *result) {
+	img := image.NewPaletted(image.Rect(0, 0, cardW, cardH), cardPalette)
+	for y := 0; y < 56; y++ {
+		for x := 0; x < cardW; x++ {
+			img.SetColorIndex(x, y, cardInk)
+		}
+	}
+	name := res.brand.plain()
+	scale := cardFit(name, 260, 4)
+	name = cardClip(name, 260, scale)
+	end := cardText(img, 20, 14+(4-scale)*7/2, scale, cardLight, name)
+	server := res.Server
+	if server == "" {
+		server = cfg().Hostname
+	}
+	if res.POP != "" {
+		server = res.POP + " " + server
+	}
+	server = cardClip(server, cardW-40-end, 2)
+	cardText(img, cardW-20-cardWidth(server, 2)+2, 21, 2, cardLight, server)
+
+	cardSpeed(img, 20, "Download", res.Down, cardDown, res.unit, res.loc)
+	cardSpeed(img, 310, "Upload", res.Up, cardUp, res.unit, res.loc)
+	for x := 20; x < cardW-20; x++ {
+		img.SetColorIndex(x, 198, cardGrey)
+	}
+	x := 20
+	if res.Ping > 0 {
+		x = cardText(img, x, 214, 2, cardGrey, "Ping ")
+		x = cardText(img, x, 214, 2, cardInk, res.loc.num(res.Ping, 1)+" ms   ")
+		x = cardText(img, x, 214, 2, cardGrey, "Jitter ")
+		x = cardText(img, x, 214, 2, cardInk, res.loc.num(res.Jitter, 1)+" ms   ")
+	}
+	if res.LoadPing > 0 && res.Ping > 0 {
+		x = cardText(img, x, 214, 2, cardGrey, "Bufferbloat ")
+		cardText(img, x, 214, 2, cardInk, bloatGrade(res.Ping, res.LoadPing))
+	}
+	when := res.Time.UTC().Format("2006-01-02 15:04 UTC")
+	if res.Tor {
+		when += ", through Tor"
+	}
+	cardText(img, 20, 248, 2, cardGrey, when)
+	if res.Label != "" {
+		cardText(img, 20, 276, 2, cardInk, cardClip(res.Label, cardW-40, 2))
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Vary", "Cookie, Accept-Language")
+	if res.Done {
+		w.Header().Set("Cache-Control", "public, max-age=600")
+	} else {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	png.Encode(w, img)
+}
@@ -0,0 +1,182 @@
+//go:build !minimal && !nochaos
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -chaos makes the server misbehave on purpose, to check that the test
+// degrades gracefully on terrible networks: it delays requests, drops
+// connections before answering, stalls responses partway and cuts them
+// short, each at its own rate. Latency is added to every request instead,
+// as a longer path would, with an optional random jitter on top.
+type chaosSpec struct {
+	delay, drop, truncate, stall float64
+	delayFor, stallFor           time.Duration
+	latency, jitter              time.Duration
+}
+
+var chaos chaosSpec
+
+func init() {
+	register(subsystem{
+		name: "chaos",
+		flags: func() {
+			flag.StringVar(&settings.Chaos, "chaos", settings.Chaos, "fault injection for testing, e.g. latency=80ms:20ms,delay=0.2:500ms,stall=0.1:2s,drop=0.05,truncate=0.05 (rates 0-1)")
+		},
+		start: startChaos,
+		wrap:  chaosWrap,
+	})
+}
+
+func parseChaos(s string) (chaosSpec, error) {
+	c := chaosSpec{delayFor: time.Second, stallFor: time.Second}
+	for _, f := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(f), "=")
+		v, d, hasD := strings.Cut(v, ":")
+		if k == "latency" {
+			var err error
+			if c.latency, err = time.ParseDuration(v); err != nil || c.latency < 0 {
+				return c, fmt.Errorf("%q: want latency=DURATION[:JITTER]", f)
+			}
+			if hasD {
+				if c.jitter, err = time.ParseDuration(d); err != nil || c.jitter < 0 {
+					return c, fmt.Errorf("%q: want latency=DURATION[:JITTER]", f)
+				}
+			}
+			continue
+		}
+		p, err := strconv.ParseFloat(v, 64)
+		if err != nil || p < 0 || p > 1 {
+			return c, fmt.Errorf("%q: rate must be between 0 and 1", f)
+		}
+		switch k {
+		case "delay":
+			c.delay = p
+			if hasD {
+				if c.delayFor, err = time.ParseDuration(d); err != nil {
+					return c, fmt.Errorf("%q: %v", f, err)
+				}
+			}
+		case "stall":
+			c.stall = p
+			if hasD {
+				if c.stallFor, err = time.ParseDuration(d); err != nil {
+					return c, fmt.Errorf("%q: %v", f, err)
+				}
+			}
+		case "drop":
+			c.drop = p
+		case "truncate":
+			c.truncate = p
+		default:
+			return c, fmt.Errorf("%q: want latency, delay, stall, drop or truncate", f)
+		}
+	}
+	return c, nil
+}
+
+func startChaos() {
+	if cfg().Chaos == "" {
+		return
+	}
+	c, err := parseChaos(cfg().Chaos)
+	if err != nil {
+		mustFix("-chaos: "+err.Error(), `Give comma-separated faults like "latency=80ms,delay=0.2:500ms,stall=0.1:2s,drop=0.05,truncate=0.05".`)
+		return
+	}
+	chaos = c
+	log.Printf("chaos: adding %s (+%s jitter) to every request, delaying %.0f%% by up to %s, stalling %.0f%% for up to %s, dropping %.0f%%, truncating %.0f%%",
+		c.latency, c.jitter, c.delay*100, c.delayFor, c.stall*100, c.stallFor, c.drop*100, c.truncate*100)
+}
+
+func chaosWrap(h http.Handler) http.Handler {
+	if cfg().Chaos == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if chaos.latency > 0 || chaos.jitter > 0 {
+			time.Sleep(chaos.latency + time.Duration(rand.Int63n(int64(chaos.jitter)+1)))
+		}
+		if rand.Float64() < chaos.delay {
+			time.Sleep(time.Duration(rand.Int63n(int64(chaos.delayFor) + 1)))
+		}
+		if rand.Float64() < chaos.drop {
+			// closes the connection without an answer
+			panic(http.ErrAbortHandler)
+		}
+		if rand.Float64() < chaos.truncate {
+			w = &cutWriter{ResponseWriter: w, left: rand.Int63n(256 << 10)}
+		}
+		if rand.Float64() < chaos.stall {
+			w = &stallWriter{ResponseWriter: w, left: rand.Int63n(256 << 10), pause: time.Duration(rand.Int63n(int64(chaos.stallFor) + 1))}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// cutWriter aborts the response once left bytes have gone out.
+type cutWriter struct {
+	http.ResponseWriter
+	left int64
+}
+
+func (c *cutWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) <= c.left {
+		c.left -= int64(len(b))
+		return c.ResponseWriter.Write(b)
+	}
+	c.ResponseWriter.Write(b[:c.left])
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	panic(http.ErrAbortHandler)
+}
+
+func (c *cutWriter) Unwrap() http.ResponseWriter { return c.ResponseWriter }
+
+func (c *cutWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// stallWriter holds the response for pause once left bytes have gone out,
+// as a link that stops delivering for a while and then recovers.
+type stallWriter struct {
+	http.ResponseWriter
+	left  int64
+	pause time.Duration
+}
+
+func (s *stallWriter) Write(b []byte) (int, error) {
+	if s.left < 0 || int64(len(b)) <= s.left {
+		s.left -= int64(len(b))
+		return s.ResponseWriter.Write(b)
+	}
+	n, err := s.ResponseWriter.Write(b[:s.left])
+	if err != nil {
+		return n, err
+	}
+	s.Flush()
+	time.Sleep(s.pause)
+	m, err := s.ResponseWriter.Write(b[n:])
+	s.left = -1
+	return n + m, err
+}
+
+func (s *stallWriter) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+func (s *stallWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
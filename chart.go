@@ -0,0 +1,133 @@
+//go:build !minimal && !nochart
+
+package main
+
+import (
+	"encoding/csv"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	register(subsystem{
+		name:   "chart",
+		routes: func(m *http.ServeMux) { m.HandleFunc("/api/v1/samples/", samplesCSV) },
+		result: func(res *result) string {
+			return gauges(res) + speedChart(res)
+		},
+	})
+}
+
+// gauges shows the final download and upload figures as speedometers that
+// can be read at a glance on a kiosk screen or a phone.
+func gauges(res *result) string {
+	if !res.Done {
+		return ""
+	}
+	return `<p>` + gauge("Download", res.Down, "#1565c0", res.unit, res.loc) + gauge("Upload", res.Up, "#2e7d32", res.unit, res.loc) + "</p>\n"
+}
+
+func gauge(name string, bps float64, colour string, u unit, l *locale) string {
+	v := u.num(bps)
+	top := 1.0
+	for _, s := range []float64{1, 5, 10, 50, 100, 500, 1000, 5000, 10000} {
+		if top = s; v <= s {
+			break
+		}
+	}
+	f := math.Min(v/top, 1)
+	pt := func(f, r float64) string {
+		a := math.Pi * (1 - f)
+		return strconv.FormatFloat(100+r*math.Cos(a), 'f', 1, 64) + " " + strconv.FormatFloat(100-r*math.Sin(a), 'f', 1, 64)
+	}
+	arc := func(f float64, stroke string) string {
+		return `<path d="M` + pt(0, 80) + ` A80 80 0 0 1 ` + pt(f, 80) + `" fill="none" stroke="` + stroke + `" stroke-width="14"/>`
+	}
+	return `<svg viewBox="0 0 200 145" width="48%" role="img" aria-label="` + name + ` ` + l.speed(u, bps) + `" style="font-size:12px">` +
+		arc(1, "#e0e0e0") + arc(f, colour) +
+		`<line x1="100" y1="100" x2="` + strings.Replace(pt(f, 64), " ", `" y2="`, 1) + `" stroke="#333" stroke-width="3" stroke-linecap="round"/><circle cx="100" cy="100" r="5" fill="#333"/>` +
+		`<text x="20" y="116" text-anchor="middle">0</text><text x="180" y="116" text-anchor="middle">` + l.num(top, -1) + `</text>` +
+		`<text x="100" y="124" text-anchor="middle" style="font-size:16px;font-weight:bold">` + l.speed(u, bps) + `</text><text x="100" y="141" text-anchor="middle">` + name + `</text></svg>`
+}
+
+// speedChart draws download and upload speed over time as an inline SVG, so
+// ramp-up, throttling and mid-transfer drops show without any script.
+func speedChart(res *result) string {
+	const w, h, pad = 600.0, 160.0, 4.0
+	// the last interval is usually cut short, which would look like a drop
+	trim := func(s []int64) []int64 {
+		if len(s) > 2 {
+			return s[:len(s)-1]
+		}
+		return nil
+	}
+	down, up := trim(res.DownSeries), trim(res.UpSeries)
+	if down == nil && up == nil {
+		return ""
+	}
+	secs := float64(res.SampleMs) / 1000
+	n, top := max(len(down), len(up)), int64(1)
+	for _, s := range [][]int64{down, up} {
+		for _, v := range s {
+			top = max(top, v)
+		}
+	}
+	legend := ""
+	line := func(s []int64, colour, name string) string {
+		if s == nil {
+			return ""
+		}
+		legend += ` <tspan fill="` + colour + `">■ ` + name + `</tspan>`
+		var b strings.Builder
+		for i, v := range s {
+			x := pad + (w-2*pad)*(float64(i)+.5)/float64(n)
+			y := h - pad - (h-2*pad)*float64(v)/float64(top)
+			b.WriteString(strconv.FormatFloat(x, 'f', 1, 64) + "," + strconv.FormatFloat(y, 'f', 1, 64) + " ")
+		}
+		return `<polyline fill="none" stroke="` + colour + `" stroke-width="2" points="` + b.String() + `"/>`
+	}
+	return `<h3>Speed over time</h3>
+<svg viewBox="0 0 600 180" width="100%" role="img" aria-label="Download and upload speed over time" style="font-size:11px">
+<rect x="0" y="0" width="600" height="160" fill="none" stroke="#ccc"/>
+` + line(down, "#1565c0", "download") + line(up, "#2e7d32", "upload") + `
+<text x="6" y="14">` + res.loc.speed(res.unit, float64(top)/secs) + `</text>
+<text x="0" y="174">0 s</text><text x="600" y="174" text-anchor="end">` + res.loc.num(float64(n)*secs, 1) + ` s</text>
+<text x="300" y="174" text-anchor="middle">` + legend + `</text>
+</svg>
+<p><a href="/api/v1/samples/` + res.ID + `">Download the samples as CSV</a></p>
+`
+}
+
+// samplesCSV exports the speed-over-time samples, one row per interval,
+// for a spreadsheet. Each transfer's samples count from its own start.
+func samplesCSV(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/samples/")
+	s := getSession(id)
+	if s == nil {
+		http.NotFound(w, r)
+		return
+	}
+	res := s.snapshot()
+	u := speedUnit(w, r).or()
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="blurr-`+id+`.csv"`)
+	c := csv.NewWriter(w)
+	c.Write([]string{"seconds", "download_bytes", "upload_bytes", "download_bps", "upload_bps", "download_" + string(u), "upload_" + string(u)})
+	secs := float64(res.SampleMs) / 1000
+	cell := func(s []int64, i int, scale float64) string {
+		if i >= len(s) || secs == 0 {
+			return ""
+		}
+		return strconv.FormatFloat(float64(s[i])*scale, 'f', -1, 64)
+	}
+	for i := 0; i < max(len(res.DownSeries), len(res.UpSeries)); i++ {
+		c.Write([]string{strconv.FormatFloat(float64(i)*secs, 'f', -1, 64),
+			cell(res.DownSeries, i, 1), cell(res.UpSeries, i, 1),
+			cell(res.DownSeries, i, 1/secs), cell(res.UpSeries, i, 1/secs),
+			cell(res.DownSeries, i, u.num(1/secs)), cell(res.UpSeries, i, u.num(1/secs))})
+	}
+	c.Flush()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clientResult is what one instance measures when it tests against another
+// Blurr server: ping and jitter in milliseconds, throughput in bytes/s.
+// DNS, Connect and TLS split out the setup of the first connection, TTFB
+// its first request; Ping is then HTTP over the open connection.
+type clientResult struct {
+	Ping, Jitter      float64
+	DNS, Connect, TLS float64
+	TTFB              float64
+	Down, Up          float64
+	DownBytes         int64
+	UpBytes           int64
+}
+
+// runClient runs the same ping, download and upload sequence the browser
+// test does against the Blurr server at base (e.g. "http://10.0.0.2:8080").
+func runClient(ctx context.Context, base string, size int64) (clientResult, error) {
+	var res clientResult
+	base = strings.TrimSuffix(base, "/")
+	c := &http.Client{}
+	do := func(req *http.Request) (*http.Response, error) {
+		resp, err := c.Do(req)
+		if err == nil && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+		}
+		return resp, err
+	}
+	nonce := func() string { return strconv.FormatInt(time.Now().UnixNano(), 36) }
+
+	var t struct{ dns0, dns1, conn0, conn1, tls0, tls1, wrote, first time.Time }
+	trace := httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { t.dns0 = time.Now() },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.dns1 = time.Now() },
+		ConnectStart:         func(string, string) { t.conn0 = time.Now() },
+		ConnectDone:          func(string, string, error) { t.conn1 = time.Now() },
+		TLSHandshakeStart:    func() { t.tls0 = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.tls1 = time.Now() },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.wrote = time.Now() },
+		GotFirstResponseByte: func() { t.first = time.Now() },
+	})
+	ms := func(a, b time.Time) float64 {
+		if a.IsZero() || b.IsZero() {
+			return 0
+		}
+		return float64(b.Sub(a).Microseconds()) / 1000
+	}
+
+	var rtts []float64
+	for i := 0; i <= max(1, min(cfg().Pings, maxPings)); i++ {
+		rctx := ctx
+		if i == 0 {
+			rctx = trace
+		}
+		req, _ := http.NewRequestWithContext(rctx, "GET", base+"/ping?nonce="+nonce(), nil)
+		t0 := time.Now()
+		resp, err := do(req)
+		if err != nil {
+			return res, err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if i == 0 {
+			// the first ping pays for setting up the connection
+			res.DNS, res.Connect, res.TLS, res.TTFB = ms(t.dns0, t.dns1), ms(t.conn0, t.conn1), ms(t.tls0, t.tls1), ms(t.wrote, t.first)
+		} else {
+			rtts = append(rtts, float64(time.Since(t0).Microseconds())/1000)
+		}
+		time.Sleep(max(0, min(cfg().PingGap, maxPingGap)))
+	}
+	res.Ping, res.Jitter = meanSD(rtts)
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", base+"/download?size="+strconv.FormatInt(size, 10)+"&nonce="+nonce(), nil)
+	resp, err := do(req)
+	if err != nil {
+		return res, err
+	}
+	m := newMeter(size, 0)
+	res.DownBytes, err = drain(io.TeeReader(resp.Body, m))
+	resp.Body.Close()
+	if err != nil {
+		return res, err
+	}
+	m.stop()
+	res.Down = m.bps()
+
+	m = newMeter(size, 0)
+	req, _ = http.NewRequestWithContext(ctx, "POST", base+"/upload?nonce="+nonce(), io.TeeReader(io.LimitReader(&payloadReader{off: payloadStart()}, size), m))
+	req.ContentLength = size
+	resp, err = do(req)
+	if err != nil {
+		return res, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	m.stop()
+	res.UpBytes = size
+	res.Up = m.bps()
+	return res, nil
+}
+
+// payloadReader reads the random payload block round-robin, forever.
+type payloadReader struct{ off int }
+
+func (p *payloadReader) Read(b []byte) (int, error) {
+	blk := payload()
+	n := copy(b, blk[p.off:])
+	p.off = (p.off + n) % len(blk)
+	return n, nil
+}
+
+func meanSD(v []float64) (mean, sd float64) {
+	if len(v) == 0 {
+		return 0, 0
+	}
+	for _, x := range v {
+		mean += x
+	}
+	mean /= float64(len(v))
+	for _, x := range v {
+		sd += (x - mean) * (x - mean)
+	}
+	return mean, math.Sqrt(sd / float64(len(v)))
+}
+
+func median(v []float64) float64 {
+	s := append([]float64(nil), v...)
+	sort.Float64s(s)
+	if len(s)%2 == 0 {
+		return (s[len(s)/2-1] + s[len(s)/2]) / 2
+	}
+	return s[len(s)/2]
+}
+
+// interarrivalJitter is the RFC 3550 jitter VoIP tools report: a running
+// average, with gain 1/16, of how much each round trip differs from the
+// one before. Unlike the standard deviation it ignores slow drift.
+func interarrivalJitter(v []float64) float64 {
+	j := 0.0
+	for i := 1; i < len(v); i++ {
+		j += (math.Abs(v[i]-v[i-1]) - j) / 16
+	}
+	return j
+}
+
+// A spread summarises latency samples in milliseconds.
+type spread struct {
+	Min    float64 `json:"min_ms"`
+	Median float64 `json:"median_ms"`
+	P95    float64 `json:"p95_ms"`
+	P99    float64 `json:"p99_ms"`
+	Max    float64 `json:"max_ms"`
+}
+
+func spreadOf(v []float64) *spread {
+	if len(v) == 0 {
+		return nil
+	}
+	s := append([]float64(nil), v...)
+	sort.Float64s(s)
+	return &spread{Min: s[0], Median: median(s), P95: percentile(s, 95), P99: percentile(s, 99), Max: s[len(s)-1]}
+}
+
+// percentile interpolates between the closest ranks of sorted s.
+func percentile(s []float64, p float64) float64 {
+	x := p / 100 * float64(len(s)-1)
+	i := int(x)
+	if i+1 >= len(s) {
+		return s[len(s)-1]
+	}
+	return s[i] + (x-float64(i))*(s[i+1]-s[i])
+}
+
+func mibps(bps float64) string { return strconv.FormatFloat(bps/1024/1024, 'f', 2, 64) + " MiB/s" }
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type config struct {
+	Addr          string
+	TCPAddr       string
+	Peers         string
+	LinkEvery     time.Duration
+	LinkSize      byteSize
+	MaxTests      int
+	Streams       int
+	TargetTime    time.Duration
+	Duration      time.Duration
+	Warmup        warmup
+	LossProbes    int
+	Pings         int
+	PingGap       time.Duration
+	TestsPerHour  int
+	DailyBytes    byteSize
+	MaxSize       byteSize
+	Chunk         byteSize
+	FlushEvery    byteSize
+	FormUpload    byteSize
+	Recent        int
+	PayloadFile   string
+	RetentionDays int
+	MaxUpload     byteSize
+	LowMem        bool
+	Tor           bool
+	Anonymize     string
+	Local         bool
+	Discover      bool
+	FreshConns    bool
+	Pace          bitRate
+	NoDelay       bool
+	SndBuf        byteSize
+	RcvBuf        byteSize
+	Congestion    string
+	Allow         netList
+	Deny          netList
+
+	ReadHeaderTimeout time.Duration
+	RequestTimeout    time.Duration
+	TransferTimeout   time.Duration
+	IdleTimeout       time.Duration
+	ShutdownGrace     time.Duration
+
+	Phases []phase
+	Hosts  []vhost
+
+	UpdateURL   string
+	UpdateKey   string
+	UpdateEvery time.Duration
+
+	MatrixURL, MatrixRoom, MatrixToken string
+	MatrixHook                         string
+	Ntfy, NtfyToken                    string
+	IRC, IRCNick                       string
+	NotifySummary                      bool
+	NotifyBelow                        bitRate
+	SMTP, MailTo, MailFrom             string
+	Webhook, WebhookSecret             string
+	MQTT, MQTTTopic, MQTTDiscovery     string
+	Influx, InfluxToken, InfluxFile    string
+	Graphite, StatsD, MetricPrefix     string
+
+	ICMP           bool
+	RDNS           bool
+	Capture        bool
+	ASNDB          string
+	POP            string
+	IgnoreOptional bool
+	Hostname       string
+	Unit           string
+	SiteName       string
+	Logo           string
+	Contact        string
+	Footer         string
+	Disclaimer     string
+	Timezone       string
+	Chaos          string
+	DemoPerMinute  int
+	Stats          bool
+	Log            string
+	LogMaxSize     byteSize
+	LogMaxAge      time.Duration
+	LogKeep        int
+	AdminUser      string
+	AdminPassword  string
+	AdminToken     string
+	AuthUser       string
+	AuthPassword   string
+	AuthFile       string
+	APITokens      string
+	Pprof          bool
+
+	CSP, FrameAncestors, ReferrerPolicy string
+	BlockAgents                         string
+
+	tz *time.Location // -timezone, loaded
+}
+
+var settings = config{
+	Addr:        ":8080",
+	Streams:     1,
+	NoDelay:     true,
+	TargetTime:  10 * time.Second,
+	LossProbes:  50,
+	Pings:       6,
+	PingGap:     80 * time.Millisecond,
+	UpdateEvery: 24 * time.Hour,
+	IRCNick:     "blurr",
+	Unit:        "mibps",
+
+	MQTTTopic:     "blurr",
+	MQTTDiscovery: "homeassistant",
+
+	ReadHeaderTimeout: 10 * time.Second,
+	RequestTimeout:    30 * time.Second,
+	TransferTimeout:   5 * time.Minute,
+	IdleTimeout:       2 * time.Minute,
+	ShutdownGrace:     30 * time.Second,
+
+	FormUpload:    4 << 20,
+	DemoPerMinute: 6,
+
+	LogMaxSize: 100 << 20,
+	LogKeep:    5,
+
+	FrameAncestors: "'self'",
+	ReferrerPolicy: "same-origin",
+}
+
+// A phase is an extra download step defined by the operator in the config
+// file. It runs after the standard download and gets its own result row.
+// Via sends it to another address of this server, so on a multi-homed box
+// whose uplinks are picked by source address each phase can test one
+// transit path; it's an IP, host:port or base URL.
+type phase struct {
+	Name    string   `json:"name"`
+	Size    byteSize `json:"size"`
+	Streams int      `json:"streams"`
+	Pacing  bitRate  `json:"pacing"`
+	Via     string   `json:"via"`
+}
+
+// base is where the browser fetches the phase from: "" for the page's own
+// origin, otherwise the Via address on the first -addr port.
+func (p *phase) base() string {
+	v := p.Via
+	if v == "" || strings.Contains(v, "://") {
+		return strings.TrimSuffix(v, "/")
+	}
+	if _, _, err := net.SplitHostPort(v); err != nil {
+		_, port, _ := net.SplitHostPort(strings.Split(cfg().Addr, ",")[0])
+		v = net.JoinHostPort(strings.Trim(v, "[]"), port)
+	}
+	return "//" + v
+}
+
+// A vhost gives the pages served under some hostnames their own brand,
+// for one instance answering for several domains: name, logo and texts,
+// and the test's default streams and sizing. What's left out comes from
+// the flags. A host of the form *.example.net matches its subdomains.
+type vhost struct {
+	Hosts      []string `json:"hosts"`
+	SiteName   string   `json:"site-name"`
+	Logo       string   `json:"logo"`
+	Contact    string   `json:"contact"`
+	Footer     string   `json:"footer"`
+	Disclaimer string   `json:"disclaimer"`
+	Streams    int      `json:"streams"`
+	TargetTime string   `json:"target-time"`
+
+	target *time.Duration
+}
+
+// hostOf is the vhost r came in for, or nil.
+func hostOf(r *http.Request) *vhost {
+	if len(cfg().Hosts) == 0 {
+		return nil
+	}
+	h := r.Host
+	if hh, _, err := net.SplitHostPort(h); err == nil {
+		h = hh
+	}
+	h = strings.TrimSuffix(strings.ToLower(h), ".")
+	for i := range cfg().Hosts {
+		for _, p := range cfg().Hosts[i].Hosts {
+			p = strings.ToLower(p)
+			if p == h || strings.HasPrefix(p, "*.") && strings.HasSuffix(h, p[1:]) {
+				return &cfg().Hosts[i]
+			}
+		}
+	}
+	return nil
+}
+
+// targetTime is -target-time, or r's vhost's.
+func targetTime(r *http.Request) time.Duration {
+	if v := hostOf(r); v != nil && v.target != nil {
+		return *v.target
+	}
+	return cfg().TargetTime
+}
+
+func findPhase(name string) *phase {
+	for i := range cfg().Phases {
+		if cfg().Phases[i].Name == name {
+			return &cfg().Phases[i]
+		}
+	}
+	return nil
+}
+
+func parseFlags() {
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	path := flag.String("config", "", "JSON config file; keys are flag names (plus \"phases\" and \"hosts\"), flags given on the command line win")
+	flag.StringVar(&settings.Addr, "addr", settings.Addr, "listen address, or several separated by commas")
+	flag.IntVar(&settings.MaxTests, "max-tests", settings.MaxTests, "maximum simultaneous measurements, extra clients wait in line (0 = unlimited)")
+	flag.IntVar(&settings.Streams, "streams", settings.Streams, "parallel download streams per test (clients may ask for up to 16 with ?streams=N)")
+	flag.DurationVar(&settings.TargetTime, "target-time", settings.TargetTime, "size the browser download to take about this long, starting small and scaling up (0 = fixed 8 MiB)")
+	flag.DurationVar(&settings.Duration, "duration", settings.Duration, "stream the browser download for this long instead of a set size (overrides -target-time, at most 60s)")
+	flag.Var(&settings.Warmup, "warmup", "leave the start of each transfer out of its speed: a time like 1s or a share like 10% (default 0)")
+	flag.IntVar(&settings.LossProbes, "loss-probes", settings.LossProbes, "tiny requests the browser fires against a deadline to estimate loss (0 = skip, at most 500)")
+	flag.IntVar(&settings.Pings, "pings", settings.Pings, "idle pings per test, for ping and jitter (clients may ask for 1-100 with ?pings=N)")
+	flag.DurationVar(&settings.PingGap, "ping-gap", settings.PingGap, "pause between idle pings (clients may ask for up to 2s with ?ping_gap=)")
+	flag.Var(&settings.Allow, "allow", "only these networks may run tests: CIDRs, addresses or \"lan\" for private ranges, comma-separated (default: everyone)")
+	flag.Var(&settings.Deny, "deny", "networks that may not run tests, in the same form as -allow; they win over it")
+	flag.IntVar(&settings.TestsPerHour, "tests-per-hour", settings.TestsPerHour, "maximum tests one IP may start per hour (0 = unlimited)")
+	flag.Var(&settings.MaxSize, "max-size", "largest download a client may request (0 = unlimited)")
+	flag.Var(&settings.MaxUpload, "max-upload", "largest upload body accepted (default: -max-size, or 1G)")
+	flag.Var(&settings.Chunk, "chunk", "size of each download write (default 32K, 8K with -lowmem)")
+	flag.Var(&settings.FlushEvery, "flush-every", "flush the download after at least this many bytes (default 0: after every chunk)")
+	flag.Var(&settings.FormUpload, "form-upload", "payload the no-JS test's upload form carries in a hidden field (default 4M, at most 32M)")
+	flag.StringVar(&settings.PayloadFile, "payload-file", settings.PayloadFile, "write the download payload to this file at startup and send sized downloads from it (sendfile on Linux)")
+	flag.IntVar(&settings.Recent, "recent", settings.Recent, "finished results kept in memory for the admin view and statistics (default 500, 50 with -lowmem)")
+	flag.DurationVar(&settings.ReadHeaderTimeout, "read-header-timeout", settings.ReadHeaderTimeout, "time a client gets to send its request headers (0 = no limit)")
+	flag.DurationVar(&settings.RequestTimeout, "request-timeout", settings.RequestTimeout, "time to read a request and write its response, except downloads and uploads (0 = no limit)")
+	flag.DurationVar(&settings.TransferTimeout, "transfer-timeout", settings.TransferTimeout, "time a single download or upload may take (0 = no limit)")
+	flag.DurationVar(&settings.IdleTimeout, "idle-timeout", settings.IdleTimeout, "how long an idle keep-alive connection stays open")
+	flag.DurationVar(&settings.ShutdownGrace, "shutdown-grace", settings.ShutdownGrace, "on Ctrl+C, SIGTERM or a service stop, how long running tests get to finish (0 = as long as they take)")
+	flag.BoolVar(&settings.FreshConns, "fresh-conns", settings.FreshConns, "close the connection after every ping, so pings include the TCP (and TLS) handshake like a first visit")
+	flag.Var(&settings.Pace, "pace", "hold every test to this rate in each direction, e.g. 50Mbit, as a simulated link (default 0: as fast as possible)")
+	flag.BoolVar(&settings.NoDelay, "tcp-nodelay", settings.NoDelay, "send small writes at once instead of coalescing them (Nagle's algorithm off)")
+	flag.Var(&settings.SndBuf, "sndbuf", "socket send buffer for test connections, e.g. 4M (default: the kernel's)")
+	flag.Var(&settings.RcvBuf, "rcvbuf", "socket receive buffer for test connections, e.g. 4M (default: the kernel's)")
+	flag.StringVar(&settings.Congestion, "congestion", settings.Congestion, "TCP congestion control for test connections, e.g. bbr (Linux only; default: the system's)")
+	flag.BoolVar(&settings.LowMem, "lowmem", settings.LowMem, "low-memory profile for routers and other small devices: small buffers, one test at a time, 64M download cap")
+	flag.IntVar(&settings.RetentionDays, "retention-days", settings.RetentionDays, "drop stored results older than this many days (0 = keep until they're pushed out or the server restarts)")
+	flag.BoolVar(&settings.Tor, "tor", settings.Tor, "onion service profile: hide client addresses, skip reverse DNS and ICMP, allow for circuit latency in timeouts, and label results as measured through Tor")
+	flag.StringVar(&settings.Anonymize, "anonymize", settings.Anonymize, "record client addresses only as \"truncate\" (/24 or /48) or \"hash\" (keyed per process), and show none on pages")
+	flag.Var(&settings.DailyBytes, "daily-bytes", "maximum test traffic per day, e.g. 50G (0 = unlimited)")
+	flag.BoolVar(&settings.IgnoreOptional, "ignore-optional-failures", settings.IgnoreOptional, "start without optional features that fail to come up (ASN database, ICMP, notifications...) instead of exiting")
+	flag.StringVar(&settings.POP, "pop", settings.POP, "name of this site (e.g. \"fra1\"), shown with every result so tests behind anycast or GeoDNS tell which one served them")
+	flag.StringVar(&settings.Log, "log", settings.Log, "where the log goes: stderr, json (JSON lines on stdout), syslog, journald, or a file path")
+	flag.Var(&settings.LogMaxSize, "log-max-size", "rotate a -log file once it would pass this size (0 = never)")
+	flag.DurationVar(&settings.LogMaxAge, "log-max-age", settings.LogMaxAge, "rotate a -log file once it has been written to for this long, e.g. 24h (0 = never)")
+	flag.IntVar(&settings.LogKeep, "log-keep", settings.LogKeep, "rotated -log files to keep (0 = all)")
+	flag.StringVar(&settings.Unit, "unit", settings.Unit, "speed unit pages show unless the visitor picks another: mbps (Mbit/s), mibps (MiB/s) or mbs (MB/s)")
+	flag.StringVar(&settings.Timezone, "timezone", settings.Timezone, "time zone pages show times in, e.g. Europe/Berlin or Local (default UTC)")
+	flag.StringVar(&settings.SiteName, "site-name", settings.SiteName, "name the index and result pages go by (default Blurr)")
+	flag.StringVar(&settings.Logo, "logo", settings.Logo, "URL of a logo shown next to the site name (a path on this server, or an https URL)")
+	flag.StringVar(&settings.Contact, "contact", settings.Contact, "operator contact shown on the index and result pages: an email address, URL or any text")
+	flag.StringVar(&settings.Footer, "footer", settings.Footer, "footer line for the index page, in place of the project's own")
+	flag.StringVar(&settings.Disclaimer, "disclaimer", settings.Disclaimer, "disclaimer or terms shown on the index and result pages (plain text, blank lines between paragraphs)")
+	flag.StringVar(&settings.Hostname, "hostname", settings.Hostname, "server name shown with every result (default: the system hostname)")
+	eachSubsystem(func(s subsystem) {
+		if s.flags != nil {
+			s.flags()
+		}
+	})
+	flag.Parse()
+	if *showVersion {
+		fmt.Println("blurr " + versionLine())
+		os.Exit(0)
+	}
+	configPath = *path
+	if *path != "" {
+		if err := loadConfig(*path); err != nil {
+			mustFix("config "+*path+": "+err.Error(), "Correct the file; its keys are the flag names without the dash, plus \"phases\" and \"hosts\".")
+		}
+	}
+	if settings.Hostname == "" {
+		settings.Hostname, _ = os.Hostname()
+	}
+	profiles(&settings)
+	checkConfig(&settings, mustFix)
+	checkCongestion(&settings)
+	publish()
+	setupLog()
+}
+
+// checkConfig reports what's wrong with c to bad, the way parseFlags and
+// a reload both need, and fills in what follows from the rest.
+func checkConfig(c *config, bad func(what, fix string)) {
+	switch c.Anonymize {
+	case "", "truncate", "hash":
+	default:
+		bad("-anonymize "+c.Anonymize+": unknown mode", "Use -anonymize truncate or -anonymize hash.")
+	}
+	if units[unit(c.Unit)].per == 0 {
+		bad("-unit "+c.Unit+": unknown unit", "Use -unit mbps, -unit mibps or -unit mbs.")
+	}
+	c.tz = nil
+	if c.Timezone != "" {
+		if l, err := time.LoadLocation(c.Timezone); err != nil {
+			bad("-timezone "+c.Timezone+": "+err.Error(), "Use an IANA zone name such as Europe/Berlin, or Local for the server's own.")
+		} else {
+			c.tz = l
+		}
+	}
+	if c.Anonymize != "" {
+		// a reverse DNS name identifies the client as well as the address
+		c.RDNS = false
+	}
+}
+
+// The flags and the -config file write into settings; everything else
+// reads the copy cfg returns, which is replaced whole (by publish, after a
+// reload or a change at startup) and never changed in place, so a request
+// can read it while a reload is running.
+var (
+	live  atomic.Pointer[config]
+	cfgMu sync.Mutex // held while settings changes
+)
+
+// cfg is the running configuration. Treat it as read-only; tune changes
+// it.
+func cfg() *config {
+	if c := live.Load(); c != nil {
+		return c
+	}
+	return &cfgDefault
+}
+
+func publish() {
+	c := settings
+	live.Store(&c)
+}
+
+// tune applies f to the settings and publishes the result, for the
+// subsystems that correct a setting when they start.
+func tune(f func(*config)) {
+	cfgMu.Lock()
+	defer cfgMu.Unlock()
+	f(&settings)
+	publish()
+}
+
+// siteAuth is whether -auth-user or -auth-file puts basic auth in front
+// of the whole site.
+func (c *config) siteAuth() bool { return c.AuthUser != "" || c.AuthFile != "" }
+
+// zone is where -timezone puts the times pages show.
+func (c *config) zone() *time.Location {
+	if c.tz != nil {
+		return c.tz
+	}
+	return time.UTC
+}
+
+func loadConfig(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for k, v := range m {
+		if k == "phases" {
+			if err := json.Unmarshal(v, &settings.Phases); err != nil {
+				return fmt.Errorf("phases: %v", err)
+			}
+			continue
+		}
+		if k == "hosts" {
+			if err := json.Unmarshal(v, &settings.Hosts); err != nil {
+				return fmt.Errorf("hosts: %v", err)
+			}
+			continue
+		}
+		f := flag.Lookup(k)
+		if f == nil || k == "config" {
+			return fmt.Errorf("unknown setting %q", k)
+		}
+		if set[k] {
+			continue
+		}
+		var s string
+		if json.Unmarshal(v, &s) != nil {
+			s = string(v)
+		}
+		if err := f.Value.Set(s); err != nil {
+			return fmt.Errorf("%s: %v", k, err)
+		}
+	}
+	seen := map[string]bool{}
+	for i := range settings.Phases {
+		p := &settings.Phases[i]
+		if p.Name == "" || seen[p.Name] {
+			return fmt.Errorf("phases: every phase needs a unique name")
+		}
+		seen[p.Name] = true
+		if p.Size <= 0 {
+			p.Size = 8 << 20
+		}
+		p.Streams = max(1, min(p.Streams, 16))
+	}
+	names := map[string]bool{}
+	for i := range settings.Hosts {
+		h := &settings.Hosts[i]
+		if len(h.Hosts) == 0 {
+			return fmt.Errorf("hosts: every entry needs a list of \"hosts\" it's for")
+		}
+		for _, n := range h.Hosts {
+			if n = strings.ToLower(n); n == "" || names[n] {
+				return fmt.Errorf("hosts: %q is empty or listed twice", n)
+			}
+			names[n] = true
+		}
+		if h.TargetTime != "" {
+			d, err := time.ParseDuration(h.TargetTime)
+			if err != nil || d < 0 {
+				return fmt.Errorf("hosts: target-time %q: want a duration like 5s", h.TargetTime)
+			}
+			h.target = &d
+		}
+		h.Streams = max(0, min(h.Streams, 16))
+	}
+	return nil
+}
+
+// lowMem tightens anything left at its default so Blurr fits comfortably on
+// a 128 MB device, and makes the GC give memory back early.
+// profiles applies -lowmem and -tor to what they leave at its default, at
+// startup and again on each reload.
+func profiles(c *config) {
+	if c.LowMem {
+		lowMem(c)
+	}
+	if c.Tor {
+		torMode(c)
+	}
+}
+
+func lowMem(c *config) {
+	if c.MaxTests == 0 {
+		c.MaxTests = 1
+	}
+	if c.MaxSize == 0 {
+		c.MaxSize = 64 << 20
+	}
+	debug.SetGCPercent(50)
+	debug.SetMemoryLimit(24 << 20)
+}
+
+// cfgDefault is the configuration before flags, so profiles can tell what
+// was left at its default.
+var cfgDefault = settings
+
+// torMode is the -tor profile. Behind an onion service every client is
+// the local Tor daemon, so addresses, reverse DNS and ICMP pings say
+// nothing (or too much, if a proxy passes one on), and a circuit's
+// several hundred milliseconds of latency need longer timeouts than a
+// direct connection.
+func torMode(c *config) {
+	c.RDNS, c.ICMP = false, false
+	if c.ReadHeaderTimeout == cfgDefault.ReadHeaderTimeout {
+		c.ReadHeaderTimeout = 30 * time.Second
+	}
+	if c.RequestTimeout == cfgDefault.RequestTimeout {
+		c.RequestTimeout = 2 * time.Minute
+	}
+	if c.TransferTimeout == cfgDefault.TransferTimeout {
+		c.TransferTimeout = 10 * time.Minute
+	}
+}
+
+// probeFloor is the shortest deadline the loss probes get, in ms.
+func probeFloor() int {
+	if cfg().Tor {
+		return 3000
+	}
+	return 300
+}
+
+// maxProbes caps -loss-probes.
+const maxProbes = 500
+
+// maxPings and maxPingGap cap the idle ping run.
+const (
+	maxPings   = 100
+	maxPingGap = 2 * time.Second
+)
+
+// maxFormUpload caps -form-upload, which the browser has to download as
+// part of the page before it can send it back.
+const maxFormUpload = 32 << 20
+
+// maxRecent caps -recent.
+const maxRecent = 100000
+
+// maxDuration caps a fixed-duration download.
+const maxDuration = time.Minute
+
+// maxUpload is the largest upload body the server reads.
+func maxUpload() int64 {
+	if cfg().MaxUpload > 0 {
+		return int64(cfg().MaxUpload)
+	}
+	return maxDownload()
+}
+
+// maxDownload is the largest single download the browser will ask for.
+func maxDownload() int64 {
+	if cfg().MaxSize > 0 {
+		return int64(cfg().MaxSize)
+	}
+	return 1 << 30
+}
+
+func chunkSize() int {
+	if cfg().Chunk > 0 {
+		return int(cfg().Chunk)
+	}
+	return bufSize()
+}
+
+func bufSize() int {
+	if cfg().LowMem {
+		return 8 * 1024
+	}
+	return 32 * 1024
+}
+
+// byteSize is a flag value accepting plain byte counts or K/M/G/T suffixes
+// (powers of 1024, an optional trailing "iB" or "B" is ignored).
+type byteSize int64
+
+func (b *byteSize) String() string { return strconv.FormatInt(int64(*b), 10) }
+
+func (b *byteSize) Set(s string) error {
+	t := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	mul := int64(1)
+	if t != "" {
+		if i := strings.IndexByte("KMGT", t[len(t)-1]); i >= 0 {
+			mul = 1 << (10 * (i + 1))
+			t = t[:len(t)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(t, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	*b = byteSize(n * float64(mul))
+	return nil
+}
+
+func (b *byteSize) UnmarshalJSON(d []byte) error {
+	var s string
+	if json.Unmarshal(d, &s) != nil {
+		s = string(d)
+	}
+	return b.Set(s)
+}
+
+// bitRate is a rate in bits per second, written like "50M", "50Mbit" or
+// "50Mbps" (SI prefixes k, M, G).
+type bitRate float64
+
+func (r *bitRate) String() string { return strconv.FormatFloat(float64(*r), 'f', -1, 64) }
+
+func (r *bitRate) Set(s string) error {
+	t := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(s), "ps"), "bit")
+	t = strings.TrimSuffix(t, "b")
+	mul := 1.0
+	if t != "" {
+		if i := strings.IndexByte("kMG", t[len(t)-1]); i >= 0 {
+			mul = [...]float64{1e3, 1e6, 1e9}[i]
+			t = t[:len(t)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(t, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid rate %q", s)
+	}
+	*r = bitRate(n * mul)
+	return nil
+}
+
+func (r *bitRate) UnmarshalJSON(d []byte) error {
+	var s string
+	if json.Unmarshal(d, &s) != nil {
+		s = string(d)
+	}
+	return r.Set(s)
+}
+
+// warmup is how much of a transfer -warmup leaves out: a fixed time, or a
+// share of the transfer's bytes (of its duration in fixed-duration mode).
+type warmup struct {
+	d    time.Duration
+	frac float64
+}
+
+func (w *warmup) String() string {
+	if w.frac > 0 {
+		return strconv.FormatFloat(w.frac*100, 'f', -1, 64) + "%"
+	}
+	return w.d.String()
+}
+
+func (w *warmup) Set(s string) error {
+	s = strings.TrimSpace(s)
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		f, err := strconv.ParseFloat(p, 64)
+		if err != nil || f < 0 || f >= 100 {
+			return fmt.Errorf("invalid warm-up share %q", s)
+		}
+		*w = warmup{frac: f / 100}
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return fmt.Errorf("invalid warm-up %q", s)
+	}
+	*w = warmup{d: d}
+	return nil
+}
+
+// cut says where the warm-up of a transfer of size bytes (0 if unknown)
+// lasting dur (0 if it's sized by bytes) ends.
+func (w *warmup) cut(size int64, dur time.Duration) (time.Duration, int64) {
+	switch {
+	case w.d > 0:
+		return w.d, 0
+	case dur > 0:
+		return time.Duration(w.frac * float64(dur)), 0
+	}
+	return 0, int64(w.frac * float64(size))
+}
+
+func fmtBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGT"[exp])
+}
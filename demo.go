@@ -0,0 +1,62 @@
+//go:build !minimal && !nodemo
+
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// /demo.bin answers "is this server alive and roughly how fast" from
+// scripts: a small payload without a session, a queue slot, a result or a
+// log line, so it never shows up in the statistics. It's rate limited per
+// IP much harder than tests are.
+const demoMax = 1 << 20
+
+var demoIP = &sliding{hits: map[string][]time.Time{}, window: time.Minute, max: func() int { return cfg().DemoPerMinute }}
+
+func init() {
+	register(subsystem{
+		name: "demo",
+		flags: func() {
+			flag.IntVar(&settings.DemoPerMinute, "demo-per-minute", settings.DemoPerMinute, "requests per minute one IP may make to /demo.bin (0 = unlimited)")
+		},
+		routes: func(m *http.ServeMux) { m.HandleFunc("/demo.bin", demoBin) },
+	})
+}
+
+func demoBin(w http.ResponseWriter, r *http.Request) {
+	ip := limitIP(r)
+	if budget.exhausted() {
+		busy(w)
+		return
+	}
+	if !demoIP.allow(ip) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(demoIP.wait(ip).Seconds())+1))
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+		return
+	}
+	holdOpen(w, cfg().TransferTimeout)
+	size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+	if size <= 0 || size > demoMax {
+		size = demoMax
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	if r.Method == http.MethodHead {
+		return
+	}
+	p, off := payload(), payloadSeed(w, r)
+	for left := size; left > 0; {
+		n, err := w.Write(p[off : off+min(left, len(p)-off)])
+		budget.add(int64(n))
+		if err != nil {
+			return
+		}
+		left -= n
+		off = (off + n) % len(p)
+	}
+}
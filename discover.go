@@ -0,0 +1,449 @@
+//go:build !minimal && !nodiscover
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Instances find each other with multicast DNS service discovery
+// (_blurr._tcp.local), so two of them on one LAN can test the link between
+// them from the browser, iperf style. The TXT record carries a random id so
+// an instance can recognise (and ignore) its own announcements.
+const (
+	mdnsService  = "_blurr._tcp.local."
+	mdnsTTL      = 120
+	mdnsInterval = 30 * time.Second
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+type peer struct {
+	Name string
+	Addr string
+	seen time.Time
+}
+
+var disc struct {
+	sync.Mutex
+	id    string
+	name  string
+	host  string
+	port  int
+	peers map[string]*peer
+	conn  *net.UDPConn
+}
+
+var pairing sync.Mutex
+
+func init() {
+	register(subsystem{
+		name: "discover",
+		flags: func() {
+			flag.BoolVar(&settings.Discover, "discover", settings.Discover, "announce this instance on the LAN via mDNS and offer point-to-point tests against other instances found there (on by default with --local)")
+		},
+		routes: func(m *http.ServeMux) { m.HandleFunc("/pair", pair) },
+		start:  startDiscovery,
+		index:  peersFragment,
+	})
+}
+
+func startDiscovery() {
+	if !cfg().Discover && !cfg().Local {
+		return
+	}
+	_, port, _ := net.SplitHostPort(strings.Split(cfg().Addr, ",")[0])
+	disc.port, _ = strconv.Atoi(port)
+	if disc.port == 0 {
+		disc.port = 8080
+	}
+	h, _ := os.Hostname()
+	h = strings.Split(h, ".")[0]
+	if h == "" {
+		h = "blurr"
+	}
+	var b [6]byte
+	rand.Read(b[:])
+	disc.id = hex.EncodeToString(b[:])
+	disc.host = h
+	disc.name = "Blurr on " + h
+	if disc.port != 8080 {
+		disc.name += " port " + port
+	}
+	disc.peers = map[string]*peer{}
+	c, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		degraded("discovery: "+err.Error(), "Allow multicast on this host (UDP 5353), or drop -discover.")
+		return
+	}
+	disc.conn = c
+	go mdnsRead(c)
+	go func() {
+		for {
+			mdnsSend(mdnsQuery())
+			mdnsSend(mdnsAnnounce())
+			time.Sleep(mdnsInterval)
+		}
+	}()
+}
+
+func peerList() []peer {
+	disc.Lock()
+	defer disc.Unlock()
+	var ps []peer
+	for k, p := range disc.peers {
+		if time.Since(p.seen) > 3*mdnsInterval {
+			delete(disc.peers, k)
+			continue
+		}
+		ps = append(ps, *p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Name < ps[j].Name })
+	return ps
+}
+
+func peersFragment(r *http.Request) string {
+	if disc.conn == nil {
+		return ""
+	}
+	ps := peerList()
+	s := "<h3>Other Blurr instances on this network</h3>\n"
+	if len(ps) == 0 {
+		return s + "<p>None found yet. Start another instance with <code>--local</code> or <code>-discover</code> on the same LAN.</p>\n"
+	}
+	s += "<p>Test the link between this server and another one, in both directions:</p>\n"
+	for _, p := range ps {
+		s += `<form method=post action="/pair" style="margin:.2rem 0"><input type=hidden name=peer value="` + html.EscapeString(p.Addr) + `"><button>Test to ` + html.EscapeString(p.Name) + `</button> <small>` + html.EscapeString(p.Addr) + "</small></form>\n"
+	}
+	return s
+}
+
+// pair runs a server-to-server test against a discovered peer: the peer's
+// download measures peer-to-here, our upload measures here-to-peer.
+func pair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "Cross-site request refused", http.StatusForbidden)
+		return
+	}
+	addr := r.FormValue("peer")
+	var p *peer
+	for _, x := range peerList() {
+		if h, _, _ := net.SplitHostPort(x.Addr); x.Addr == addr && lanPeer(net.ParseIP(h)) {
+			p = &x
+			break
+		}
+	}
+	if p == nil {
+		http.Error(w, "unknown peer", http.StatusNotFound)
+		return
+	}
+	// a pair test costs as much as a browser's, so it goes through the
+	// same limits and holds a test slot while it runs
+	if !admit(w, r) {
+		return
+	}
+	ip := limitIP(r)
+	if !q.take(ip) {
+		busy(w)
+		return
+	}
+	defer q.put(ip)
+	if !pairing.TryLock() {
+		busy(w)
+		return
+	}
+	defer pairing.Unlock()
+	size := int64(64 << 20)
+	if cfg().MaxSize > 0 && size > int64(cfg().MaxSize) {
+		size = int64(cfg().MaxSize)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+	holdOpen(w, 2*time.Minute+cfg().RequestTimeout)
+	res, err := runClient(ctx, "http://"+p.Addr, size)
+	budget.add(2 * size)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	body, u, l, b := "", speedUnit(w, r), pageLocale(r), brandFor(r)
+	if err != nil {
+		log.Printf("pair test with %s failed: %v", p.Addr, err)
+		body = "<p>Test failed: " + html.EscapeString(err.Error()) + "</p>"
+	} else {
+		log.Printf("pair test with %s: ping=%.2fms down=%s up=%s", p.Addr, res.Ping, mibps(res.Down), mibps(res.Up))
+		body = `<table>
+<tr><td>Round trip</td><td>` + l.num(res.Ping, 2) + ` ms (jitter ` + l.num(res.Jitter, 2) + ` ms)</td></tr>
+<tr><td>Connection setup</td><td>TCP handshake ` + l.num(res.Connect, 2) + ` ms, first request ` + l.num(res.TTFB, 2) + ` ms</td></tr>
+<tr><td>` + html.EscapeString(p.Name) + ` → this server</td><td>` + l.speed(u, res.Down) + `</td></tr>
+<tr><td>This server → ` + html.EscapeString(p.Name) + `</td><td>` + l.speed(u, res.Up) + `</td></tr>
+</table>`
+	}
+	io.WriteString(w, `<!doctype html>
+<html><head><meta charset="utf-8"><title>`+b.name()+` (point-to-point)</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Arial;max-width:760px;margin:1rem}td{padding:0 1rem 0 0}</style>
+</head><body>
+<h2>`+b.heading(b.name())+` point-to-point test</h2>
+<p>Between `+html.EscapeString(disc.name)+` and `+html.EscapeString(p.Name)+` (`+html.EscapeString(p.Addr)+`)</p>
+`+body+`
+<p><a href="/">Back</a></p>
+</body></html>`)
+}
+
+// lanPeer reports whether ip is in the ranges lanIPs announces from:
+// private, or link-local.
+func lanPeer(ip net.IP) bool { return ip.IsPrivate() || ip.IsLinkLocalUnicast() }
+
+func mdnsSend(msg []byte) {
+	if _, err := disc.conn.WriteToUDP(msg, mdnsGroup); err != nil {
+		log.Printf("mdns: %v", err)
+	}
+}
+
+func mdnsRead(c *net.UDPConn) {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := c.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("mdns: %v", err)
+			return
+		}
+		m, err := parseDNS(buf[:n])
+		if err != nil {
+			continue
+		}
+		if m.flags&0x8000 == 0 {
+			for _, q := range m.questions {
+				if strings.EqualFold(q.name, mdnsService) && (q.typ == 12 || q.typ == 255) {
+					mdnsSend(mdnsAnnounce())
+					break
+				}
+			}
+			continue
+		}
+		if src.Port == mdnsGroup.Port {
+			mdnsLearn(m, src.IP)
+		}
+	}
+}
+
+func mdnsLearn(m *dnsMsg, src net.IP) {
+	srv := map[string]dnsRR{}
+	txt := map[string]string{}
+	a := map[string]net.IP{}
+	for _, rr := range m.records {
+		switch rr.typ {
+		case 33:
+			srv[strings.ToLower(rr.name)] = rr
+		case 16:
+			txt[strings.ToLower(rr.name)] = rr.target
+		case 1:
+			a[strings.ToLower(rr.name)] = rr.ip
+		}
+	}
+	for _, rr := range m.records {
+		if rr.typ != 12 || !strings.EqualFold(rr.name, mdnsService) {
+			continue
+		}
+		inst := strings.ToLower(rr.target)
+		s, ok := srv[inst]
+		if !ok || strings.Contains(txt[inst], "id="+disc.id) {
+			continue
+		}
+		ip := a[strings.ToLower(s.target)]
+		if ip == nil {
+			ip = src
+		}
+		if !lanPeer(ip) {
+			// mDNS answers aren't authenticated: anything outside the
+			// LAN's own ranges would point pair tests at the internet
+			continue
+		}
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(s.port))
+		name := strings.TrimSuffix(rr.target, "."+mdnsService)
+		disc.Lock()
+		disc.peers[addr] = &peer{Name: name, Addr: addr, seen: time.Now()}
+		disc.Unlock()
+	}
+}
+
+func mdnsQuery() []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	b = appendName(b, mdnsService)
+	return binary.BigEndian.AppendUint32(b, 12<<16|1)
+}
+
+func mdnsAnnounce() []byte {
+	inst := disc.name + "." + mdnsService
+	target := disc.host + ".local."
+	ips := lanIPs()
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[2:], 0x8400)
+	binary.BigEndian.PutUint16(b[6:], 1)
+	binary.BigEndian.PutUint16(b[10:], uint16(2+len(ips)))
+	rr := func(b []byte, name string, typ, class uint16, data []byte) []byte {
+		b = appendName(b, name)
+		b = binary.BigEndian.AppendUint16(b, typ)
+		b = binary.BigEndian.AppendUint16(b, class)
+		b = binary.BigEndian.AppendUint32(b, mdnsTTL)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+		return append(b, data...)
+	}
+	b = rr(b, mdnsService, 12, 1, appendName(nil, inst))
+	srv := binary.BigEndian.AppendUint32(nil, 0)
+	srv = binary.BigEndian.AppendUint16(srv, uint16(disc.port))
+	b = rr(b, inst, 33, 0x8001, appendName(srv, target))
+	t := "id=" + disc.id
+	b = rr(b, inst, 16, 0x8001, append([]byte{byte(len(t))}, t...))
+	for _, ip := range ips {
+		b = rr(b, target, 1, 0x8001, ip.To4())
+	}
+	return b
+}
+
+func appendName(b []byte, name string) []byte {
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(l) > 63 {
+			l = l[:63]
+		}
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+type dnsQuestion struct {
+	name string
+	typ  uint16
+}
+
+// dnsRR keeps only what discovery needs: PTR and SRV targets, SRV port,
+// TXT strings (joined by spaces) and A addresses.
+type dnsRR struct {
+	name   string
+	typ    uint16
+	target string
+	port   int
+	ip     net.IP
+}
+
+type dnsMsg struct {
+	flags     uint16
+	questions []dnsQuestion
+	records   []dnsRR
+}
+
+var errDNS = errors.New("malformed dns message")
+
+func parseDNS(b []byte) (*dnsMsg, error) {
+	if len(b) < 12 {
+		return nil, errDNS
+	}
+	m := &dnsMsg{flags: binary.BigEndian.Uint16(b[2:])}
+	qd := int(binary.BigEndian.Uint16(b[4:]))
+	nr := int(binary.BigEndian.Uint16(b[6:])) + int(binary.BigEndian.Uint16(b[8:])) + int(binary.BigEndian.Uint16(b[10:]))
+	off := 12
+	for i := 0; i < qd; i++ {
+		name, n, err := readName(b, off)
+		if err != nil || n+4 > len(b) {
+			return nil, errDNS
+		}
+		m.questions = append(m.questions, dnsQuestion{name, binary.BigEndian.Uint16(b[n:])})
+		off = n + 4
+	}
+	for i := 0; i < nr; i++ {
+		name, n, err := readName(b, off)
+		if err != nil || n+10 > len(b) {
+			return nil, errDNS
+		}
+		rr := dnsRR{name: name, typ: binary.BigEndian.Uint16(b[n:])}
+		l := int(binary.BigEndian.Uint16(b[n+8:]))
+		d := n + 10
+		if d+l > len(b) {
+			return nil, errDNS
+		}
+		switch rr.typ {
+		case 12:
+			rr.target, _, err = readName(b, d)
+		case 33:
+			if l < 7 {
+				return nil, errDNS
+			}
+			rr.port = int(binary.BigEndian.Uint16(b[d+4:]))
+			rr.target, _, err = readName(b, d+6)
+		case 16:
+			var parts []string
+			for j := d; j < d+l; j += int(b[j]) + 1 {
+				if j+1+int(b[j]) > d+l {
+					break
+				}
+				parts = append(parts, string(b[j+1:j+1+int(b[j])]))
+			}
+			rr.target = strings.Join(parts, " ")
+		case 1:
+			if l == 4 {
+				rr.ip = net.IP(append([]byte(nil), b[d:d+4]...))
+			}
+		}
+		if err != nil {
+			return nil, errDNS
+		}
+		m.records = append(m.records, rr)
+		off = d + l
+	}
+	return m, nil
+}
+
+// readName decodes a possibly compressed name at off and returns it with
+// the offset just past it.
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	end, jumps := -1, 0
+	for {
+		if off >= len(b) {
+			return "", 0, errDNS
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(b) || jumps > 16 {
+				return "", 0, errDNS
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+			jumps++
+		default:
+			if off+1+l > len(b) {
+				return "", 0, errDNS
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
@@ -0,0 +1,119 @@
+//go:build !minimal && !nodiscover
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// announcement is what an instance with this id and port would send.
+func announcement(id string, port int) []byte {
+	disc.Lock()
+	defer disc.Unlock()
+	oldID, oldName, oldHost, oldPort := disc.id, disc.name, disc.host, disc.port
+	disc.id, disc.name, disc.host, disc.port = id, "Blurr on "+id, id, port
+	defer func() { disc.id, disc.name, disc.host, disc.port = oldID, oldName, oldHost, oldPort }()
+	return mdnsAnnounce()
+}
+
+func withPeers(t testing.TB, id string) {
+	disc.Lock()
+	oldID, oldPeers := disc.id, disc.peers
+	disc.id, disc.peers = id, map[string]*peer{}
+	disc.Unlock()
+	t.Cleanup(func() {
+		disc.Lock()
+		disc.id, disc.peers = oldID, oldPeers
+		disc.Unlock()
+	})
+}
+
+func TestParseDNS(t *testing.T) {
+	m, err := parseDNS(mdnsQuery())
+	if err != nil || len(m.questions) != 1 || m.questions[0].name != mdnsService || m.questions[0].typ != 12 {
+		t.Fatalf("query: %+v, %v", m, err)
+	}
+	m, err = parseDNS(announcement("peer", 8080))
+	if err != nil || m.flags&0x8000 == 0 {
+		t.Fatalf("announcement: %+v, %v", m, err)
+	}
+	var ptr, srv, txt bool
+	for _, rr := range m.records {
+		switch rr.typ {
+		case 12:
+			ptr = rr.target == "Blurr on peer."+mdnsService
+		case 33:
+			srv = rr.port == 8080 && rr.target == "peer.local."
+		case 16:
+			txt = rr.target == "id=peer"
+		}
+	}
+	if !ptr || !srv || !txt {
+		t.Errorf("announcement records: %+v", m.records)
+	}
+	for _, bad := range [][]byte{
+		nil,
+		make([]byte, 11),
+		// one question, no name
+		{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0},
+		// a label running past the end
+		{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 9, 'a'},
+		// a compression pointer to itself
+		{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xC0, 12, 0, 12, 0, 1},
+	} {
+		if _, err := parseDNS(bad); err == nil {
+			t.Errorf("parseDNS(%x) took it", bad)
+		}
+	}
+}
+
+func TestMdnsLearn(t *testing.T) {
+	withPeers(t, "me")
+	learn := func(b []byte, src string) int {
+		m, err := parseDNS(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		disc.Lock()
+		clear(disc.peers)
+		disc.Unlock()
+		mdnsLearn(m, net.ParseIP(src))
+		disc.Lock()
+		defer disc.Unlock()
+		return len(disc.peers)
+	}
+	if n := learn(announcement("peer", 8080), "192.168.1.5"); n != 1 {
+		t.Errorf("LAN peer: %d learned, want 1", n)
+	}
+	// its own announcements come back too
+	if n := learn(announcement("me", 8080), "192.168.1.5"); n != 0 {
+		t.Errorf("own announcement: %d learned", n)
+	}
+	// nothing outside the LAN's ranges, whatever the answer claims
+	if n := learn(announcement("peer", 8080), "203.0.113.5"); n != 0 {
+		t.Errorf("public peer: %d learned", n)
+	}
+}
+
+func FuzzParseDNS(f *testing.F) {
+	f.Add(mdnsQuery())
+	f.Add(announcement("peer", 8080))
+	f.Add([]byte{0, 0, 0x84, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0xC0, 12, 0, 33, 0, 1, 0, 0, 0, 0, 0, 7, 0, 0, 0, 0, 0x1f, 0x90, 0})
+	f.Add([]byte{0, 0, 0x84, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 16, 0, 1, 0, 0, 0, 0, 0, 3, 5, 'a', 'b'})
+	withPeers(f, "me")
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := parseDNS(b)
+		if err != nil {
+			return
+		}
+		mdnsLearn(m, net.IPv4(192, 168, 1, 5))
+		disc.Lock()
+		defer disc.Unlock()
+		for _, p := range disc.peers {
+			if ip, _, _ := net.SplitHostPort(p.Addr); !lanPeer(net.ParseIP(ip)) {
+				t.Fatalf("learned %s from %x", p.Addr, b)
+			}
+		}
+	})
+}
@@ -0,0 +1,188 @@
+//go:build !minimal && !nofederation
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -peers lists other Blurr servers (a site's other locations, a friend's
+// box) the index page offers to test against instead. This server pings
+// each one every minute, so the list can say roughly how far away they are
+// and sort the nearest first; from the user's network the order is usually
+// the same. Choosing one sends the browser there with the same query
+// (streams and so on), where the test runs as it would for any visitor.
+const fedEvery = time.Minute
+
+type fedPeer struct {
+	Name string    `json:"name"`
+	URL  string    `json:"url"`
+	RTT  float64   `json:"rtt_ms,omitempty"` // this server to the peer, 0 while unknown
+	Up   bool      `json:"up"`
+	When time.Time `json:"checked,omitempty"`
+}
+
+var fed struct {
+	sync.Mutex
+	peers []fedPeer
+}
+
+func init() {
+	register(subsystem{
+		name: "federation",
+		flags: func() {
+			flag.StringVar(&settings.Peers, "peers", settings.Peers, "other Blurr servers to offer on the index page, as [name=]URL separated by commas")
+		},
+		start: startFederation,
+		routes: func(m *http.ServeMux) {
+			m.HandleFunc("/go", goPeer)
+			m.HandleFunc("/api/v1/servers", serversJSON)
+		},
+		index: serversFragment,
+	})
+}
+
+func startFederation() {
+	if cfg().Peers == "" {
+		return
+	}
+	for _, p := range strings.Split(cfg().Peers, ",") {
+		name, raw, named := strings.Cut(strings.TrimSpace(p), "=")
+		if !named {
+			raw = name
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+			degraded("-peers "+p+": not an http(s) URL", "List peers as name=https://host[:port], separated by commas.")
+			continue
+		}
+		if !named {
+			name = u.Host
+		}
+		fed.peers = append(fed.peers, fedPeer{Name: strings.TrimSpace(name), URL: strings.TrimSuffix(u.String(), "/")})
+	}
+	if len(fed.peers) > 0 {
+		go probePeers()
+	}
+}
+
+func probePeers() {
+	c := &http.Client{Timeout: 5 * time.Second}
+	for {
+		for i := range fed.peers {
+			rtt, err := peerRTT(c, fed.peers[i].URL)
+			fed.Lock()
+			fed.peers[i].Up, fed.peers[i].When = err == nil, time.Now()
+			if err == nil {
+				fed.peers[i].RTT = rtt
+			}
+			fed.Unlock()
+		}
+		time.Sleep(fedEvery)
+	}
+}
+
+// peerRTT is the lowest of a few /ping round trips over one connection,
+// after a first one that pays for setting it up.
+func peerRTT(c *http.Client, base string) (float64, error) {
+	best := 0.0
+	for i := 0; i < 4; i++ {
+		t0 := time.Now()
+		res, err := c.Get(base + "/ping?nonce=" + strconv.FormatInt(t0.UnixNano(), 36))
+		if err != nil {
+			return 0, err
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+			return 0, errors.New(res.Status)
+		}
+		if ms := float64(time.Since(t0).Microseconds()) / 1000; i > 0 && (best == 0 || ms < best) {
+			best = ms
+		}
+	}
+	return best, nil
+}
+
+// fedList is the peers nearest first, unreachable ones last.
+func fedList() []fedPeer {
+	fed.Lock()
+	ps := append([]fedPeer(nil), fed.peers...)
+	fed.Unlock()
+	sort.SliceStable(ps, func(i, j int) bool {
+		if ps[i].Up != ps[j].Up {
+			return ps[i].Up
+		}
+		return ps[i].Up && ps[i].RTT < ps[j].RTT
+	})
+	return ps
+}
+
+func serversFragment(r *http.Request) string {
+	ps := fedList()
+	if len(ps) == 0 {
+		return ""
+	}
+	s := "<h3>Other servers</h3>\n<p>You're testing against " + html.EscapeString(cfg().Hostname) + ". To test against another server instead:</p>\n<ul>\n"
+	for _, p := range ps {
+		hint := "not checked yet"
+		switch {
+		case p.Up && p.RTT > 0:
+			hint = pageLocale(r).num(p.RTT, 1) + " ms from this server"
+		case !p.When.IsZero():
+			hint = "unreachable from this server"
+		}
+		s += `<li><a href="/go?` + html.EscapeString(peerQuery(r, p.Name)) + `">` + html.EscapeString(p.Name) + "</a> <small>" + html.EscapeString(hint) + "</small></li>\n"
+	}
+	return s + "</ul>\n"
+}
+
+// peerQuery is r's query with peer=name added, so /go can pass the rest on.
+func peerQuery(r *http.Request, name string) string {
+	q := r.URL.Query()
+	q.Set("peer", name)
+	return q.Encode()
+}
+
+// goPeer sends the browser to the chosen peer's index page, keeping the
+// query it came with.
+func goPeer(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := q.Get("peer")
+	q.Del("peer")
+	for _, p := range fedList() {
+		if p.Name == name {
+			u := p.URL + "/"
+			if len(q) > 0 {
+				u += "?" + q.Encode()
+			}
+			http.Redirect(w, r, u, http.StatusFound)
+			return
+		}
+	}
+	http.Error(w, "unknown server", http.StatusNotFound)
+}
+
+func serversJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	ps := fedList()
+	if ps == nil {
+		ps = []fedPeer{}
+	}
+	json.NewEncoder(w).Encode(struct {
+		Self  string    `json:"self"`
+		Peers []fedPeer `json:"peers"`
+	}{cfg().Hostname, ps})
+}
@@ -0,0 +1,133 @@
+//go:build !minimal && !nogolden
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	register(subsystem{name: "golden", cmd: "golden", run: runGolden})
+}
+
+// goldenResults are representative results for "blurr golden -init".
+func goldenResults() map[string]result {
+	t := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	series := func(n int, v int64) []int64 {
+		s := make([]int64, n)
+		for i := range s {
+			s[i] = v * int64(min(i+1, 5)) / 5
+		}
+		return s
+	}
+	return map[string]result{
+		"basic": {ID: "0123456789abcdef", Time: t, IP: "192.0.2.1", Pings: []float64{12, 14, 11, 13}, Ping: 12.5, Jitter: 1.12,
+			Down: 11.5e6, Up: 2.4e6, ServerDown: 11.7e6, ClientUp: 2.3e6, Streams: 1, Done: true},
+		"full": {ID: "fedcba9876543210", Time: t, IP: "2001:db8::1", POP: "fra1", Server: "blurr-1", Method: "4cab30d95f1e", Label: "Kitchen <laptop>", Pings: []float64{20, 22, 21}, Ping: 21, Jitter: 0.82, JitterRFC: 0.18,
+			PingStats: &spread{Min: 20, Median: 21, P95: 21.9, P99: 21.98, Max: 22},
+			LoadPings: []float64{80, 95, 110}, LoadPing: 95, Probes: 50, ProbesOK: 47, ProbesSeen: 49, ProbeMs: 300,
+			ProbeTTFB: []float64{21, 24, 250}, DownTTFB: []float64{35}, AcceptMs: []float64{0.4, 0.6},
+			Down: 48e6, Up: 9e6, ServerDown: 50e6, ClientUp: 8.8e6, Streams: 4, DownBytes: 480e6, UpBytes: 8 << 20,
+			Phases:   []phaseResult{{Name: "Video-like 25 Mbit/s", Streams: 1, Bytes: 16 << 20, Down: 3.1e6, ServerDown: 3.1e6}},
+			Timings:  []timing{{Kind: "download", Start: t, End: t.Add(10 * time.Second), Bytes: 480e6, TCP: &tcpStat{RTTMs: 24.5, MinRTTMs: 19.8, Cwnd: 310, Retrans: 412, SegsOut: 331000}}},
+			SampleMs: 100, DownSeries: series(100, 4.8e6), UpSeries: series(10, 0.9e6), Done: true},
+	}
+}
+
+// runGolden is "blurr golden": it renders every result in a directory
+// (name.json) and compares the page with name.html, so theme and template
+// changes can be checked against representative results. -init writes a
+// starter set, -update accepts the current rendering.
+func runGolden(args []string) {
+	fs := flag.NewFlagSet("golden", flag.ExitOnError)
+	initDir := fs.Bool("init", false, "write built-in representative results into the directory first")
+	update := fs.Bool("update", false, "overwrite the .html files with the current rendering")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: blurr golden [-init] [-update] dir")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	dir := fs.Arg(0)
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *initDir {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			fail(err)
+		}
+		for name, r := range goldenResults() {
+			b, _ := json.MarshalIndent(r, "", "  ")
+			if err := os.WriteFile(filepath.Join(dir, name+".json"), append(b, '\n'), 0o644); err != nil {
+				fail(err)
+			}
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) == 0 {
+		fail(fmt.Errorf("no .json results in %s (try -init)", dir))
+	}
+	sort.Strings(files)
+	bad := 0
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			fail(err)
+		}
+		var r result
+		if err := json.Unmarshal(b, &r); err != nil {
+			fail(fmt.Errorf("%s: %v", f, err))
+		}
+		var page bytes.Buffer
+		writeResult(&page, &r)
+		gf := strings.TrimSuffix(f, ".json") + ".html"
+		want, err := os.ReadFile(gf)
+		switch {
+		case *update || *initDir && os.IsNotExist(err):
+			if err := os.WriteFile(gf, page.Bytes(), 0o644); err != nil {
+				fail(err)
+			}
+			fmt.Println("wrote", gf)
+		case err != nil:
+			fmt.Println("missing", gf)
+			bad++
+		case !bytes.Equal(want, page.Bytes()):
+			fmt.Println("differs", gf+":", firstDiff(string(want), page.String()))
+			bad++
+		default:
+			fmt.Println("ok", gf)
+		}
+	}
+	if bad > 0 {
+		os.Exit(1)
+	}
+}
+
+func firstDiff(a, b string) string {
+	al, bl := strings.Split(a, "\n"), strings.Split(b, "\n")
+	for i := 0; i < len(al) || i < len(bl); i++ {
+		var x, y string
+		if i < len(al) {
+			x = al[i]
+		}
+		if i < len(bl) {
+			y = bl[i]
+		}
+		if x != y {
+			return fmt.Sprintf("line %d\n  want: %s\n  got:  %s", i+1, x, y)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+//go:build !minimal && !nographite
+
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// For stacks older than Prometheus, each finished result can also go out as
+// Graphite plaintext (one "path value timestamp" line per metric, over TCP)
+// and as StatsD gauges (over UDP), under -metric-prefix.
+var graphite struct{ carbon, statsd *sink }
+
+func init() {
+	register(subsystem{
+		name: "graphite",
+		flags: func() {
+			flag.StringVar(&settings.Graphite, "graphite", settings.Graphite, "Carbon plaintext address (host:port, usually :2003) to send each result's metrics to")
+			flag.StringVar(&settings.StatsD, "statsd", settings.StatsD, "StatsD address (host:port, usually :8125) to send each result's metrics to as gauges")
+			flag.StringVar(&settings.MetricPrefix, "metric-prefix", settings.MetricPrefix, "path the -graphite and -statsd metrics go under (default blurr.<hostname>, plus .<pop> with -pop)")
+		},
+		start: startGraphite,
+		done:  graphiteDone,
+	})
+}
+
+func startGraphite() {
+	check := func(flag, addr, example string) bool {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			degraded("-"+flag+" "+addr+": "+err.Error(), "Give host:port, e.g. "+example+".")
+			return false
+		}
+		return true
+	}
+	if cfg().Graphite != "" && check("graphite", cfg().Graphite, "localhost:2003") {
+		graphite.carbon = newSink("graphite", func(s string) error { return sendMetrics("tcp", cfg().Graphite, s) }, nil)
+	}
+	if cfg().StatsD != "" && check("statsd", cfg().StatsD, "localhost:8125") {
+		graphite.statsd = newSink("statsd", func(s string) error { return sendMetrics("udp", cfg().StatsD, s) }, nil)
+	}
+}
+
+// metricPrefix is -metric-prefix, or blurr.<hostname>[.<pop>] with the dots
+// in the names made safe for a Graphite path.
+func metricPrefix(res *result) string {
+	if cfg().MetricPrefix != "" {
+		return strings.TrimSuffix(cfg().MetricPrefix, ".")
+	}
+	safe := strings.NewReplacer(".", "_", " ", "_", "/", "_", ":", "_", "|", "_")
+	p := "blurr." + safe.Replace(cfg().Hostname)
+	if res.POP != "" {
+		p += "." + safe.Replace(res.POP)
+	}
+	return p
+}
+
+// resultMetrics is the metrics a result carries, in a fixed order.
+func resultMetrics(res *result) [][2]string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	m := [][2]string{
+		{"download_bps", f(res.Down)}, {"upload_bps", f(res.Up)},
+		{"ping_ms", f(res.Ping)}, {"jitter_ms", f(res.Jitter)},
+		{"streams", strconv.Itoa(res.Streams)},
+	}
+	if res.LoadPing > 0 {
+		m = append(m, [2]string{"loaded_ping_ms", f(res.LoadPing)})
+	}
+	return m
+}
+
+func graphiteDone(_ *http.Request, res *result) {
+	p := metricPrefix(res)
+	if graphite.carbon != nil {
+		ts := strconv.FormatInt(res.Time.Unix(), 10)
+		s := ""
+		for _, m := range resultMetrics(res) {
+			s += p + "." + m[0] + " " + m[1] + " " + ts + "\n"
+		}
+		graphite.carbon.post(s)
+	}
+	if graphite.statsd != nil {
+		s := ""
+		for _, m := range resultMetrics(res) {
+			s += p + "." + m[0] + ":" + m[1] + "|g\n"
+		}
+		graphite.statsd.post(s)
+	}
+}
+
+func sendMetrics(network, addr, s string) error {
+	c, err := net.DialTimeout(network, addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err = c.Write([]byte(s))
+	return err
+}
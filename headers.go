@@ -0,0 +1,100 @@
+//go:build !minimal && !noheaders
+
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// Every response carries a Content-Security-Policy, nosniff and a referrer
+// policy. The default policy is as tight as the pages allow: they run
+// inline script and style, the no-JS test frames its own downloads, and
+// phases with a via address are fetched from other origins. Operators who
+// embed Blurr elsewhere widen -frame-ancestors.
+func init() {
+	register(subsystem{
+		name: "headers",
+		flags: func() {
+			flag.StringVar(&settings.CSP, "csp", settings.CSP, "Content-Security-Policy to send instead of the built-in one (\"off\" for none)")
+			flag.StringVar(&settings.FrameAncestors, "frame-ancestors", settings.FrameAncestors, "who may show Blurr in a frame, in CSP syntax, e.g. \"'self' https://intranet.example\" or \"*\"")
+			flag.StringVar(&settings.ReferrerPolicy, "referrer-policy", settings.ReferrerPolicy, "Referrer-Policy header")
+		},
+		wrap:   secureHeaders,
+		reload: refreshPolicy,
+	})
+}
+
+// policy is contentPolicy as of startup or the last reload, which can
+// bring new phases and hosts and so new origins.
+var policy atomic.Pointer[string]
+
+func refreshPolicy() {
+	p := contentPolicy()
+	policy.Store(&p)
+}
+
+func secureHeaders(next http.Handler) http.Handler {
+	refreshPolicy()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if csp := *policy.Load(); csp != "" {
+			h.Set("Content-Security-Policy", csp)
+		}
+		h.Set("X-Content-Type-Options", "nosniff")
+		if cfg().ReferrerPolicy != "" {
+			h.Set("Referrer-Policy", cfg().ReferrerPolicy)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func contentPolicy() string {
+	switch cfg().CSP {
+	case "off":
+		return ""
+	case "":
+	default:
+		return cfg().CSP
+	}
+	connect := "'self'"
+	for i := range cfg().Phases {
+		if o := phaseOrigin(cfg().Phases[i].base()); o != "" {
+			connect += " " + o
+		}
+	}
+	img := "'self' data:"
+	logos := []string{cfg().Logo}
+	for _, h := range cfg().Hosts {
+		logos = append(logos, h.Logo)
+	}
+	for _, l := range logos {
+		if o := phaseOrigin(l); o != "" && !strings.Contains(img, " "+o) {
+			img += " " + o
+		}
+	}
+	p := "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; img-src " + img + "; connect-src " + connect + "; frame-src 'self'; form-action 'self'; base-uri 'none'"
+	if cfg().FrameAncestors != "" {
+		p += "; frame-ancestors " + cfg().FrameAncestors
+	}
+	return p
+}
+
+// phaseOrigin turns a phase's base ("//host:port" or a URL) into a CSP
+// source; without a scheme it matches the page's own.
+func phaseOrigin(base string) string {
+	if base == "" {
+		return ""
+	}
+	if h, ok := strings.CutPrefix(base, "//"); ok {
+		return h
+	}
+	u, err := url.Parse(base)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Subsystems that depend on something outside Blurr (a database file, DNS,
+// a chat server) report how it's going here. A failing one degrades on
+// its own, retrying or skipping its part, and never holds up a test;
+// /readyz and /metrics show which are degraded.
+type component struct {
+	ok       bool
+	since    time.Time
+	failures int // in a row
+	err      string
+}
+
+var health struct {
+	sync.Mutex
+	m map[string]*component
+}
+
+// setHealth records the outcome of a component's latest attempt.
+func setHealth(name string, err error) {
+	health.Lock()
+	defer health.Unlock()
+	if health.m == nil {
+		health.m = map[string]*component{}
+	}
+	c := health.m[name]
+	if c == nil {
+		c = &component{ok: true, since: time.Now()}
+		health.m[name] = c
+	}
+	if ok := err == nil; ok != c.ok {
+		c.ok, c.since = ok, time.Now()
+	}
+	if err != nil {
+		c.failures++
+		c.err = err.Error()
+	} else {
+		c.failures, c.err = 0, ""
+	}
+}
+
+// components returns a copy of every component's state, by name.
+func components() (names []string, cs []component) {
+	health.Lock()
+	defer health.Unlock()
+	for n := range health.m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		cs = append(cs, *health.m[n])
+	}
+	return names, cs
+}
+
+// backoff is how long to wait after the given number of failures in a
+// row: from min, doubling, up to max.
+func backoff(failures int, min, max time.Duration) time.Duration {
+	d := min
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// readyz answers 200 while the server can run tests, degraded components
+// or not, and 503 once the daily budget is used up. The body lists each
+// component's state.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if budget.exhausted() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "not ready: daily traffic budget used up\n")
+	} else {
+		io.WriteString(w, "ready\n")
+	}
+	names, cs := components()
+	for i, c := range cs {
+		s := names[i] + ": ok"
+		if !c.ok {
+			s = names[i] + ": degraded since " + c.since.Format(time.RFC3339) + " (" + strconv.Itoa(c.failures) + " failures, last: " + c.err + ")"
+		}
+		io.WriteString(w, s+"\n")
+	}
+}
@@ -0,0 +1,178 @@
+//go:build !minimal && !nohistory
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"html"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// History keeps the last finished results in memory. Visitors see their own
+// by IP, or, if they opt in, by an anonymous ID cookie that survives CGNAT
+// and address changes.
+const (
+	histCap    = 1000
+	histCookie = "blurr_id"
+)
+
+type histEntry struct {
+	client string // anonymous ID, "" if the visitor didn't opt in
+	addr   string // limitIP, which a made-up X-Forwarded-For can't change
+	res    result
+}
+
+var hist struct {
+	sync.Mutex
+	list []histEntry
+}
+
+func init() {
+	register(subsystem{
+		name: "history",
+		routes: func(m *http.ServeMux) {
+			m.HandleFunc("/history", historyPage)
+			m.HandleFunc("/history/remember", rememberMe)
+			m.HandleFunc("/history/forget", forgetMe)
+		},
+		index: func(*http.Request) string { return `<p><a href="/history">Your past results</a></p>` + "\n" },
+		done:  addHistory,
+		purge: purgeHistory,
+	})
+}
+
+func histOff() bool { return cfg().LowMem || cfg().Local }
+
+func clientID(r *http.Request) string {
+	c, err := r.Cookie(histCookie)
+	if err != nil || len(c.Value) != 32 {
+		return ""
+	}
+	if _, err := hex.DecodeString(c.Value); err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+func addHistory(r *http.Request, res *result) {
+	if histOff() {
+		return
+	}
+	hist.Lock()
+	defer hist.Unlock()
+	if len(hist.list) >= histCap {
+		hist.list = append(hist.list[:0], hist.list[1:]...)
+	}
+	e := histEntry{clientID(r), limitIP(r), *res}
+	e.res.Timings, e.res.DownSeries, e.res.UpSeries = nil, nil, nil
+	hist.list = append(hist.list, e)
+}
+
+func purgeHistory(keep func(*result) bool) []string {
+	hist.Lock()
+	defer hist.Unlock()
+	var gone []string
+	kept := hist.list[:0]
+	for _, e := range hist.list {
+		if keep(&e.res) {
+			kept = append(kept, e)
+		} else {
+			gone = append(gone, e.res.ID)
+		}
+	}
+	clear(hist.list[len(kept):])
+	hist.list = kept
+	return gone
+}
+
+// mine returns the visitor's results, newest first. With the cookie only
+// results tied to it count; without it, untagged results from the same
+// connection address (see limitIP).
+func mine(r *http.Request) []result {
+	id, ip := clientID(r), limitIP(r)
+	hist.Lock()
+	defer hist.Unlock()
+	var out []result
+	for i := len(hist.list) - 1; i >= 0; i-- {
+		e := &hist.list[i]
+		if id != "" && e.client == id || id == "" && e.client == "" && e.addr == ip {
+			out = append(out, e.res)
+		}
+	}
+	return out
+}
+
+func historyPage(w http.ResponseWriter, r *http.Request) {
+	body, u, l := "", speedUnit(w, r), pageLocale(r)
+	switch {
+	case histOff():
+		body = "<p>This server doesn't keep a history.</p>\n"
+	default:
+		rows := ""
+		for _, res := range mine(r) {
+			rows += `<tr><td><a href="/r/` + res.ID + `">` + l.when(res.Time) + `</a></td><td>` + html.EscapeString(res.Label) + `</td><td>` + l.speed(u, res.Down) + `</td><td>` + l.speed(u, res.Up) + `</td></tr>` + "\n"
+		}
+		if rows == "" {
+			body = "<p>No results yet.</p>\n"
+		} else {
+			body = "<table>\n<tr><th>Time</th><th>Label</th><th>Download</th><th>Upload</th></tr>\n" + rows + "</table>\n" + unitSwitch(u)
+		}
+		if clientID(r) == "" {
+			body += `<p>Results are matched by your IP address, which can be shared (CGNAT) or change. To keep your tests together instead, this browser can store a random ID in a cookie. It identifies nothing but your results here, and you can revoke it any time.</p>
+<form method="post" action="/history/remember"><button>Remember this browser</button></form>
+`
+		} else {
+			body += `<p>This browser is remembered with an anonymous ID cookie. Forgetting it deletes the cookie and every result tied to it from the server.</p>
+<form method="post" action="/history/forget"><button>Forget this browser and delete its history</button></form>
+`
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, `<!doctype html>
+<html><head><meta charset="utf-8"><title>Blurr (history)</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Arial;max-width:760px;margin:1rem}td{padding:0 1rem 0 0}</style>
+</head><body>
+<h2>Your past results</h2>
+`+body+`<p><a href="/">Run a test</a></p>
+</body></html>`)
+}
+
+func rememberMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if clientID(r) == "" {
+		var b [16]byte
+		rand.Read(b[:])
+		http.SetCookie(w, &http.Cookie{Name: histCookie, Value: hex.EncodeToString(b[:]), Path: "/", MaxAge: 365 * 24 * 3600, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	}
+	http.Redirect(w, r, "/history", http.StatusSeeOther)
+}
+
+func forgetMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if id := clientID(r); id != "" {
+		ids := map[string]bool{}
+		hist.Lock()
+		for _, e := range hist.list {
+			if e.client == id {
+				ids[e.res.ID] = true
+			}
+		}
+		hist.Unlock()
+		// everywhere the results are kept (sessions, the recent ring,
+		// households and the API), history included
+		purge(func(res *result) bool { return !ids[res.ID] })
+	}
+	http.SetCookie(w, &http.Cookie{Name: histCookie, Value: "", Path: "/", Expires: time.Unix(0, 0), MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	http.Redirect(w, r, "/history", http.StatusSeeOther)
+}
@@ -0,0 +1,248 @@
+//go:build !minimal && !nohousehold
+
+package main
+
+import (
+	"crypto/rand"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A household groups the results of several devices under a short code
+// entered on each of them, so one report shows whether it's the whole
+// connection or only one laptop that's slow. Groups live in memory for a
+// week.
+const (
+	groupTTL     = 7 * 24 * time.Hour
+	groupMembers = 50
+	groupAlpha   = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+type group struct {
+	created time.Time
+	results []result
+}
+
+var groups = struct {
+	sync.Mutex
+	m map[string]*group
+}{m: map[string]*group{}}
+
+func init() {
+	register(subsystem{
+		name: "household",
+		routes: func(m *http.ServeMux) {
+			m.HandleFunc("/household", householdPage)
+			m.HandleFunc("/household/", groupPage)
+		},
+		index:  householdStep,
+		result: householdLink,
+		done:   addToGroup,
+		purge:  purgeGroups,
+	})
+}
+
+func groupCap() int {
+	if cfg().LowMem {
+		return 10
+	}
+	return 1000
+}
+
+func newGroup() string {
+	groups.Lock()
+	defer groups.Unlock()
+	for code, g := range groups.m {
+		if time.Since(g.created) > groupTTL {
+			delete(groups.m, code)
+		}
+	}
+	if len(groups.m) >= groupCap() {
+		return ""
+	}
+	for {
+		var b [6]byte
+		rand.Read(b[:])
+		for i := range b {
+			b[i] = groupAlpha[int(b[i])%len(groupAlpha)]
+		}
+		if code := string(b[:]); groups.m[code] == nil {
+			groups.m[code] = &group{created: time.Now()}
+			return code
+		}
+	}
+}
+
+// findGroup returns a copy of the group's results, or nil if there's no
+// such group.
+func findGroup(code string) []result {
+	groups.Lock()
+	defer groups.Unlock()
+	g := groups.m[code]
+	if g == nil || time.Since(g.created) > groupTTL {
+		return nil
+	}
+	return append([]result{}, g.results...)
+}
+
+func purgeGroups(keep func(*result) bool) []string {
+	groups.Lock()
+	defer groups.Unlock()
+	var gone []string
+	for _, g := range groups.m {
+		kept := g.results[:0]
+		for _, r := range g.results {
+			if keep(&r) {
+				kept = append(kept, r)
+			} else {
+				gone = append(gone, r.ID)
+			}
+		}
+		clear(g.results[len(kept):])
+		g.results = kept
+	}
+	return gone
+}
+
+func addToGroup(_ *http.Request, res *result) {
+	if res.Group == "" {
+		return
+	}
+	groups.Lock()
+	defer groups.Unlock()
+	g := groups.m[res.Group]
+	if g == nil || len(g.results) >= groupMembers {
+		return
+	}
+	r := *res
+	r.Pings, r.Timings, r.DownSeries, r.UpSeries = nil, nil, nil, nil
+	g.results = append(g.results, r)
+}
+
+func householdPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		code := newGroup()
+		if code == "" {
+			http.Error(w, "Too many households right now, try again later.", http.StatusServiceUnavailable)
+			return
+		}
+		http.Redirect(w, r, "/household/"+code, http.StatusSeeOther)
+		return
+	}
+	if code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("code"))); code != "" {
+		http.Redirect(w, r, "/household/"+url.PathEscape(code), http.StatusSeeOther)
+		return
+	}
+	housePage(w, "Test several devices", `<p>Test every device at home against the same household code and get one report, to tell a slow connection from one slow device.</p>
+<form method="post" action="/household"><button>Start a household</button></form>
+<form method="get" action="/household"><p><label>Or join one with its code: <input name="code" size="8" maxlength="8" autocapitalize="characters"></label> <button>Join</button></p></form>
+`)
+}
+
+func groupPage(w http.ResponseWriter, r *http.Request) {
+	code := strings.ToUpper(strings.TrimPrefix(r.URL.Path, "/household/"))
+	res := findGroup(code)
+	if res == nil {
+		http.Error(w, "No such household (codes are kept for a week).", http.StatusNotFound)
+		return
+	}
+	c := html.EscapeString(code)
+	housePage(w, "Household "+code, `<p>Enter <strong>`+c+`</strong> on each device you want to compare, or open this page there. Give every device its own name.</p>
+<form method="get" action="/"><input type="hidden" name="group" value="`+c+`"><p><label>This device: <input name="label" size="20" maxlength="40" placeholder="e.g. Kitchen laptop" required></label> <button>Test it</button></p></form>
+`+groupReport(res, speedUnit(w, r), pageLocale(r)))
+}
+
+// groupReport shows each device's latest result and flags the ones well
+// below the household's median download.
+func groupReport(res []result, u unit, l *locale) string {
+	if len(res) == 0 {
+		return "<p>No devices tested yet.</p>\n"
+	}
+	latest := map[string]result{}
+	for _, r := range res {
+		name := r.Label
+		if name == "" {
+			name = r.IP
+		}
+		if o, ok := latest[name]; !ok || r.Time.After(o.Time) {
+			latest[name] = r
+		}
+	}
+	names := make([]string, 0, len(latest))
+	downs := make([]float64, 0, len(latest))
+	for n, r := range latest {
+		names = append(names, n)
+		downs = append(downs, r.Down)
+	}
+	sort.Strings(names)
+	sort.Float64s(downs)
+	median := downs[len(downs)/2]
+	if len(downs)%2 == 0 {
+		median = (downs[len(downs)/2-1] + downs[len(downs)/2]) / 2
+	}
+	ms := func(v float64) string { return l.num(v, 2) + " ms" }
+	s := "<table>\n<tr><th>Device</th><th>Tested</th><th>Ping</th><th>Download</th><th>Upload</th><th></th></tr>\n"
+	slow := 0
+	for _, n := range names {
+		r := latest[n]
+		note := ""
+		if len(latest) > 1 && r.Down < median/2 {
+			note = "much slower than the rest"
+			slow++
+		}
+		s += `<tr><td><a href="/r/` + r.ID + `">` + html.EscapeString(n) + `</a></td><td>` + l.when(r.Time) + `</td><td>` + ms(r.Ping) + `</td><td>` + l.speed(u, r.Down) + `</td><td>` + l.speed(u, r.Up) + `</td><td>` + note + "</td></tr>\n"
+	}
+	s += "</table>\n"
+	switch {
+	case len(latest) < 2:
+		s += "<p>Test another device to compare.</p>\n"
+	case slow > 0:
+		s += "<p>The connection itself looks fine; the flagged devices are the problem (their Wi-Fi signal, adapter or load).</p>\n"
+	default:
+		s += "<p>All devices get similar speeds, so any slowness is the connection rather than one device.</p>\n"
+	}
+	methods := map[string]bool{}
+	for _, r := range latest {
+		methods[r.Method] = true
+	}
+	if len(methods) > 1 {
+		s += "<p>Not every device was tested with the same settings (the method differs), so small differences may come from that.</p>\n"
+	}
+	return s
+}
+
+func householdStep(r *http.Request) string {
+	code := strings.ToUpper(r.URL.Query().Get("group"))
+	if code == "" {
+		return `<p><a href="/household">Test several devices</a> and compare them in one household report.</p>` + "\n"
+	}
+	if findGroup(code) == nil {
+		return ""
+	}
+	return `<p style="border:1px solid #ccc;padding:.5rem">Testing <strong>` + html.EscapeString(r.URL.Query().Get("label")) + `</strong> for household <a href="/household/` + html.EscapeString(code) + `">` + html.EscapeString(code) + `</a>. Press Start.</p>` + "\n"
+}
+
+func householdLink(res *result) string {
+	if res.Group == "" || findGroup(res.Group) == nil {
+		return ""
+	}
+	return `<p><a href="/household/` + html.EscapeString(res.Group) + `">Household report for ` + html.EscapeString(res.Group) + `</a> · test another device there with the same code.</p>` + "\n"
+}
+
+func housePage(w http.ResponseWriter, title, body string) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, `<!doctype html>
+<html><head><meta charset="utf-8"><title>Blurr (`+html.EscapeString(title)+`)</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Arial;max-width:760px;margin:1rem}td{padding:0 1rem 0 0}</style>
+</head><body>
+<h2>`+html.EscapeString(title)+`</h2>
+`+body+`<p><a href="/">Back</a></p>
+</body></html>`)
+}
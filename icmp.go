@@ -0,0 +1,183 @@
+//go:build !minimal && !noicmp
+
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// With -icmp the server pings the client itself while the test runs. Raw
+// sockets need root or CAP_NET_RAW; without them the feature turns itself
+// off. Behind NAT the echo is answered by the client's router, which is
+// still the network path the browser's ping crosses.
+const (
+	icmpCount = 5
+	icmpWait  = time.Second
+)
+
+var icmp struct {
+	once   sync.Once
+	c4, c6 *net.IPConn
+	mu     sync.Mutex
+	seq    uint16
+	wait   map[uint16]chan struct{}
+}
+
+func init() {
+	register(subsystem{
+		name: "icmp",
+		flags: func() {
+			flag.BoolVar(&settings.ICMP, "icmp", settings.ICMP, "also ping the client with ICMP from the server during the test (needs CAP_NET_RAW)")
+		},
+		start: func() {
+			if cfg().ICMP {
+				icmp.once.Do(icmpOpen)
+			}
+		},
+		begin:  icmpSession,
+		result: icmpRow,
+	})
+}
+
+func icmpID() uint16 { return uint16(os.Getpid()) }
+
+func icmpOpen() {
+	icmp.wait = map[uint16]chan struct{}{}
+	var err4, err6 error
+	icmp.c4, err4 = net.ListenIP("ip4:icmp", nil)
+	icmp.c6, err6 = net.ListenIP("ip6:ipv6-icmp", nil)
+	if err4 != nil && err6 != nil {
+		degraded("icmp: "+err4.Error(), "Run as root or give the binary CAP_NET_RAW (setcap cap_net_raw+ep blurr), or drop -icmp.")
+	}
+	for _, c := range []*net.IPConn{icmp.c4, icmp.c6} {
+		if c != nil {
+			go icmpRead(c)
+		}
+	}
+}
+
+// icmpRead hands echo replies meant for this process to whoever waits for
+// their sequence number.
+func icmpRead(c *net.IPConn) {
+	b := make([]byte, 1500)
+	for {
+		n, _, err := c.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		if n < 8 || b[0] != 0 && b[0] != 129 || binary.BigEndian.Uint16(b[4:]) != icmpID() {
+			continue
+		}
+		icmp.mu.Lock()
+		if ch := icmp.wait[binary.BigEndian.Uint16(b[6:])]; ch != nil {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+		icmp.mu.Unlock()
+	}
+}
+
+// icmpEcho sends one echo request to ip and returns the round trip, or
+// false if no reply came in time.
+func icmpEcho(ip net.IP) (time.Duration, bool) {
+	c, typ := icmp.c4, byte(8)
+	if ip.To4() == nil {
+		c, typ = icmp.c6, 128
+	}
+	if c == nil {
+		return 0, false
+	}
+	ch := make(chan struct{}, 1)
+	icmp.mu.Lock()
+	icmp.seq++
+	seq := icmp.seq
+	icmp.wait[seq] = ch
+	icmp.mu.Unlock()
+	defer func() {
+		icmp.mu.Lock()
+		delete(icmp.wait, seq)
+		icmp.mu.Unlock()
+	}()
+	msg := []byte{typ, 0, 0, 0}
+	msg = binary.BigEndian.AppendUint16(msg, icmpID())
+	msg = binary.BigEndian.AppendUint16(msg, seq)
+	msg = append(msg, "blurr..."...)
+	if typ == 8 { // the kernel fills in the ICMPv6 checksum
+		binary.BigEndian.PutUint16(msg[2:], inetChecksum(msg))
+	}
+	t0 := time.Now()
+	if _, err := c.WriteTo(msg, &net.IPAddr{IP: ip}); err != nil {
+		return 0, false
+	}
+	select {
+	case <-ch:
+		return time.Since(t0), true
+	case <-time.After(icmpWait):
+		return 0, false
+	}
+}
+
+func inetChecksum(b []byte) uint16 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+func icmpSession(s *session) {
+	if !cfg().ICMP {
+		return
+	}
+	icmp.once.Do(icmpOpen)
+	ip := net.ParseIP(s.addr)
+	if ip == nil || icmp.c4 == nil && icmp.c6 == nil {
+		return
+	}
+	go func() {
+		for i := 0; i < icmpCount; i++ {
+			d, ok := icmpEcho(ip)
+			s.update(func(r *result) {
+				if ok {
+					r.ICMP = append(r.ICMP, float64(d.Microseconds())/1000)
+				} else {
+					r.ICMPLost++
+				}
+			})
+			time.Sleep(200 * time.Millisecond)
+		}
+	}()
+}
+
+func icmpRow(res *result) string {
+	if len(res.ICMP) == 0 && res.ICMPLost == 0 {
+		return ""
+	}
+	if len(res.ICMP) == 0 {
+		return "<p>ICMP ping from the server: no replies (the client or its router may drop pings).</p>\n"
+	}
+	avg, _ := meanSD(res.ICMP)
+	ms := func(v float64) string { return res.loc.num(v, 2) + " ms" }
+	s := "<p>ICMP ping from the server: " + ms(avg)
+	if res.ICMPLost > 0 {
+		s += " (" + strconv.Itoa(res.ICMPLost) + " of " + strconv.Itoa(len(res.ICMP)+res.ICMPLost) + " lost)"
+	}
+	if res.Ping > 0 {
+		s += ". The browser's HTTP ping adds " + ms(max(res.Ping-avg, 0)) + " of browser and HTTP overhead on top of the network"
+	}
+	return s + ".</p>\n"
+}
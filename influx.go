@@ -0,0 +1,107 @@
+//go:build !minimal && !noinflux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each finished result can go out as one line of InfluxDB line protocol,
+// the usual home of long-term speed monitoring: POSTed to a write URL
+// (v1 /write?db=... or v2 /api/v2/write?org=...&bucket=..., with
+// -influx-token for v2), appended to a file for Telegraf to tail, or both.
+var influx struct {
+	out  *sink
+	mu   sync.Mutex
+	file *os.File
+}
+
+func init() {
+	register(subsystem{
+		name: "influx",
+		flags: func() {
+			flag.StringVar(&settings.Influx, "influx", settings.Influx, "InfluxDB write URL to send each result to as line protocol")
+			flag.StringVar(&settings.InfluxToken, "influx-token", settings.InfluxToken, "API token for -influx (InfluxDB 2)")
+			flag.StringVar(&settings.InfluxFile, "influx-file", settings.InfluxFile, "append each result as line protocol to this file")
+		},
+		start: startInflux,
+		done:  influxDone,
+	})
+}
+
+func startInflux() {
+	if cfg().Influx != "" {
+		if u, err := url.Parse(cfg().Influx); err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+			degraded("-influx "+cfg().Influx+": not an http(s) URL", "Give the full write URL, e.g. http://localhost:8086/api/v2/write?org=home&bucket=blurr.")
+		} else {
+			influx.out = newSink("influx", sendInflux, nil)
+		}
+	}
+	if cfg().InfluxFile != "" {
+		f, err := os.OpenFile(cfg().InfluxFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			degraded("-influx-file: "+err.Error(), "Point it at a file Blurr may write, or drop -influx-file.")
+			return
+		}
+		influx.file = f
+	}
+}
+
+// lineProtocol renders res as measurement "blurr", tagged with the server
+// (and site), timestamped in nanoseconds.
+func lineProtocol(res *result) string {
+	tag := strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	s := "blurr,server=" + tag.Replace(cfg().Hostname)
+	if res.POP != "" {
+		s += ",pop=" + tag.Replace(res.POP)
+	}
+	s += " download_bps=" + f(res.Down) + ",upload_bps=" + f(res.Up) + ",ping_ms=" + f(res.Ping) + ",jitter_ms=" + f(res.Jitter) +
+		",streams=" + strconv.Itoa(res.Streams) + "i"
+	if res.LoadPing > 0 {
+		s += ",loaded_ping_ms=" + f(res.LoadPing)
+	}
+	return s + " " + strconv.FormatInt(res.Time.UnixNano(), 10) + "\n"
+}
+
+func influxDone(_ *http.Request, res *result) {
+	line := lineProtocol(res)
+	if influx.out != nil {
+		influx.out.post(line)
+	}
+	if influx.file != nil {
+		influx.mu.Lock()
+		_, err := influx.file.WriteString(line)
+		influx.mu.Unlock()
+		setHealth("influx-file", err)
+	}
+}
+
+func sendInflux(line string) error {
+	req, err := http.NewRequest(http.MethodPost, cfg().Influx, strings.NewReader(line))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if cfg().InfluxToken != "" {
+		req.Header.Set("Authorization", "Token "+cfg().InfluxToken)
+	}
+	c := http.Client{Timeout: 15 * time.Second}
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return errors.New(res.Status)
+	}
+	return nil
+}
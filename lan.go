@@ -0,0 +1,24 @@
+package main
+
+import "net"
+
+// lanIPs returns the private IPv4 addresses of the interfaces that are up.
+func lanIPs() []net.IP {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, i := range ifs {
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		as, _ := i.Addrs()
+		for _, a := range as {
+			if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil && n.IP.IsPrivate() {
+				ips = append(ips, n.IP)
+			}
+		}
+	}
+	return ips
+}
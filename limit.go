@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// refusals counts requests turned away by a limit or because the server
+// was busy, for the operator's daily digest.
+var refusals struct{ limited, busy atomic.Int64 }
+
+// A sliding limit allows each client IP max() hits per window. perIP
+// counts test starts over an hour: a test is counted when it starts, or
+// when its download starts if it has no session. Both key on limitIP.
+type sliding struct {
+	mu     sync.Mutex
+	hits   map[string][]time.Time
+	swept  time.Time
+	window time.Duration
+	max    func() int
+}
+
+var perIP = &sliding{hits: map[string][]time.Time{}, window: time.Hour, max: func() int { return cfg().TestsPerHour }}
+
+func (h *sliding) recent(ip string, now time.Time) []time.Time {
+	ts := h.hits[ip]
+	i := 0
+	for i < len(ts) && now.Sub(ts[i]) >= h.window {
+		i++
+	}
+	ts = ts[i:]
+	if len(ts) == 0 {
+		delete(h.hits, ip)
+		return nil
+	}
+	h.hits[ip] = ts
+	return ts
+}
+
+func (h *sliding) sweep(now time.Time) {
+	if now.Sub(h.swept) < min(h.window, 5*time.Minute) {
+		return
+	}
+	h.swept = now
+	for ip := range h.hits {
+		h.recent(ip, now)
+	}
+}
+
+// wait returns how long ip must wait before its next hit is allowed.
+func (h *sliding) wait(ip string) time.Duration {
+	n := h.max()
+	if n <= 0 {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	ts := h.recent(ip, now)
+	if len(ts) < n {
+		return 0
+	}
+	return ts[len(ts)-n].Add(h.window).Sub(now)
+}
+
+// allow records a hit for ip unless it is over its limit.
+func (h *sliding) allow(ip string) bool {
+	n := h.max()
+	if n <= 0 {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	h.sweep(now)
+	if len(h.recent(ip, now)) >= n {
+		refusals.limited.Add(1)
+		return false
+	}
+	h.hits[ip] = append(h.hits[ip], now)
+	return true
+}
+
+func tooMany(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(d.Seconds())+1))
+	http.Error(w, "too many tests", http.StatusTooManyRequests)
+}
+
+func cooldownPage(w http.ResponseWriter, r *http.Request, d time.Duration) {
+	b := brandFor(r)
+	mins := int(d.Minutes()) + 1
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Retry-After", strconv.Itoa(int(d.Seconds())+1))
+	w.WriteHeader(http.StatusTooManyRequests)
+	io.WriteString(w, `<!doctype html>
+<html><head><meta charset="utf-8"><title>`+b.name()+` (cooling down)</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Arial;max-width:760px;margin:1rem}</style>
+</head><body>
+<h2>`+b.heading(b.name())+`</h2>
+<p>You've run `+strconv.Itoa(cfg().TestsPerHour)+` tests in the last hour, which is as many as this instance allows per visitor.</p>
+<p>Take a short break — you can test again in about `+strconv.Itoa(mins)+` minute(s).</p>
+</body></html>`)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSliding(t *testing.T) {
+	n := 3
+	h := &sliding{hits: map[string][]time.Time{}, window: time.Hour, max: func() int { return n }}
+	for i := 0; i < n; i++ {
+		if !h.allow("a") {
+			t.Fatalf("hit %d refused", i+1)
+		}
+	}
+	if h.allow("a") {
+		t.Fatal("hit over the limit allowed")
+	}
+	if d := h.wait("a"); d <= 59*time.Minute || d > time.Hour {
+		t.Errorf("wait = %v, want just under an hour", d)
+	}
+	// another address has its own allowance
+	if !h.allow("b") || h.wait("b") != 0 {
+		t.Error("b refused for a's hits")
+	}
+	// once the oldest hit slides out of the window, one more is allowed
+	h.hits["a"][0] = time.Now().Add(-time.Hour - time.Second)
+	if h.wait("a") != 0 || !h.allow("a") || h.allow("a") {
+		t.Error("the window didn't slide by exactly one hit")
+	}
+	// n <= 0 is unlimited and records nothing
+	n = 0
+	for i := 0; i < 10; i++ {
+		if !h.allow("c") {
+			t.Fatal("unlimited refused")
+		}
+	}
+	if len(h.hits["c"]) != 0 || h.wait("a") != 0 {
+		t.Error("unlimited still counted")
+	}
+}
+
+func TestSlidingSweep(t *testing.T) {
+	h := &sliding{hits: map[string][]time.Time{}, window: time.Minute, max: func() int { return 1 }}
+	old := time.Now().Add(-2 * time.Minute)
+	for _, ip := range []string{"a", "b", "c"} {
+		h.hits[ip] = []time.Time{old}
+	}
+	h.allow("d")
+	if len(h.hits) != 1 {
+		t.Errorf("after a sweep %d addresses are kept, want 1", len(h.hits))
+	}
+}
@@ -0,0 +1,210 @@
+//go:build !minimal && !nofederation && !nolinks
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -link-every tests the link to each -peers server on a schedule, with the
+// same client the point-to-point test uses: a ping series, a download from
+// the peer and an upload to it. /links shows the latest runs per peer, for
+// keeping an eye on the links between sites; /metrics and -notify-below
+// pick them up too. The peer sees each run as a visitor's test, under its
+// own limits.
+const (
+	linkRuns  = 48
+	linkFirst = time.Minute
+)
+
+type linkRun struct {
+	Time   time.Time `json:"time"`
+	Ping   float64   `json:"ping_ms,omitempty"`
+	Jitter float64   `json:"jitter_ms,omitempty"`
+	Down   float64   `json:"download_bps,omitempty"` // peer to here
+	Up     float64   `json:"upload_bps,omitempty"`   // here to peer
+	Err    string    `json:"error,omitempty"`
+}
+
+var links struct {
+	sync.Mutex
+	runs map[string][]linkRun // by peer name, oldest first
+}
+
+// linkAlert is alertSlow when notifications are built in.
+var linkAlert = func(what string, down, ping float64) {}
+
+func init() {
+	register(subsystem{
+		name: "links",
+		flags: func() {
+			flag.DurationVar(&settings.LinkEvery, "link-every", settings.LinkEvery, "test the link to each -peers server this often, e.g. 1h (0 = never)")
+			flag.Var(&settings.LinkSize, "link-size", "bytes each scheduled link test moves each way (default 16M)")
+		},
+		start: startLinks,
+		routes: func(m *http.ServeMux) {
+			m.HandleFunc("/links", linksPage)
+			m.HandleFunc("/api/v1/links", linksJSON)
+		},
+		index:   linksFragment,
+		metrics: linksMetrics,
+	})
+}
+
+func startLinks() {
+	if cfg().LinkEvery <= 0 || len(fedList()) == 0 {
+		return
+	}
+	if cfg().LinkEvery < time.Minute {
+		degraded(fmt.Sprintf("-link-every %v: shorter than a minute", cfg().LinkEvery), "Test links at most once a minute; every test costs both servers bandwidth.")
+		tune(func(c *config) { c.LinkEvery = time.Minute })
+	}
+	links.runs = map[string][]linkRun{}
+	go func() {
+		time.Sleep(linkFirst)
+		for {
+			for _, p := range fedList() {
+				testLink(p)
+			}
+			time.Sleep(cfg().LinkEvery)
+		}
+	}()
+}
+
+func linkSize() int64 {
+	size := int64(16 << 20)
+	if cfg().LinkSize > 0 {
+		size = int64(cfg().LinkSize)
+	}
+	return min(size, maxDownload())
+}
+
+func testLink(p fedPeer) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	res, err := runClient(ctx, p.URL, linkSize())
+	run := linkRun{Time: time.Now()}
+	if err != nil {
+		run.Err = err.Error()
+		log.Printf("link test with %s failed: %v", p.Name, err)
+	} else {
+		run.Ping, run.Jitter, run.Down, run.Up = res.Ping, res.Jitter, res.Down, res.Up
+		budget.add(res.DownBytes + res.UpBytes)
+		log.Printf("link test with %s: ping=%.2fms down=%s up=%s", p.Name, res.Ping, mibps(res.Down), mibps(res.Up))
+		linkAlert("the link test with "+p.Name, res.Down, res.Ping)
+	}
+	setHealth("link "+p.Name, err)
+	links.Lock()
+	rs := append(links.runs[p.Name], run)
+	if len(rs) > linkRuns {
+		rs = rs[len(rs)-linkRuns:]
+	}
+	links.runs[p.Name] = rs
+	links.Unlock()
+}
+
+// linkHistory returns the peers in fedList order and a copy of their
+// runs, newest first.
+func linkHistory() ([]string, map[string][]linkRun) {
+	links.Lock()
+	defer links.Unlock()
+	var names []string
+	out := map[string][]linkRun{}
+	for _, p := range fedList() {
+		names = append(names, p.Name)
+		rs := links.runs[p.Name]
+		rev := make([]linkRun, len(rs))
+		for i, r := range rs {
+			rev[len(rs)-1-i] = r
+		}
+		out[p.Name] = rev
+	}
+	return names, out
+}
+
+func linksFragment(*http.Request) string {
+	if links.runs == nil {
+		return ""
+	}
+	return "<p><a href=\"/links\">Link tests</a> between this server and the others, every " + html.EscapeString(cfg().LinkEvery.String()) + ".</p>\n"
+}
+
+func linksPage(w http.ResponseWriter, r *http.Request) {
+	if links.runs == nil {
+		http.NotFound(w, r)
+		return
+	}
+	names, runs := linkHistory()
+	var b strings.Builder
+	for _, n := range names {
+		fmt.Fprintf(&b, "<h3>%s</h3>\n", html.EscapeString(n))
+		if len(runs[n]) == 0 {
+			b.WriteString("<p>Not tested yet.</p>\n")
+			continue
+		}
+		b.WriteString("<table>\n<tr><th>Time</th><th>Ping</th><th>Jitter</th><th>" + html.EscapeString(n) + " → here</th><th>Here → " + html.EscapeString(n) + "</th></tr>\n")
+		for _, run := range runs[n] {
+			t := run.Time.UTC().Format("2006-01-02 15:04")
+			if run.Err != "" {
+				fmt.Fprintf(&b, "<tr><td>%s</td><td colspan=4>failed: %s</td></tr>\n", t, html.EscapeString(run.Err))
+				continue
+			}
+			fmt.Fprintf(&b, "<tr><td>%s</td><td>%.1f ms</td><td>%.1f ms</td><td>%s</td><td>%s</td></tr>\n", t, run.Ping, run.Jitter, mibps(run.Down), mibps(run.Up))
+		}
+		b.WriteString("</table>\n")
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, `<!doctype html>
+<html><head><meta charset="utf-8"><title>Blurr (links)</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Arial;max-width:760px;margin:1rem}td,th{padding:0 1rem 0 0;text-align:left}</style>
+</head><body>
+<h2>Links from `+html.EscapeString(cfg().Hostname)+`</h2>
+<p>Tested every `+html.EscapeString(cfg().LinkEvery.String())+` with `+fmtBytes(linkSize())+` each way; times in UTC, newest first.</p>
+`+b.String()+`<p><a href="/">Back</a></p>
+</body></html>`)
+}
+
+func linksJSON(w http.ResponseWriter, r *http.Request) {
+	if links.runs == nil {
+		http.NotFound(w, r)
+		return
+	}
+	_, runs := linkHistory()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(runs)
+}
+
+func linksMetrics(w io.Writer) {
+	if links.runs == nil {
+		return
+	}
+	names, runs := linkHistory()
+	for _, m := range []struct {
+		name string
+		val  func(linkRun) float64
+	}{
+		{"blurr_link_ping_ms", func(r linkRun) float64 { return r.Ping }},
+		{"blurr_link_download_bytes_per_second", func(r linkRun) float64 { return r.Down }},
+		{"blurr_link_upload_bytes_per_second", func(r linkRun) float64 { return r.Up }},
+	} {
+		fmt.Fprintf(w, "# TYPE %s gauge\n", m.name)
+		for _, n := range names {
+			if rs := runs[n]; len(rs) > 0 && rs[0].Err == "" {
+				fmt.Fprintf(w, "%s{peer=%s} %g\n", m.name, strconv.Quote(n), m.val(rs[0]))
+			}
+		}
+	}
+}
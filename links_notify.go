@@ -0,0 +1,5 @@
+//go:build !minimal && !nofederation && !nolinks && !nonotify
+
+package main
+
+func init() { linkAlert = alertSlow }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Connections are accepted through connListener, which counts the bytes
+// each one moves and notes when it was accepted and when its first byte
+// arrived. The gap is the client's
+// side of setting up: near zero for a browser that sends its request right
+// after the handshake, large for preconnected or proxied connections. It's
+// a cross-check on the HTTP-level ping, from below HTTP.
+type connListener struct{ net.Listener }
+
+type conn struct {
+	net.Conn
+	id       uint64
+	accepted time.Time
+	first    atomic.Int64 // UnixNano of the first byte read
+	reported atomic.Bool
+	in, out  atomic.Int64
+	mark     atomic.Int64 // in at the end of the last request
+	served   atomic.Int64 // requests finished on it
+}
+
+type connKey struct{}
+
+var connSeq atomic.Uint64
+
+func (l connListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tuneConn(c)
+	return &conn{Conn: c, id: connSeq.Add(1), accepted: time.Now()}, nil
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.first.Load() == 0 {
+		c.first.CompareAndSwap(0, time.Now().UnixNano())
+	}
+	c.in.Add(int64(n))
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.Add(int64(n))
+	return n, err
+}
+
+// ReadFrom keeps io.Copy from a file to the socket a sendfile.
+func (c *conn) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{c.Conn}, r)
+	}
+	c.out.Add(n)
+	return n, err
+}
+
+// wire returns, counted at the socket with headers and framing, the bytes
+// read from r's connection since the request before it ended (r's own
+// headers and body, as far as they've arrived) and the bytes written to
+// it so far.
+func wire(r *http.Request) (in, out int64) {
+	if c := connOf(r); c != nil {
+		return c.in.Load() - c.mark.Load(), c.out.Load()
+	}
+	return 0, 0
+}
+
+// newServer is the HTTP server for every -addr; it serves each listener
+// through a connListener, and handlers find their connection with connOf.
+func newServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, r)
+			if c := connOf(r); c != nil {
+				c.mark.Store(c.in.Load())
+				c.served.Add(1)
+			}
+		}),
+		ConnContext:       func(ctx context.Context, c net.Conn) context.Context { return context.WithValue(ctx, connKey{}, c) },
+		ReadHeaderTimeout: cfg().ReadHeaderTimeout,
+		ReadTimeout:       cfg().RequestTimeout,
+		WriteTimeout:      cfg().RequestTimeout,
+		IdleTimeout:       cfg().IdleTimeout,
+	}
+}
+
+// holdOpen moves the connection's deadlines to d from now (or removes
+// them if d is 0), for the handlers that are meant to outlast
+// -request-timeout: the transfers themselves and anything waiting on one.
+func holdOpen(w http.ResponseWriter, d time.Duration) {
+	var t time.Time
+	if d > 0 {
+		t = time.Now().Add(d)
+	}
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(t)
+	rc.SetWriteDeadline(t)
+}
+
+func connOf(r *http.Request) *conn {
+	c, _ := r.Context().Value(connKey{}).(*conn)
+	return c
+}
+
+// connStat says which connection carried r and whether it had carried
+// other requests before (keep-alive) rather than being opened for this one.
+func connStat(r *http.Request) (id uint64, reused bool) {
+	if c := connOf(r); c != nil {
+		return c.id, c.served.Load() > 0
+	}
+	return 0, false
+}
+
+// noteConn records, once per connection, how long after being accepted
+// the connection carrying r sent its first byte.
+func (s *session) noteConn(r *http.Request) {
+	c := connOf(r)
+	if c == nil || c.first.Load() == 0 || c.reported.Swap(true) {
+		return
+	}
+	ms := float64(time.Duration(c.first.Load()-c.accepted.UnixNano()).Microseconds()) / 1000
+	s.update(func(res *result) {
+		if len(res.AcceptMs) < maxConns {
+			res.AcceptMs = append(res.AcceptMs, ms)
+		}
+	})
+}
+
+const maxConns = 64
@@ -0,0 +1,87 @@
+//go:build !minimal && !nolocal
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+func init() {
+	register(subsystem{
+		name: "local",
+		flags: func() {
+			flag.BoolVar(&settings.Local, "local", settings.Local, "ad-hoc LAN mode: listen on localhost and the LAN only, keep nothing, use the low-memory profile and print the LAN URL as a QR code")
+		},
+		start: startLocal,
+	})
+}
+
+func startLocal() {
+	if !cfg().Local {
+		return
+	}
+	_, port, err := net.SplitHostPort(strings.Split(cfg().Addr, ",")[0])
+	if err != nil || port == "" {
+		port = "8080"
+	}
+	addrs := []string{net.JoinHostPort("127.0.0.1", port)}
+	var urls []string
+	for _, ip := range lanIPs() {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		urls = append(urls, "http://"+net.JoinHostPort(ip.String(), port)+"/")
+	}
+	tune(func(c *config) {
+		c.Addr = strings.Join(addrs, ",")
+		// through the flag, so a reload applies the profile again
+		c.LowMem = true
+		profiles(c)
+	})
+	if len(urls) == 0 {
+		log.Println("local mode: no LAN address found, listening on localhost only")
+	} else {
+		fmt.Println("Open this on any device on the same network:")
+		for _, u := range urls {
+			fmt.Println("  " + u)
+		}
+		if c := qrEncode(urls[0]); c != nil {
+			fmt.Print(c)
+		}
+	}
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		openBrowser("http://" + addrs[0] + "/")
+	}()
+}
+
+// openBrowser makes a best effort at showing url on this device, including
+// Termux on Android. Failures are ignored: the URL has been printed anyway.
+func openBrowser(url string) {
+	var cmd *exec.Cmd
+	switch {
+	case hasCmd("termux-open-url"):
+		cmd = exec.Command("termux-open-url", url)
+	case runtime.GOOS == "darwin":
+		cmd = exec.Command("open", url)
+	case runtime.GOOS == "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	case hasCmd("xdg-open"):
+		cmd = exec.Command("xdg-open", url)
+	default:
+		return
+	}
+	if cmd.Start() == nil {
+		go cmd.Wait()
+	}
+}
+
+func hasCmd(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pages format numbers and times for the visitor's Accept-Language: a
+// decimal comma where that's the custom, the local order of day, month
+// and year, and a 12-hour clock for American English. Times are shown in
+// -timezone (UTC by default). A language that isn't listed, or none,
+// gets the plain ISO style the pages have always used.
+type locale struct {
+	comma bool   // decimal comma
+	h12   bool   // 12-hour clock
+	date  string // layout of a date
+}
+
+var locales = map[string]*locale{
+	"en-us": {h12: true, date: "Jan 2, 2006"},
+	"en-gb": {date: "2 Jan 2006"},
+	"de":    {comma: true, date: "02.01.2006"},
+	"fr":    {comma: true, date: "02/01/2006"},
+	"es":    {comma: true, date: "02/01/2006"},
+	"it":    {comma: true, date: "02/01/2006"},
+	"pt":    {comma: true, date: "02/01/2006"},
+	"nl":    {comma: true, date: "02-01-2006"},
+	"da":    {comma: true, date: "02.01.2006"},
+	"nb":    {comma: true, date: "02.01.2006"},
+	"fi":    {comma: true, date: "2.1.2006"},
+	"sv":    {comma: true, date: "2006-01-02"},
+	"pl":    {comma: true, date: "02.01.2006"},
+	"cs":    {comma: true, date: "2. 1. 2006"},
+	"ru":    {comma: true, date: "02.01.2006"},
+	"uk":    {comma: true, date: "02.01.2006"},
+	"tr":    {comma: true, date: "02.01.2006"},
+	"ja":    {date: "2006/01/02"},
+	"zh":    {date: "2006/01/02"},
+}
+
+// isoLocale is the style for anyone else.
+var isoLocale = &locale{date: "2006-01-02"}
+
+// pageLocale picks the locale for r from its Accept-Language, trying each
+// language in order of preference, the full tag before the bare language.
+func pageLocale(r *http.Request) *locale {
+	type pref struct {
+		tag string
+		q   float64
+	}
+	var prefs []pref
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		if tag != "" && q > 0 {
+			prefs = append(prefs, pref{strings.ToLower(tag), q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	for _, p := range prefs {
+		if l := locales[p.tag]; l != nil {
+			return l
+		}
+		lang, _, _ := strings.Cut(p.tag, "-")
+		if lang == "en" {
+			return isoLocale
+		}
+		if l := locales[lang]; l != nil {
+			return l
+		}
+	}
+	return isoLocale
+}
+
+func (l *locale) or() *locale {
+	if l == nil {
+		return isoLocale
+	}
+	return l
+}
+
+// dec puts the locale's decimal mark into a number formatted with a point.
+func (l *locale) dec(s string) string {
+	if l.or().comma {
+		return strings.Replace(s, ".", ",", 1)
+	}
+	return s
+}
+
+func (l *locale) num(v float64, prec int) string {
+	return l.dec(strconv.FormatFloat(v, 'f', prec, 64))
+}
+
+func (l *locale) speed(u unit, bps float64) string {
+	return l.num(u.num(bps), 2) + " " + u.label()
+}
+
+func (l *locale) day(t time.Time) string { return t.In(cfg().zone()).Format(l.or().date) }
+
+// when is a date and time of day, with the zone.
+func (l *locale) when(t time.Time) string {
+	clock := "15:04 MST"
+	if l.or().h12 {
+		clock = "3:04 PM MST"
+	}
+	return t.In(cfg().zone()).Format(l.or().date + " " + clock)
+}
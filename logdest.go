@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -log picks where the log goes: stderr as always, "json" for one JSON
+// object per line on stdout (for log shippers), "syslog" or "journald" for
+// the system's log, or a file Blurr rotates itself once it passes
+// -log-max-size or gets older than -log-max-age.
+func setupLog() {
+	var w io.Writer
+	var err error
+	stamped := false // the destination has its own timestamps
+	switch cfg().Log {
+	case "", "stderr":
+		return
+	case "json":
+		w, stamped = &jsonLog{w: os.Stdout}, true
+	case "syslog":
+		w, err = openSyslog()
+		stamped = true
+	case "journald":
+		w, err = openJournald()
+		stamped = true
+	default:
+		w, err = openRotating(cfg().Log)
+	}
+	if err != nil {
+		mustFix("-log "+cfg().Log+": "+err.Error(), "Use stderr, json, syslog, journald or the path of a file Blurr can write to.")
+		return
+	}
+	if stamped {
+		log.SetFlags(0)
+	}
+	log.SetOutput(w)
+}
+
+// logLevel guesses a level from how the message starts, for the
+// destinations that keep one.
+func logLevel(msg string) string {
+	switch {
+	case strings.HasPrefix(msg, "error:"):
+		return "error"
+	case strings.HasPrefix(msg, "optional:"), strings.Contains(msg, "failed"):
+		return "warning"
+	}
+	return "info"
+}
+
+type jsonLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (j *jsonLog) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	b, _ := json.Marshal(struct {
+		Time  string `json:"time"`
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+	}{time.Now().UTC().Format(time.RFC3339Nano), logLevel(msg), msg})
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.w.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// journald takes a datagram of FIELD=value lines per entry on its socket.
+type journald struct{ c net.Conn }
+
+func openJournald() (io.Writer, error) {
+	c, err := net.Dial("unixgram", "/run/systemd/journal/socket")
+	if err != nil {
+		return nil, err
+	}
+	return &journald{c}, nil
+}
+
+func (j *journald) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	prio := map[string]int{"error": 3, "warning": 4, "info": 6}[logLevel(msg)]
+	var b strings.Builder
+	fmt.Fprintf(&b, "PRIORITY=%d\nSYSLOG_IDENTIFIER=blurr\n", prio)
+	if strings.Contains(msg, "\n") {
+		// a multi-line value goes as its length, little-endian, then the bytes
+		n := uint64(len(msg))
+		b.WriteString("MESSAGE\n")
+		for i := 0; i < 8; i++ {
+			b.WriteByte(byte(n >> (8 * i)))
+		}
+		b.WriteString(msg + "\n")
+	} else {
+		b.WriteString("MESSAGE=" + msg + "\n")
+	}
+	if _, err := j.c.Write([]byte(b.String())); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// rotating is a log file that's moved aside, as name.2006-01-02T15-04-05.000,
+// once it's over -log-max-size or older than -log-max-age; only the last
+// -log-keep old files are kept.
+type rotating struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotating(path string) (io.Writer, error) {
+	if path == "" || strings.HasSuffix(path, "/") {
+		return nil, errors.New("not a file")
+	}
+	r := &rotating{path: path}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotating) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.opened = f, st.Size(), time.Now()
+	return nil
+}
+
+func (r *rotating) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && (cfg().LogMaxSize > 0 && r.size+int64(len(p)) > int64(cfg().LogMaxSize) || cfg().LogMaxAge > 0 && time.Since(r.opened) > cfg().LogMaxAge) {
+		if err := r.rotate(); err != nil {
+			// carry on in the old file rather than lose the line
+			fmt.Fprintf(os.Stderr, "log rotation: %v\n", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotating) rotate() error {
+	r.f.Close()
+	old := r.path + "." + time.Now().Format("2006-01-02T15-04-05.000")
+	if err := os.Rename(r.path, old); err != nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	if cfg().LogKeep > 0 {
+		olds, _ := filepath.Glob(r.path + ".????-??-??T??-??-??.???")
+		sort.Strings(olds)
+		for len(olds) > cfg().LogKeep {
+			os.Remove(olds[0])
+			olds = olds[1:]
+		}
+	}
+	return nil
+}
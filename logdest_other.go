@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func openSyslog() (io.Writer, error) { return nil, errors.New("no syslog on this system") }
@@ -0,0 +1,10 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+func openSyslog() (io.Writer, error) { return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "blurr") }
@@ -1,16 +1,27 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 )
 
-func getIP(r *http.Request) string {
+// getIP is the client's address as Blurr records it (see -anonymize);
+// clientAddr is the real one as the client tells it, for display only.
+// Anything that acts on the address, such as the limits, pings and
+// lookups, goes by testerAddr instead.
+func getIP(r *http.Request) string { return anonIP(clientAddr(r)) }
+
+func clientAddr(r *http.Request) string {
 	if x := r.Header.Get("X-Forwarded-For"); x != "" {
 		if i := strings.IndexByte(x, ','); i >= 0 {
 			return strings.TrimSpace(x[:i])
@@ -22,15 +33,37 @@ func getIP(r *http.Request) string {
 }
 
 func root(w http.ResponseWriter, r *http.Request) {
-	ip := getIP(r)
+	ip := limitIP(r)
+	if budget.exhausted() {
+		budgetPage(w, r)
+		return
+	}
+	if d := perIP.wait(limitIP(r)); d > 0 {
+		cooldownPage(w, r, d)
+		return
+	}
+	if n := q.pos(ip); n > 0 {
+		queuePage(w, r, n)
+		return
+	}
+	extra := ""
+	eachSubsystem(func(s subsystem) {
+		if s.index != nil {
+			extra += s.index(r)
+		}
+	})
+	if textUI(r) {
+		textIndex(w, r, extra)
+		return
+	}
+	u, b := speedUnit(w, r), brandFor(r)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	io.WriteString(w, `<!doctype html>
-<html><head><meta charset="utf-8"><title>Blurr (JS primary)</title>
+<html><head><meta charset="utf-8"><title>`+b.name()+` (JS primary)</title>
 <style>body{font-family:system-ui,Segoe UI,Roboto,Arial;max-width:760px;margin:1rem}</style>
 </head><body>
-<h2>Blurr</h2>
-<p>Host: `+ip+`</p>
-<div id=out>Click <button id=start>Start test</button> to run. JS required for automatic test; no-JS fallback links below.</div>
+<h2>`+b.heading(b.name())+`</h2>
+`+hostPara(ip)+`<div id=out>Click <button id=start>Start test</button> to run. JS required for automatic test; no-JS fallback links below.</div>
 
 <pre id=log style="background:#f6f6f6;padding:.5rem"></pre>
 
@@ -40,25 +73,63 @@ func root(w http.ResponseWriter, r *http.Request) {
   <p>Manual tests:</p>
   <ul>
     <li><a href="/download?size=8388608&nonce=manual">Download 8MiB</a> — click to fetch</li>
-    <li>Upload: POST a file to <code>/upload</code> with a form or curl</li>
+    <li><a href="/multi?streams=4">Multi-stream download</a> — four parallel 8MiB downloads, measured by the server</li>
+    <li>Upload: the multi-stream test ends with a one-click upload, or POST anything to <code>/upload</code> with curl</li>
     <li>Ping: use <code>curl -w "%{time_starttransfer}\\n" -o /dev/null /ping</code></li>
   </ul>
 </noscript>
 
 <script>
 const $ = id=>document.getElementById(id);
+let sid="";
+const unitPer=`+strconv.FormatFloat(units[u.or()].per, 'f', -1, 64)+`, unitName="`+u.label()+`";
+const speed=bps=>(bps/unitPer).toFixed(2)+" "+unitName;
+const streams=+new URLSearchParams(location.search).get("streams")||`+strconv.Itoa(defaultStreams(r))+`;
+const phases=`+phasesJSON()+`;
+const probeCount=`+strconv.Itoa(max(0, min(cfg().LossProbes, maxProbes)))+`;
+const warmSecs=`+strconv.FormatFloat(cfg().Warmup.d.Seconds(), 'f', -1, 64)+`, warmFrac=`+strconv.FormatFloat(cfg().Warmup.frac, 'f', -1, 64)+`;
+const duration=`+strconv.FormatFloat(min(cfg().Duration, maxDuration).Seconds(), 'f', -1, 64)+`;
+const targetSecs=`+strconv.FormatFloat(targetTime(r).Seconds(), 'f', -1, 64)+`, maxSize=`+strconv.FormatInt(maxDownload(), 10)+`;
+// fetch resolves once the headers are in, so timing it gives the time to
+// first byte
+const ttfb={probes:[], download:[]};
 function log(s){ $("log").textContent += s+"\n" }
-async function pingRuns(n=6){
+async function pingRuns(n, gap){
   const times=[];
   for(let i=0;i<n;i++){
     const t0=performance.now();
-    await fetch('/ping?nonce='+Date.now(),{cache:'no-store',headers:{"x-ts":"1"}});
+    await fetch('/ping?sid='+sid+'&nonce='+Date.now(),{cache:'no-store',headers:{"x-ts":"1"}});
     const t1=performance.now();
     times.push(t1-t0);
-    await new Promise(r=>setTimeout(r,80));
+    await new Promise(r=>setTimeout(r,gap));
   }
   return times;
 }
+// fires n tiny requests, 8 at a time, and counts those answered within the
+// deadline: a rough loss indicator, since a lost packet shows up as a
+// retransmit delay
+async function lossProbes(n, deadline){
+  let ok=0;
+  const one=async i=>{
+    const c=new AbortController(), t=setTimeout(()=>c.abort(), deadline), t0=performance.now();
+    try{
+      await fetch('/ping?sid='+sid+'&probe=1&nonce='+Date.now()+'-'+i,{cache:'no-store',signal:c.signal});
+      ttfb.probes.push(performance.now()-t0);
+      ok++;
+    }catch(e){}
+    clearTimeout(t);
+  };
+  for(let i=0;i<n;i+=8) await Promise.all([...Array(Math.min(8,n-i)).keys()].map(k=>one(i+k)));
+  return ok;
+}
+// how the page load's connection was set up, from Navigation Timing; all
+// zero when the browser reused an open connection
+function connTiming(){
+  const n=performance.getEntriesByType ? performance.getEntriesByType('navigation')[0] : null;
+  if(!n || !(n.connectEnd>n.connectStart)) return {};
+  const tls=n.secureConnectionStart>0 ? n.connectEnd-n.secureConnectionStart : 0;
+  return {tcp_ms:n.connectEnd-n.connectStart-tls, tls_ms:tls, http_ms:n.responseStart-n.requestStart};
+}
 function stats(arr){
   const sum=arr.reduce((a,b)=>a+b,0);
   const avg=sum/arr.length;
@@ -67,31 +138,88 @@ function stats(arr){
   sd = Math.sqrt(sd/arr.length);
   return {avg,sd};
 }
-async function downloadTest(size=8*1024*1024){
-  const url='/download?size='+size+'&nonce='+Date.now();
-  const res = await fetch(url,{cache:'no-store'});
-  if(!res.body) throw "no stream";
-  const reader = res.body.getReader();
-  let seen=0;
-  const t0=performance.now();
-  while(true){
-    const {done,value} = await reader.read();
-    if(done) break;
-    seen += value.byteLength;
+// times a transfer, leaving the -warmup part out of its speed
+function warmMeter(expect, dur){
+  const ms=warmSecs ? warmSecs*1000 : warmFrac*dur*1000, bytes=warmSecs||dur ? 0 : warmFrac*expect;
+  const m={t0:performance.now(), n:0, from:null, fromN:0};
+  if(!ms && !bytes) m.from=m.t0;
+  m.add=k=>{
+    m.n+=k;
+    const now=performance.now();
+    if(m.from===null && m.n>=bytes && now-m.t0>=ms){ m.from=now; m.fromN=m.n; }
+  };
+  m.done=()=>{
+    const end=performance.now(), all=m.from===null||m.fromN==m.n;
+    const from=all?m.t0:m.from, got=all?m.n:m.n-m.fromN;
+    return {bps:got/Math.max((end-from)/1000,1e-9), bytes:m.n, secs:(end-m.t0)/1000};
+  };
+  return m;
+}
+async function downloadTest(size=8*1024*1024, n=1, phase="", round=0, dur=0){
+  const base=phase ? phases.find(p=>p.name==phase).base||"" : "";
+  let m=null;
+  const one = async i=>{
+    const t0=performance.now();
+    const res = await fetch(base+'/download?sid='+sid+'&size='+size+(phase?'&phase='+encodeURIComponent(phase):'')+(round?'&round='+round:'')+(dur?'&duration='+dur+'s':'')+'&nonce='+Date.now()+'-'+i,{cache:'no-store'});
+    if(res.status==503||res.status==429) throw "busy";
+    if(!res.body) throw "no stream";
+    ttfb.download.push(performance.now()-t0);
+    if(!m) m=warmMeter(n*(+res.headers.get('content-length')||0), dur);
+    const reader = res.body.getReader();
+    while(true){
+      const {done,value} = await reader.read();
+      if(done) break;
+      m.add(value.byteLength);
+    }
+  };
+  const all = ()=>Promise.all([...Array(n).keys()].map(one)).then(()=>m.done());
+  return phase ? all() : underLoad(all);
+}
+// pings every 200 ms while run() fills the link, to measure bufferbloat
+async function underLoad(run){
+  const rtts=[];
+  let on=true;
+  const probes=(async()=>{
+    await new Promise(r=>setTimeout(r,200));
+    while(on){
+      const t0=performance.now();
+      await fetch('/ping?sid='+sid+'&load=1&nonce='+Date.now(),{cache:'no-store'});
+      if(on) rtts.push(performance.now()-t0);
+      await new Promise(r=>setTimeout(r,200));
+    }
+  })();
+  try{
+    const r=await run();
+    r.loaded=rtts;
+    return r;
+  }finally{
+    on=false;
+    await probes.catch(()=>{});
   }
-  const t1=performance.now();
-  const secs=(t1-t0)/1000;
-  return {bps: seen/secs, bytes:seen, secs};
+}
+// start small and grow until one round takes at least half the target time
+async function adaptiveDownload(n){
+  if(duration) return downloadTest(0, n, "", 0, duration);
+  if(!targetSecs) return downloadTest(8*1024*1024, n);
+  let size=64*1024, r;
+  for(let round=1; round<=5; round++){
+    r = await downloadTest(size, n, "", round);
+    if(r.secs >= targetSecs/2 || size >= maxSize) break;
+    size = Math.min(maxSize, Math.max(size*2, Math.round(r.bps*targetSecs/n)));
+  }
+  return r;
 }
 function uploadTest(size=8*1024*1024){
   return new Promise((resolve,reject)=>{
     const xhr=new XMLHttpRequest();
-    const url='/upload?nonce='+Date.now();
+    const url='/upload?sid='+sid+'&nonce='+Date.now();
     xhr.open('POST',url);
-    const start=performance.now();
+    const m=warmMeter(size, 0);
+    xhr.upload.onprogress = e=>m.add(e.loaded-m.n);
     xhr.onload = ()=>{
-      const secs = (performance.now()-start)/1000;
-      resolve({secs, bps: size/secs});
+      if(xhr.status==503) return reject("busy");
+      m.add(size-m.n);
+      resolve(m.done());
     };
     xhr.onerror = ()=>reject("upload error");
     // make buffer (small memory pressure for typical sizes)
@@ -103,90 +231,433 @@ function uploadTest(size=8*1024*1024){
 
 $("start").onclick = async ()=>{
   $("start").disabled = true;
-  log("Starting ping...");
   try{
-    const pings = await pingRuns();
+    const st = await fetch('/start'+location.search,{method:'POST'});
+    if(st.status==503||st.status==429) throw "busy";
+    const plan = await st.json();
+    sid = plan.id;
+    log("Starting ping...");
+    const pings = await pingRuns(plan.pings, plan.ping_gap_ms);
     const s = stats(pings);
     log("Ping avg (ms): "+s.avg.toFixed(2));
     log("Jitter (ms): "+s.sd.toFixed(2));
-    log("Starting download (streamed)...");
-    const d = await downloadTest();
-    log("Download: "+(d.bps/1024/1024).toFixed(2)+" MiB/s ("+d.bytes+" bytes in "+d.secs.toFixed(2)+"s)");
+    const probes={sent:probeCount, ok:0, deadline_ms:Math.round(Math.max(`+strconv.Itoa(probeFloor())+`, 4*s.avg))};
+    if(probes.sent){
+      log("Sending "+probes.sent+" small requests...");
+      probes.ok = await lossProbes(probes.sent, probes.deadline_ms);
+      log("Answered within "+probes.deadline_ms+" ms: "+probes.ok+" of "+probes.sent);
+    }
+    log("Starting download ("+(streams>1?streams+" parallel streams":"streamed")+")...");
+    const d = await adaptiveDownload(streams);
+    log("Download: "+speed(d.bps)+" ("+d.bytes+" bytes in "+d.secs.toFixed(2)+"s)");
+    if(d.loaded.length) log("Ping under load (ms): "+stats(d.loaded).avg.toFixed(2));
+    const ph={};
+    for(const p of phases){
+      log("Starting "+p.name+"...");
+      const r = await downloadTest(0, p.streams, p.name);
+      ph[p.name]=r.bps;
+      log(p.name+": "+speed(r.bps)+" ("+r.bytes+" bytes in "+r.secs.toFixed(2)+"s)");
+    }
     log("Starting upload (XHR)...");
     const u = await uploadTest();
-    log("Upload: "+(u.bps/1024/1024).toFixed(2)+" MiB/s ("+u.secs.toFixed(2)+"s)");
+    log("Upload: "+speed(u.bps)+" ("+u.secs.toFixed(2)+"s)");
+    await fetch('/done?sid='+sid,{method:'POST',body:JSON.stringify({pings,loaded:d.loaded,probes,conn:connTiming(),ttfb,down:d.bps,up:u.bps,phases:ph})});
     log("Done.");
+    location.href='/r/'+sid;
   }catch(e){
+    if(e=="busy"){
+      log("The server can't run a test right now, reloading...");
+      setTimeout(()=>location.reload(),1000);
+      return;
+    }
     log("Error: "+e);
   } finally {
     $("start").disabled = false;
   }
 };
 </script>
-<span>Donations are not needed. Instead, <a href="https://github.com/gigirassy/Blurr/">consider contributing to the CC0 code</a>.</span>
-</body></html>`)
+`+extra+b.about()+b.footer()+versionFooter()+`</body></html>`)
+}
+
+// multi is the no-JS multi-stream test: hidden iframes download in
+// parallel under one session and the server adds up what it sent.
+func multi(w http.ResponseWriter, r *http.Request) {
+	if s := getSession(r.URL.Query().Get("sid")); s != nil && textUI(r) {
+		s.noteFollowUp(time.Now())
+		textMulti(w, r, s)
+		return
+	}
+	if budget.exhausted() || q.pos(limitIP(r)) > 0 || perIP.wait(limitIP(r)) > 0 {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if !admit(w, r) {
+		return
+	}
+	s := newSession(r)
+	s.noJS = true
+	if textUI(r) {
+		textMulti(w, r, s)
+		return
+	}
+	id := s.res.ID
+	frames := ""
+	for i := 0; i < s.res.Streams; i++ {
+		frames += `<iframe hidden src="/download?sid=` + id + `&size=8388608&frame=1&nonce=` + strconv.Itoa(i) + `"></iframe>` + "\n"
+	}
+	// the upload rides in a hidden field, so there's no file to pick:
+	// the browser sends back what it was given and the server times it
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, `<!doctype html>
+<html><head><meta charset="utf-8"><meta http-equiv="refresh" content="`+strconv.Itoa(int(multiWait().Seconds()))+`;url=/r/`+id+`?auto=1"><title>`+brandFor(r).name()+` (multi-stream)</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Arial;max-width:760px;margin:1rem}</style>
+</head><body>
+<h2>`+brandFor(r).name()+`</h2>
+<p>Downloading over `+strconv.Itoa(s.res.Streams)+` parallel streams. When your browser stops loading this page, press Upload to measure the upload and see your result, or <a href="/r/`+id+`">skip the upload</a>; the result opens by itself after `+strconv.Itoa(int(multiWait().Seconds()))+` seconds.</p>
+<form method="post" action="/upload?sid=`+id+`&form=1"><input type="hidden" name="p" value="`+formFill()+`"><button>Upload</button></form>
+`+frames+`</body></html>`)
+}
+
+// multiWait is how long the no-JS test gives the downloads before its
+// page moves on to the result.
+func multiWait() time.Duration {
+	if cfg().Tor {
+		return 90 * time.Second
+	}
+	return 30 * time.Second
+}
+
+// formUpload is the size of the upload form's hidden field.
+func formUpload() int64 {
+	return max(0, min(int64(cfg().FormUpload), maxFormUpload, maxUpload()-int64(len("p="))))
+}
+
+func formFill() string {
+	n := int(formUpload())
+	return strings.Repeat("blurr0123456789abcdefghijklmnopq", n/32+1)[:n]
 }
 
 func ping(w http.ResponseWriter, r *http.Request) {
+	if s := getSession(r.URL.Query().Get("sid")); s != nil {
+		s.noteConn(r)
+		kind := "ping"
+		switch {
+		case r.URL.Query().Get("load") != "":
+			kind = "loaded-ping"
+		case r.URL.Query().Get("probe") != "":
+			kind = "probe"
+		}
+		s.recordPing(r, time.Now(), kind)
+	}
+	// no body and no content type: nothing for the browser to parse or
+	// render, so the ping is just the round trip
 	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte("1"))
+	if cfg().FreshConns {
+		// every ping pays for its own handshake, as a first visit would
+		w.Header().Set("Connection", "close")
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func download(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()
-	size, _ := strconv.Atoi(q.Get("size"))
+	ip := limitIP(r)
+	if budget.exhausted() || !q.take(ip) {
+		busy(w)
+		return
+	}
+	defer q.put(ip)
+	holdOpen(w, cfg().TransferTimeout)
+	s := getSession(r.URL.Query().Get("sid"))
+	if s == nil && !perIP.allow(limitIP(r)) {
+		tooMany(w, perIP.wait(limitIP(r)))
+		return
+	}
+	size, _ := strconv.Atoi(r.URL.Query().Get("size"))
 	if size <= 0 {
 		size = 8 * 1024 * 1024
 	}
+	if cfg().MaxSize > 0 && size > int(cfg().MaxSize) {
+		size = int(cfg().MaxSize)
+	}
+	dur, _ := time.ParseDuration(r.URL.Query().Get("duration"))
+	if dur > 0 {
+		// streamed until the time is up, so there's no length to announce
+		dur = min(dur, maxDuration)
+		size = math.MaxInt
+		if cfg().MaxSize > 0 {
+			size = int(cfg().MaxSize)
+		}
+	}
+	ph := findPhase(r.URL.Query().Get("phase"))
+	var rate bitRate
+	if ph != nil {
+		size, rate, dur = int(ph.Size), ph.Pacing, 0
+	}
 	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", strconv.Itoa(size))
-	chunk := make([]byte, 32*1024)
-	for i := range chunk {
-		chunk[i] = 'a'
-	}
-	bw := 0
-	start := time.Now()
+	// phases with a via address fetch from another origin
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.URL.Query().Get("frame") != "" {
+		// shown in a hidden iframe: plain text keeps browsers from saving it
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	p, off := payload(), payloadSeed(w, r)
+	var head, tail string
+	if s != nil && textUI(r) {
+		// the text UI's download is a page that links on to the upload
+		head, tail = textWrap(s.res.ID)
+		p = textPayload()
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	var m *meter
+	if dur <= 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(head)+size+len(tail)))
+		m = newMeter(int64(size), 0)
+	} else {
+		m = newMeter(0, dur)
+	}
+	m.conn, m.reused = connStat(r)
+	m.req = requestID(r)
+	acked0 := tcpInfo(r)
+	pace, _ := pacers(s)
+	until := m.start.Add(dur)
+	io.WriteString(w, head)
+	_, out0 := wire(r)
+	chunk := chunkSize()
+	bw, unflushed := 0, 0
 	fl, _ := w.(http.Flusher)
-	for bw < size {
-		to := size - bw
-		if to > len(chunk) {
-			to = len(chunk)
-		}
-		n, err := w.Write(chunk[:to])
+	if payloadPath != "" && dur <= 0 && rate <= 0 && pace == nil && head == "" {
+		// anything the file didn't send goes the usual way
+		bw, _ = sendPayload(w, off, size, m)
+		off = (off + bw) % len(p)
+	}
+	for bw < size && (dur <= 0 || time.Now().Before(until)) {
+		to := min(size-bw, chunk, len(p)-off)
+		n, err := w.Write(p[off : off+to])
+		off = (off + n) % len(p)
 		if err != nil {
 			break
 		}
 		bw += n
-		if fl != nil {
+		m.add(n)
+		budget.add(int64(n))
+		if unflushed += n; fl != nil && unflushed >= int(cfg().FlushEvery) {
 			fl.Flush()
+			unflushed = 0
+		}
+		pace.wait(n)
+		if rate > 0 {
+			time.Sleep(time.Until(m.start.Add(time.Duration(float64(bw) * 8 / float64(rate) * float64(time.Second)))))
 		}
 	}
-	elapsed := time.Since(start).Seconds()
-	if elapsed < 1e-9 {
-		elapsed = 1e-9
+	m.stop()
+	io.WriteString(w, tail)
+	if fl != nil {
+		fl.Flush()
+	}
+	if _, out := wire(r); out > out0 {
+		m.wire = out - out0
+	}
+	m.waitAcked(r, acked0, m.wire)
+	if m.tcp == nil {
+		m.tcp = tcpInfo(r)
+	}
+	tcp := ""
+	if t := m.tcp; t != nil {
+		tcp = fmt.Sprintf(" rtt=%.2fms retrans=%d/%d cwnd=%d", t.RTTMs, t.Retrans, t.SegsOut, t.Cwnd)
 	}
-	log.Printf("download done bytes=%d elapsed=%.3f bps=%.3fMiB/s\n", bw, elapsed, float64(bw)/1024.0/1024.0/elapsed)
+	if m.acked > 0 {
+		tcp += fmt.Sprintf(" acked=%d", m.acked)
+	}
+	if s != nil {
+		s.noteConn(r)
+		name := ""
+		if ph != nil {
+			name = ph.Name
+		}
+		round, _ := strconv.Atoi(r.URL.Query().Get("round"))
+		s.recordDown(name, round, m)
+	}
+	log.Printf("download done req=%s bytes=%d wire=%d elapsed=%.3f bps=%.3fMiB/s%s\n", m.req, bw, m.wire, m.end.Sub(m.start).Seconds(), m.bps()/1024.0/1024.0, tcp)
 }
 
 func upload(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	var n int64
-	n, _ = io.Copy(io.Discard, r.Body)
-	el := time.Since(start).Seconds()
-	if el < 1e-9 {
-		el = 1e-9
-	}
-	log.Printf("upload received bytes=%d elapsed=%.3f bps=%.3fMiB/s\n", n, el, float64(n)/1024.0/1024.0/el)
+	if s := getSession(r.URL.Query().Get("sid")); s != nil {
+		s.noteFollowUp(time.Now())
+	}
+	if receive(w, r) == nil {
+		return
+	}
+	if sid := r.URL.Query().Get("sid"); r.URL.Query().Get("form") != "" {
+		// the form upload is the last step of /multi and the text UI, with
+		// no script to post to /done
+		if s := getSession(sid); s != nil {
+			closeTest(r, s, &report{})
+			http.Redirect(w, r, "/r/"+sid+textQuery(r, "?"), http.StatusSeeOther)
+			return
+		}
+	}
 	w.Write([]byte("ok"))
 }
 
+// receive reads and times an upload body, recording it against the
+// session if there is one. It returns nil, having answered, when the
+// server is too busy to take it or the body is over -max-upload.
+func receive(w http.ResponseWriter, r *http.Request) *meter {
+	ip := limitIP(r)
+	if r.ContentLength > maxUpload() {
+		tooLarge(w, r)
+		return nil
+	}
+	if budget.exhausted() || !q.take(ip) {
+		busy(w)
+		return nil
+	}
+	defer q.done(ip)
+	defer q.put(ip)
+	holdOpen(w, cfg().TransferTimeout)
+	// the clock starts with the first body byte, not when the headers
+	// came in: a client waiting for 100 Continue, or one that's slow to
+	// start sending, would otherwise drag the speed down
+	m := newMeter(max(r.ContentLength, 0), 0)
+	m.atFirstByte = true
+	m.conn, m.reused = connStat(r)
+	m.req = requestID(r)
+	var body io.Reader = http.MaxBytesReader(w, r.Body, maxUpload())
+	s := getSession(r.URL.Query().Get("sid"))
+	if _, pace := pacers(s); pace != nil {
+		body = pacedReader{body, pace}
+	}
+	n, err := drain(io.TeeReader(body, m))
+	m.stop()
+	m.wire, _ = wire(r)
+	budget.add(n)
+	var mb *http.MaxBytesError
+	if errors.As(err, &mb) {
+		log.Printf("upload from %s cut off at %d bytes (over -max-upload) req=%s", ip, n, m.req)
+		tooLarge(w, r)
+		return nil
+	}
+	if s != nil {
+		s.noteConn(r)
+		s.recordUp(m)
+	}
+	log.Printf("upload received req=%s bytes=%d wire=%d elapsed=%.3f bps=%.3fMiB/s\n", m.req, n, m.wire, m.end.Sub(m.start).Seconds(), m.bps()/1024.0/1024.0)
+	return m
+}
+
+func tooLarge(w http.ResponseWriter, r *http.Request) {
+	b := brandFor(r)
+	msg := "Uploads to this server are limited to " + pageLocale(r).num(float64(maxUpload())/(1<<20), -1) + " MiB."
+	if r.URL.Query().Get("form") == "" {
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	io.WriteString(w, `<!doctype html>
+<html><head><meta charset="utf-8"><title>`+b.name()+` (upload too large)</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Arial;max-width:760px;margin:1rem}</style>
+</head><body>
+<h2>`+b.heading(b.name())+`</h2>
+<p>`+msg+` Nothing was recorded; <a href="/">run the test again</a>.</p>
+</body></html>`)
+}
+
+// apiUpload takes a raw body, as from curl -T, and answers with what it
+// measured, for scripts that have no browser to report back.
+func apiUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "PUT, POST")
+		http.Error(w, "PUT or POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	m := receive(w, r)
+	if m == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Bytes   int64   `json:"bytes"`
+		Wire    int64   `json:"wire_bytes"`
+		Seconds float64 `json:"seconds"`
+		Bps     float64 `json:"bps"`
+	}{m.n, m.wire, m.end.Sub(m.start).Seconds(), m.bps()})
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		for _, s := range subsystems {
+			if s.cmd != "" && s.cmd == os.Args[1] {
+				s.run(os.Args[2:])
+				return
+			}
+		}
+	}
+	runServer()
+}
+
+// runServer runs the server until it's stopped (see shutdown).
+func runServer() {
+	parseFlags()
 	http.HandleFunc("/", root)
 	http.HandleFunc("/ping", ping)
 	http.HandleFunc("/download", download)
 	http.HandleFunc("/upload", upload)
-	log.Println("listening :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	http.HandleFunc("/api/upload", apiUpload)
+	http.HandleFunc("/multi", multi)
+	http.HandleFunc("/start", startTest)
+	http.HandleFunc("/done", doneTest)
+	http.HandleFunc("/r/", resultPage)
+	http.HandleFunc("/api/v1/result/", resultJSON)
+	http.HandleFunc("/api/v1/payload-hash", payloadHash)
+	http.HandleFunc("/readyz", readyz)
+	http.HandleFunc("/version", versionJSON)
+	var names []string
+	eachSubsystem(func(s subsystem) {
+		names = append(names, s.name)
+		if s.routes != nil {
+			s.routes(http.DefaultServeMux)
+		}
+		if s.start != nil {
+			s.start()
+		}
+	})
+	h := http.Handler(http.DefaultServeMux)
+	eachSubsystem(func(s subsystem) {
+		if s.wrap != nil {
+			h = s.wrap(h)
+		}
+	})
+	h = access(h)
+	h = requestIDs(h)
+	var ls []net.Listener
+	for _, a := range strings.Split(cfg().Addr, ",") {
+		l, err := listen(a)
+		if err != nil {
+			mustFix(err.Error(), "Pick another -addr or stop whatever holds the port; ports below 1024 need root or CAP_NET_BIND_SERVICE.")
+			continue
+		}
+		ls = append(ls, l)
+	}
+	startRetention()
+	writePayloadFile()
+	checkProblems()
+	watchReload()
+	watchSignals()
+	log.Println("listening", cfg().Addr, "subsystems:", strings.Join(names, " "))
+	srv := newServer(h)
+	errc := make(chan error, len(ls))
+	for _, l := range ls {
+		go func(l net.Listener) { errc <- srv.Serve(connListener{l}) }(l)
+	}
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case <-stopping:
+		shutdown(srv)
+	}
 }
@@ -0,0 +1,41 @@
+//go:build !minimal && !nometrics
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+func init() {
+	register(subsystem{name: "metrics", routes: func(m *http.ServeMux) { m.HandleFunc("/metrics", metrics) }})
+}
+
+func metrics(w http.ResponseWriter, r *http.Request) {
+	active, waiting := q.stats()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# TYPE blurr_build_info gauge\nblurr_build_info{version=%s} 1\n", strconv.Quote(version))
+	fmt.Fprintf(w, "# TYPE blurr_active_tests gauge\nblurr_active_tests %d\n", active)
+	fmt.Fprintf(w, "# TYPE blurr_queue_length gauge\nblurr_queue_length %d\n", waiting)
+	fmt.Fprintf(w, "# TYPE blurr_traffic_today_bytes gauge\nblurr_traffic_today_bytes %d\n", budget.today())
+	if cfg().DailyBytes > 0 {
+		fmt.Fprintf(w, "# TYPE blurr_daily_budget_bytes gauge\nblurr_daily_budget_bytes %d\n", cfg().DailyBytes)
+	}
+	if names, cs := components(); len(cs) > 0 {
+		io.WriteString(w, "# TYPE blurr_component_up gauge\n")
+		for i, c := range cs {
+			up := 0
+			if c.ok {
+				up = 1
+			}
+			fmt.Fprintf(w, "blurr_component_up{component=%s} %d\n", strconv.Quote(names[i]), up)
+		}
+	}
+	eachSubsystem(func(s subsystem) {
+		if s.metrics != nil {
+			s.metrics(w)
+		}
+	})
+}
@@ -0,0 +1,191 @@
+//go:build !minimal && !nomqtt
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// -mqtt publishes each finished result to an MQTT broker as a retained
+// JSON state message on <topic>/<node>/state, and announces it to Home
+// Assistant with discovery messages under -mqtt-discovery, so download,
+// upload, ping and jitter appear as sensors by themselves. Each delivery
+// connects, publishes at QoS 0 and disconnects (MQTT 3.1.1); results are
+// rare enough that a standing connection isn't worth it.
+var mqttOut *sink
+
+func init() {
+	register(subsystem{
+		name: "mqtt",
+		flags: func() {
+			flag.StringVar(&settings.MQTT, "mqtt", settings.MQTT, "publish finished results to this broker, mqtt[s]://[user:pass@]host[:port]")
+			flag.StringVar(&settings.MQTTTopic, "mqtt-topic", settings.MQTTTopic, "topic prefix for -mqtt")
+			flag.StringVar(&settings.MQTTDiscovery, "mqtt-discovery", settings.MQTTDiscovery, "Home Assistant discovery prefix (\"\" to send no discovery messages)")
+		},
+		start: startMQTT,
+		done:  mqttDone,
+	})
+}
+
+func startMQTT() {
+	if cfg().MQTT == "" {
+		return
+	}
+	if u, err := url.Parse(cfg().MQTT); err != nil || u.Hostname() == "" || u.Scheme != "mqtt" && u.Scheme != "mqtts" {
+		degraded("-mqtt "+cfg().MQTT+": not a broker URL", "Give it as mqtt://[user:pass@]host[:port], or mqtts:// for TLS.")
+		return
+	}
+	mqttOut = newSink("mqtt", sendMQTT, nil)
+}
+
+// mqttNode is this server's name as MQTT topics and Home Assistant IDs
+// allow it.
+func mqttNode() string {
+	n := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, cfg().Hostname)
+	if n == "" {
+		n = "blurr"
+	}
+	return n
+}
+
+type mqttState struct {
+	Down   float64   `json:"download_mbps"`
+	Up     float64   `json:"upload_mbps"`
+	Ping   float64   `json:"ping_ms"`
+	Jitter float64   `json:"jitter_ms"`
+	Time   time.Time `json:"time"`
+	ID     string    `json:"id"`
+}
+
+func mqttDone(_ *http.Request, res *result) {
+	if mqttOut == nil {
+		return
+	}
+	b, _ := json.Marshal(mqttState{res.Down * 8 / 1e6, res.Up * 8 / 1e6, res.Ping, res.Jitter, res.Time, res.ID})
+	mqttOut.post(string(b))
+}
+
+// mqttMessages is what one delivery publishes: the discovery configs
+// (retained, so Home Assistant finds them after a restart) and the state.
+func mqttMessages(state string) [][2]string {
+	node := mqttNode()
+	stateTopic := strings.TrimSuffix(cfg().MQTTTopic, "/") + "/" + node + "/state"
+	var out [][2]string
+	if cfg().MQTTDiscovery != "" {
+		device := map[string]any{"identifiers": []string{"blurr_" + node}, "name": "Blurr " + cfg().Hostname, "manufacturer": "Blurr", "sw_version": version}
+		for _, s := range []struct{ key, name, unit, class string }{
+			{"download_mbps", "Download", "Mbit/s", "data_rate"},
+			{"upload_mbps", "Upload", "Mbit/s", "data_rate"},
+			{"ping_ms", "Ping", "ms", "duration"},
+			{"jitter_ms", "Jitter", "ms", "duration"},
+		} {
+			id := "blurr_" + node + "_" + s.key
+			b, _ := json.Marshal(map[string]any{
+				"name": s.name, "unique_id": id, "object_id": id,
+				"state_topic": stateTopic, "value_template": "{{ value_json." + s.key + " | round(2) }}",
+				"unit_of_measurement": s.unit, "device_class": s.class, "state_class": "measurement",
+				"device": device,
+			})
+			out = append(out, [2]string{strings.TrimSuffix(cfg().MQTTDiscovery, "/") + "/sensor/" + id + "/config", string(b)})
+		}
+	}
+	return append(out, [2]string{stateTopic, state})
+}
+
+func sendMQTT(state string) error {
+	u, _ := url.Parse(cfg().MQTT)
+	host := u.Host
+	if u.Port() == "" {
+		port := "1883"
+		if u.Scheme == "mqtts" {
+			port = "8883"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	d := net.Dialer{Timeout: 15 * time.Second}
+	var c net.Conn
+	var err error
+	if u.Scheme == "mqtts" {
+		c, err = tls.DialWithDialer(&d, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		c, err = d.Dial("tcp", host)
+	}
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+
+	// CONNECT: protocol "MQTT" level 4, clean session, 60s keep-alive
+	flags := byte(0x02)
+	body := mqttString(nil, "MQTT")
+	var pay []byte
+	pay = mqttString(pay, "blurr-"+mqttNode())
+	if name := u.User.Username(); name != "" {
+		flags |= 0x80
+		pay = mqttString(pay, name)
+		if pw, ok := u.User.Password(); ok {
+			flags |= 0x40
+			pay = mqttString(pay, pw)
+		}
+	}
+	body = append(body, 4, flags, 0, 60)
+	if _, err := c.Write(mqttPacket(0x10, append(body, pay...))); err != nil {
+		return err
+	}
+	var ack [4]byte
+	if _, err := io.ReadFull(c, ack[:]); err != nil {
+		return err
+	}
+	if ack[0] != 0x20 || ack[3] != 0 {
+		return fmt.Errorf("broker refused the connection (code %d)", ack[3])
+	}
+	for _, m := range mqttMessages(state) {
+		// PUBLISH, QoS 0, retained
+		if _, err := c.Write(mqttPacket(0x31, append(mqttString(nil, m[0]), m[1]...))); err != nil {
+			return err
+		}
+	}
+	_, err = c.Write([]byte{0xe0, 0})
+	return err
+}
+
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttPacket frames body with its type byte and variable-length size.
+func mqttPacket(typ byte, body []byte) []byte {
+	p := []byte{typ}
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		if n /= 128; n > 0 {
+			d |= 0x80
+		}
+		p = append(p, d)
+		if n == 0 {
+			break
+		}
+	}
+	return append(p, body...)
+}
@@ -0,0 +1,351 @@
+//go:build !minimal && !nondt7
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ndt7 is M-Lab's speed test protocol: a WebSocket per direction, the
+// sender streaming binary messages for ten seconds while the server
+// reports JSON measurements every 250 ms. Serving /ndt/v7/download and
+// /ndt/v7/upload lets the standard clients (ndt7-client-go with -server,
+// the M-Lab JavaScript client, ...) test against this server. See
+// https://github.com/m-lab/ndt-server/blob/main/spec/ndt7-protocol.md.
+const (
+	ndt7Proto    = "net.measurementlab.ndt.v7"
+	ndt7Duration = 10 * time.Second
+	ndt7Every    = 250 * time.Millisecond
+	ndt7MinMsg   = 1 << 13
+	ndt7MaxMsg   = 1 << 24
+)
+
+func init() {
+	register(subsystem{
+		name: "ndt7",
+		routes: func(m *http.ServeMux) {
+			m.HandleFunc("/ndt/v7/download", ndt7Download)
+			m.HandleFunc("/ndt/v7/upload", ndt7Upload)
+		},
+	})
+}
+
+type ndt7Measurement struct {
+	AppInfo struct {
+		ElapsedTime int64 // µs
+		NumBytes    int64
+	}
+	ConnectionInfo *ndt7Conn `json:",omitempty"`
+	Origin         string
+	Test           string
+	TCPInfo        *ndt7TCP `json:",omitempty"`
+}
+
+type ndt7Conn struct{ Client, Server, UUID string }
+
+// ndt7TCP is the part of TCP_INFO Blurr reads, under the names ndt7
+// clients expect (times in µs).
+type ndt7TCP struct {
+	ElapsedTime  int64
+	RTT          int64
+	RTTVar       int64
+	MinRTT       int64
+	SndCwnd      int
+	TotalRetrans int
+	DeliveryRate uint64
+}
+
+func ndt7Start(w http.ResponseWriter, r *http.Request) (*wsConn, string, bool) {
+	ip := limitIP(r)
+	if budget.exhausted() || !q.take(ip) {
+		busy(w)
+		return nil, ip, false
+	}
+	// a download and an upload make one test against -tests-per-hour
+	if r.URL.Path == "/ndt/v7/download" && !perIP.allow(limitIP(r)) {
+		q.put(ip)
+		tooMany(w, perIP.wait(limitIP(r)))
+		return nil, ip, false
+	}
+	ws, err := wsUpgrade(w, r, ndt7Proto)
+	if err != nil {
+		q.put(ip)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, ip, false
+	}
+	return ws, ip, true
+}
+
+func ndt7Download(w http.ResponseWriter, r *http.Request) {
+	ws, ip, ok := ndt7Start(w, r)
+	if !ok {
+		return
+	}
+	defer q.put(ip)
+	defer ws.c.Close()
+	// the client may send measurements of its own, and closes at the end
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		ws.discard()
+	}()
+	start := time.Now()
+	ws.c.SetWriteDeadline(start.Add(ndt7Duration + 5*time.Second))
+	p, off := payload(), 0
+	size, sent := int64(ndt7MinMsg), int64(0)
+	next := start
+	first := true
+	var err error
+	for time.Since(start) < ndt7Duration && err == nil {
+		select {
+		case <-closed:
+			err = io.EOF
+			continue
+		default:
+		}
+		if time.Now().After(next) {
+			err = ws.writeJSON(ndt7Report(r, ws, "download", start, sent, first))
+			first, next = false, next.Add(ndt7Every)
+			continue
+		}
+		err = ws.writeFrame(0x2, int(size), func(b []byte) {
+			for len(b) > 0 {
+				n := copy(b, p[off:])
+				off, b = (off+n)%len(p), b[n:]
+			}
+		})
+		sent += size
+		if size < ndt7MaxMsg && size < sent/16 {
+			size *= 2
+		}
+	}
+	budget.add(sent)
+	ws.close()
+	log.Printf("ndt7 download req=%s bytes=%d elapsed=%.3f bps=%.3fMiB/s", requestID(r), sent, time.Since(start).Seconds(), float64(sent)/time.Since(start).Seconds()/1024/1024)
+}
+
+func ndt7Upload(w http.ResponseWriter, r *http.Request) {
+	ws, ip, ok := ndt7Start(w, r)
+	if !ok {
+		return
+	}
+	defer q.done(ip)
+	defer q.put(ip)
+	defer ws.c.Close()
+	start := time.Now()
+	ws.c.SetReadDeadline(start.Add(ndt7Duration + 5*time.Second))
+	var mu sync.Mutex
+	var got int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			op, n, _, err := ws.readFrame(true)
+			if err != nil || op == 0x8 {
+				return
+			}
+			mu.Lock()
+			got += n
+			over := got > maxUpload()
+			mu.Unlock()
+			if over {
+				return
+			}
+		}
+	}()
+	t := time.NewTicker(ndt7Every)
+	defer t.Stop()
+	first := true
+	stop := time.After(ndt7Duration)
+loop:
+	for {
+		select {
+		case <-done:
+			break loop
+		case <-stop:
+			break loop
+		case <-t.C:
+			mu.Lock()
+			n := got
+			mu.Unlock()
+			if ws.writeJSON(ndt7Report(r, ws, "upload", start, n, first)) != nil {
+				break loop
+			}
+			first = false
+		}
+	}
+	ws.close()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+	}
+	mu.Lock()
+	n := got
+	mu.Unlock()
+	budget.add(n)
+	log.Printf("ndt7 upload req=%s bytes=%d elapsed=%.3f bps=%.3fMiB/s", requestID(r), n, time.Since(start).Seconds(), float64(n)/time.Since(start).Seconds()/1024/1024)
+}
+
+func ndt7Report(r *http.Request, ws *wsConn, test string, start time.Time, n int64, first bool) *ndt7Measurement {
+	m := &ndt7Measurement{Origin: "server", Test: test}
+	el := time.Since(start).Microseconds()
+	m.AppInfo.ElapsedTime, m.AppInfo.NumBytes = el, n
+	if first {
+		var id [16]byte
+		rand.Read(id[:])
+		m.ConnectionInfo = &ndt7Conn{Client: ws.c.RemoteAddr().String(), Server: ws.c.LocalAddr().String(), UUID: "blurr-" + hex.EncodeToString(id[:])}
+	}
+	if t := tcpInfo(r); t != nil {
+		us := func(ms float64) int64 { return int64(ms * 1000) }
+		m.TCPInfo = &ndt7TCP{ElapsedTime: el, RTT: us(t.RTTMs), RTTVar: us(t.RTTVarMs), MinRTT: us(t.MinRTTMs), SndCwnd: t.Cwnd, TotalRetrans: t.Retrans, DeliveryRate: uint64(t.DeliveryBps)}
+	}
+	return m
+}
+
+// wsConn is the server end of a WebSocket (RFC 6455), just enough of it
+// for ndt7: unfragmented messages out, anything in, no extensions.
+type wsConn struct {
+	c  net.Conn
+	br *bufio.Reader
+	mu sync.Mutex // writes
+}
+
+func wsUpgrade(w http.ResponseWriter, r *http.Request, proto string) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("this is a WebSocket endpoint")
+	}
+	offered := false
+	for _, p := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		offered = offered || strings.TrimSpace(p) == proto
+	}
+	if !offered {
+		return nil, errors.New("missing subprotocol " + proto)
+	}
+	c, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " +
+		base64.StdEncoding.EncodeToString(h[:]) + "\r\nSec-WebSocket-Protocol: " + proto + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &wsConn{c: c, br: brw.Reader}, nil
+}
+
+// writeFrame sends one final frame of n payload bytes, which fill writes
+// into the buffer it's given.
+func (ws *wsConn) writeFrame(op byte, n int, fill func([]byte)) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	h := []byte{0x80 | op}
+	switch {
+	case n < 126:
+		h = append(h, byte(n))
+	case n < 1<<16:
+		h = binary.BigEndian.AppendUint16(append(h, 126), uint16(n))
+	default:
+		h = binary.BigEndian.AppendUint64(append(h, 127), uint64(n))
+	}
+	if _, err := ws.c.Write(h); err != nil {
+		return err
+	}
+	bp := bufs.Get().(*[]byte)
+	defer bufs.Put(bp)
+	for n > 0 {
+		b := (*bp)[:min(n, len(*bp))]
+		fill(b)
+		if _, err := ws.c.Write(b); err != nil {
+			return err
+		}
+		n -= len(b)
+	}
+	return nil
+}
+
+func (ws *wsConn) writeMessage(op byte, p []byte) error {
+	return ws.writeFrame(op, len(p), func(b []byte) { p = p[copy(b, p):] })
+}
+
+func (ws *wsConn) writeJSON(v any) error {
+	b, _ := json.Marshal(v)
+	return ws.writeMessage(0x1, b)
+}
+
+// close sends a normal closure; the caller closes the connection once
+// the client has answered or given up.
+func (ws *wsConn) close() { ws.writeMessage(0x8, []byte{0x03, 0xe8}) }
+
+// readFrame reads one frame. Data frames are counted and, if discard
+// is set, dropped unread into memory; control frames (and data frames
+// otherwise) are unmasked and returned, up to 1 MiB. Pings are answered.
+func (ws *wsConn) readFrame(discard bool) (op byte, n int64, p []byte, err error) {
+	var h [2]byte
+	if _, err = io.ReadFull(ws.br, h[:]); err != nil {
+		return
+	}
+	op, n = h[0]&0x0f, int64(h[1]&0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		_, err = io.ReadFull(ws.br, b[:])
+		n = int64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		_, err = io.ReadFull(ws.br, b[:])
+		n = int64(binary.BigEndian.Uint64(b[:]) & (1<<63 - 1))
+	}
+	var mask [4]byte
+	if err == nil && h[1]&0x80 != 0 {
+		_, err = io.ReadFull(ws.br, mask[:])
+	}
+	if err != nil {
+		return
+	}
+	if discard && op < 0x8 {
+		_, err = io.CopyN(io.Discard, ws.br, n)
+		return
+	}
+	if n > 1<<20 {
+		return op, n, nil, errors.New("websocket frame too large")
+	}
+	p = make([]byte, n)
+	if _, err = io.ReadFull(ws.br, p); err != nil {
+		return
+	}
+	for i := range p {
+		p[i] ^= mask[i%4]
+	}
+	if op == 0x9 {
+		err = ws.writeMessage(0xa, p)
+	}
+	return
+}
+
+// discard reads and drops everything the client sends until it closes.
+func (ws *wsConn) discard() {
+	for {
+		op, _, _, err := ws.readFrame(true)
+		if err != nil || op == 0x8 {
+			return
+		}
+	}
+}
@@ -0,0 +1,108 @@
+//go:build !minimal && !nondt7
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// frameSink is a connection that only takes writes, for readFrame's
+// answers to pings.
+type frameSink struct {
+	net.Conn
+	out bytes.Buffer
+}
+
+func (s *frameSink) Write(p []byte) (int, error) { return s.out.Write(p) }
+
+// clientFrame is one final frame as a client sends it, masked.
+func clientFrame(op byte, p []byte) []byte {
+	b := []byte{0x80 | op}
+	switch n := len(p); {
+	case n < 126:
+		b = append(b, 0x80|byte(n))
+	case n < 1<<16:
+		b = binary.BigEndian.AppendUint16(append(b, 0x80|126), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint64(append(b, 0x80|127), uint64(n))
+	}
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, mask[:]...)
+	for i, c := range p {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+func wsReading(b []byte) (*wsConn, *frameSink) {
+	s := &frameSink{}
+	return &wsConn{c: s, br: bufio.NewReader(bytes.NewReader(b))}, s
+}
+
+func TestReadFrame(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 70000)
+	in := append(clientFrame(0x1, []byte(`{"hello":1}`)), clientFrame(0x9, []byte("ping"))...)
+	in = append(in, clientFrame(0x2, big)...)
+	in = append(in, clientFrame(0x8, []byte{0x03, 0xe8})...)
+	ws, sink := wsReading(in)
+	op, _, p, err := ws.readFrame(false)
+	if err != nil || op != 0x1 || string(p) != `{"hello":1}` {
+		t.Fatalf("text frame: %x %q %v", op, p, err)
+	}
+	op, _, p, err = ws.readFrame(false)
+	if err != nil || op != 0x9 || string(p) != "ping" {
+		t.Fatalf("ping: %x %q %v", op, p, err)
+	}
+	if want := []byte{0x8a, 4, 'p', 'i', 'n', 'g'}; !bytes.Equal(sink.out.Bytes(), want) {
+		t.Errorf("pong %x, want %x", sink.out.Bytes(), want)
+	}
+	// a data frame being discarded is counted, not kept
+	op, n, p, err := ws.readFrame(true)
+	if err != nil || op != 0x2 || n != int64(len(big)) || p != nil {
+		t.Fatalf("discarded frame: %x %d %d %v", op, n, len(p), err)
+	}
+	if op, _, _, err := ws.readFrame(true); err != nil || op != 0x8 {
+		t.Fatalf("close: %x %v", op, err)
+	}
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	// a header claiming 2 MiB; only data frames may be that big, and
+	// only when discarded
+	h := binary.BigEndian.AppendUint64([]byte{0x89, 127}, 2<<20)
+	ws, _ := wsReading(h)
+	if _, _, _, err := ws.readFrame(false); err == nil {
+		t.Error("took a 2 MiB control frame into memory")
+	}
+	// the top bit of a 64-bit length doesn't make it negative
+	h = binary.BigEndian.AppendUint64([]byte{0x82, 127}, 1<<63|5)
+	ws, _ = wsReading(append(h, "hello"...))
+	if _, n, _, err := ws.readFrame(true); n != 5 || err != nil {
+		t.Errorf("length with the top bit set: %d, %v", n, err)
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add(clientFrame(0x1, []byte(`{"hello":1}`)), false)
+	f.Add(clientFrame(0x9, []byte("ping")), false)
+	f.Add(clientFrame(0x2, bytes.Repeat([]byte("x"), 300)), true)
+	f.Add(clientFrame(0x8, []byte{0x03, 0xe8}), true)
+	f.Add([]byte{0x82, 127, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, false)
+	f.Add([]byte{0x82, 126, 0}, true)
+	f.Fuzz(func(t *testing.T, b []byte, discard bool) {
+		ws, _ := wsReading(b)
+		for i := 0; i < 64; i++ {
+			op, n, p, err := ws.readFrame(discard)
+			if err != nil {
+				return
+			}
+			if n < 0 || p != nil && int64(len(p)) != n || len(p) > 1<<20 {
+				t.Fatalf("op %x: length %d with %d bytes", op, n, len(p))
+			}
+		}
+	})
+}
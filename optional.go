@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// Optional subsystems live in files guarded by build tags and hook themselves
+// in from init, so "go build -tags minimal" leaves only the core test flow.
+// Each one can also be dropped on its own with its no<name> tag.
+type subsystem struct {
+	name    string
+	flags   func()
+	routes  func(*http.ServeMux)
+	start   func()
+	admin   func() string
+	index   func(*http.Request) string
+	result  func(*result) string
+	done    func(*http.Request, *result)
+	begin   func(*session)
+	wrap    func(http.Handler) http.Handler
+	metrics func(io.Writer)
+	// reload runs after a reload (SIGHUP or /admin/reload) has published
+	// the new config.
+	reload func()
+	// purge drops the results keep rejects from wherever the subsystem
+	// holds them and returns their IDs.
+	purge func(keep func(*result) bool) []string
+	// cmd names a subcommand ("blurr <cmd> ...") that run handles instead
+	// of starting the server.
+	cmd string
+	run func(args []string)
+}
+
+var subsystems []subsystem
+
+func register(s subsystem) { subsystems = append(subsystems, s) }
+
+func eachSubsystem(f func(subsystem)) {
+	for _, s := range subsystems {
+		f(s)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// With -pace the server holds every test to a set rate in each direction,
+// as a simulated link: the UI can be shown off, a client checked against a
+// known answer, or the instance offered as a reference endpoint. The
+// streams of one test share the rate, as they would share a real link of
+// that speed; a transfer without a session gets it to itself.
+type pacer struct {
+	mu   sync.Mutex
+	rate bitRate
+	next time.Time
+}
+
+func newPacer(rate bitRate) *pacer {
+	if rate <= 0 {
+		return nil
+	}
+	return &pacer{rate: rate}
+}
+
+// wait books n bytes on the pacer's clock and sleeps until they're due.
+// An idle pacer starts again from now, so it never saves up a burst.
+func (p *pacer) wait(n int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	p.next = p.next.Add(time.Duration(float64(n) * 8 / float64(p.rate) * float64(time.Second)))
+	t := p.next
+	p.mu.Unlock()
+	time.Sleep(time.Until(t))
+}
+
+// pacers are the download and upload pacers for a transfer in s, which
+// may be nil.
+func pacers(s *session) (down, up *pacer) {
+	if s != nil {
+		return s.paceDown, s.paceUp
+	}
+	return newPacer(cfg().Pace), newPacer(cfg().Pace)
+}
+
+type pacedReader struct {
+	r io.Reader
+	p *pacer
+}
+
+func (r pacedReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.wait(n)
+	return n, err
+}
+
+func pacedNote(res *result) string {
+	if res.Paced <= 0 {
+		return ""
+	}
+	return " · paced to " + res.loc.num(float64(res.Paced)/1e6, -1) + " Mbit/s"
+}
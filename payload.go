@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// The download payload is a block of random bytes generated once at start
+// and streamed round-robin from a random offset per request. It's larger
+// than the windows deflate and brotli use by default, so transparent
+// proxies and modem compression can't shrink it and inflate the result.
+var (
+	payloadOnce  sync.Once
+	payloadBlock []byte
+)
+
+func payload() []byte {
+	payloadOnce.Do(func() {
+		n := 8 << 20
+		if cfg().LowMem {
+			n = 1 << 20
+		}
+		payloadBlock = make([]byte, n)
+		if _, err := rand.Read(payloadBlock); err != nil {
+			panic(err)
+		}
+	})
+	return payloadBlock
+}
+
+func payloadStart() int {
+	var b [8]byte
+	rand.Read(b[:])
+	return int(binary.LittleEndian.Uint64(b[:]) % uint64(len(payload())))
+}
+
+// payloadSeed picks where a response starts in the block: the ?seed= the
+// client asked for, or a random offset. It's announced as X-Payload-Seed
+// so a client can check what it received against /api/v1/payload-hash.
+func payloadSeed(w http.ResponseWriter, r *http.Request) int {
+	off, err := strconv.Atoi(r.URL.Query().Get("seed"))
+	if err != nil || off < 0 || off >= len(payload()) {
+		off = payloadStart()
+	}
+	w.Header().Set("X-Payload-Seed", strconv.Itoa(off))
+	return off
+}
+
+const maxHashLen = 64 << 20
+
+// payloadHash returns the SHA-256 of len bytes at offset into the stream
+// a response with that seed carries, so a client holding a partial or
+// damaged transfer can narrow down where it went wrong. The block is
+// random per process: hashes only hold until the server restarts.
+func payloadHash(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	seed, err1 := strconv.Atoi(v.Get("seed"))
+	off, err2 := strconv.ParseInt(v.Get("offset"), 10, 64)
+	n, err3 := strconv.ParseInt(v.Get("len"), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || seed < 0 || seed >= len(payload()) || off < 0 || n <= 0 || n > maxHashLen {
+		http.Error(w, "need seed (0-"+strconv.Itoa(len(payload())-1)+"), offset >= 0 and len (1-"+strconv.Itoa(maxHashLen)+")", http.StatusBadRequest)
+		return
+	}
+	h := sha256.New()
+	io.Copy(h, io.LimitReader(&payloadReader{off: int((int64(seed) + off) % int64(len(payload())))}, n))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"seed": seed, "offset": off, "len": n, "sha256": hex.EncodeToString(h.Sum(nil))})
+}
+
+// bufs holds bufSize() scratch buffers for reading request bodies, so busy
+// instances don't allocate one per upload.
+var bufs = sync.Pool{New: func() any {
+	b := make([]byte, bufSize())
+	return &b
+}}
+
+// drain reads r to EOF into a pooled buffer and returns the byte count.
+func drain(r io.Reader) (int64, error) {
+	bp := bufs.Get().(*[]byte)
+	defer bufs.Put(bp)
+	var n int64
+	for {
+		m, err := r.Read(*bp)
+		n += int64(m)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// With -payload-file the block is also written out, twice over so any
+// offset has a whole block after it, and sized downloads are sent from the
+// file with io.Copy. On Linux that reaches the socket as sendfile, without
+// copying each chunk through userspace or flushing after it, which is what
+// limits multi-gigabit tests. Each request opens the file for its own
+// offset. The timed, paced and text downloads still use the write loop.
+const sendStep = 1 << 20
+
+var payloadPath string
+
+func writePayloadFile() {
+	if cfg().PayloadFile == "" {
+		return
+	}
+	p := payload()
+	err := os.WriteFile(cfg().PayloadFile, append(append(make([]byte, 0, 2*len(p)), p...), p...), 0o600)
+	if err != nil {
+		degraded("-payload-file "+cfg().PayloadFile+": "+err.Error(), "Give a path Blurr can write "+fmtBytes(int64(2*len(p)))+" to, ideally on tmpfs or an SSD.")
+		return
+	}
+	payloadPath = cfg().PayloadFile
+}
+
+// sendPayload sends size bytes of the stream starting at off from the
+// payload file, in sendStep pieces so the meter keeps its samples.
+func sendPayload(w io.Writer, off, size int, m *meter) (int, error) {
+	f, err := os.Open(payloadPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sent := 0
+	for sent < size {
+		if _, err := f.Seek(int64(off), io.SeekStart); err != nil {
+			return sent, err
+		}
+		n, err := io.Copy(w, io.LimitReader(f, int64(min(size-sent, sendStep, len(payload())))))
+		sent += int(n)
+		m.add(int(n))
+		budget.add(n)
+		off = (off + int(n)) % len(payload())
+		if err != nil {
+			return sent, err
+		}
+		if n == 0 {
+			return sent, io.ErrUnexpectedEOF
+		}
+	}
+	return sent, nil
+}
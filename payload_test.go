@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// What the download and upload loops allocate under the default and the
+// -lowmem buffer sizes: -lowmem trades big buffers for more, smaller
+// writes, and "go test -bench . -run X" shows what that costs per request.
+
+const benchSize = 1 << 20
+
+// discard is a ResponseWriter that throws the body away, so the benchmark
+// counts the handler's allocations and not a recorder's growing buffer.
+type discard struct{ h http.Header }
+
+func (d *discard) Header() http.Header         { return d.h }
+func (d *discard) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discard) WriteHeader(int)             {}
+
+// benchProfile sets up the profile under test, with the buffer pool and
+// the payload block built afresh for it: each is sized by -lowmem the
+// first time it's used.
+func benchProfile(b *testing.B, lowmem bool) {
+	withConfig(b, func(c *config) { c.LowMem = lowmem })
+	resetBuffers()
+	want := 8 << 20
+	if lowmem {
+		want = 1 << 20
+	}
+	if n := len(payload()); n != want {
+		b.Fatalf("payload block is %d bytes, want %d", n, want)
+	}
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() {
+		resetBuffers()
+		log.SetOutput(out)
+	})
+}
+
+func resetBuffers() {
+	bufs = sync.Pool{New: bufs.New}
+	payloadOnce, payloadBlock = sync.Once{}, nil
+}
+
+func benchDownload(b *testing.B, lowmem bool) {
+	benchProfile(b, lowmem)
+	r := httptest.NewRequest("GET", "/download?size="+strconv.Itoa(benchSize), nil)
+	b.SetBytes(benchSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		download(&discard{h: http.Header{}}, r)
+	}
+}
+
+func benchUpload(b *testing.B, lowmem bool) {
+	benchProfile(b, lowmem)
+	body := make([]byte, benchSize)
+	b.SetBytes(benchSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		upload(&discard{h: http.Header{}}, r)
+	}
+}
+
+func BenchmarkDownload(b *testing.B)       { benchDownload(b, false) }
+func BenchmarkDownloadLowMem(b *testing.B) { benchDownload(b, true) }
+func BenchmarkUpload(b *testing.B)         { benchUpload(b, false) }
+func BenchmarkUploadLowMem(b *testing.B)   { benchUpload(b, true) }
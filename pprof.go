@@ -0,0 +1,66 @@
+//go:build !minimal && !noadmin && !nopprof
+
+package main
+
+import (
+	"expvar"
+	"flag"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// -enable-pprof mounts net/http/pprof and expvar under /admin/debug/, for
+// profiling a server whose throughput looks CPU-bound. Both can stall the
+// process (a CPU profile, a trace) or say a lot about it, so unlike the
+// rest of /admin they're never served without admin credentials set up
+// (adminWrap checks them). Importing them also registers
+// /debug/pprof/ and /debug/vars on the default mux, which stay refused.
+func init() {
+	register(subsystem{
+		name: "pprof",
+		flags: func() {
+			flag.BoolVar(&settings.Pprof, "enable-pprof", settings.Pprof, "serve net/http/pprof and expvar under /admin/debug/ (needs -admin-token or -admin-user)")
+		},
+		routes: pprofRoutes,
+		wrap:   pprofWrap,
+	})
+}
+
+func pprofRoutes(m *http.ServeMux) {
+	if !cfg().Pprof {
+		return
+	}
+	if !adminLocked() {
+		mustFix("-enable-pprof without admin credentials", "Set -admin-token or -admin-user and -admin-password; the profiles are never served without them.")
+		return
+	}
+	// pprof.Index finds the profile by its /debug/pprof/ path
+	strip := func(h http.Handler) http.HandlerFunc {
+		return pprofHold(http.StripPrefix("/admin", h).ServeHTTP)
+	}
+	m.HandleFunc("/admin/debug/pprof/", strip(http.HandlerFunc(pprof.Index)))
+	m.HandleFunc("/admin/debug/pprof/cmdline", pprofHold(pprof.Cmdline))
+	m.HandleFunc("/admin/debug/pprof/profile", pprofHold(pprof.Profile))
+	m.HandleFunc("/admin/debug/pprof/symbol", pprofHold(pprof.Symbol))
+	m.HandleFunc("/admin/debug/pprof/trace", pprofHold(pprof.Trace))
+	m.HandleFunc("/admin/debug/vars", pprofHold(expvar.Handler().ServeHTTP))
+}
+
+// pprofHold lets a profile or trace run for its ?seconds=.
+func pprofHold(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		holdOpen(w, cfg().TransferTimeout)
+		h(w, r)
+	}
+}
+
+func pprofWrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debug/pprof") || r.URL.Path == "/debug/vars" {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"html"
+	"net"
+)
+
+// -anonymize keeps client addresses out of everything Blurr records:
+// results, logs, the admin pages and exports all see the truncated or
+// hashed form, and the pages show no client host at all. Rate limits and
+// the queue key on the same form, so "hash" keeps them per address and
+// "truncate" makes them per /24 (IPv4) or /48 (IPv6). Lookups that need
+// the real address (ASN, ICMP pings, captures) get it from the session,
+// which only lives in memory; reverse DNS, which would put a name on the
+// page, is turned off.
+var anonKey = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// anonIP is ip as -anonymize wants it recorded. Hashes are keyed per
+// process, so they can't be matched up across restarts or servers.
+func anonIP(ip string) string {
+	switch cfg().Anonymize {
+	case "truncate":
+		a := net.ParseIP(ip)
+		if a == nil {
+			return ""
+		}
+		if v4 := a.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return a.Mask(net.CIDRMask(48, 128)).String()
+	case "hash":
+		m := hmac.New(sha256.New, anonKey)
+		m.Write([]byte(ip))
+		return "anon-" + hex.EncodeToString(m.Sum(nil)[:6])
+	}
+	return ip
+}
+
+// hostNote is "Host: <ip>" followed by sep for the top of a page, or ""
+// when client addresses aren't shown.
+func hostNote(ip, sep string) string {
+	switch {
+	case cfg().Anonymize != "":
+		return ""
+	case cfg().Tor:
+		ip = "hidden (onion service)"
+	}
+	return "Host: " + html.EscapeString(ip) + sep
+}
+
+func hostPara(ip string) string {
+	if n := hostNote(ip, ""); n != "" {
+		return "<p>" + n + "</p>\n"
+	}
+	return ""
+}
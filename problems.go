@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// Startup problems are collected instead of ending the process at the
+// first one, so an operator fixing a config sees everything that's wrong
+// at once, each with what to do about it. An optional problem only costs
+// a feature; with -ignore-optional-failures the server starts without it.
+type problem struct {
+	what, fix string
+	optional  bool
+}
+
+var problems []problem
+
+// mustFix notes a problem the server can't run with.
+func mustFix(what, fix string) { problems = append(problems, problem{what, fix, false}) }
+
+// degraded notes a problem that turns a feature off.
+func degraded(what, fix string) { problems = append(problems, problem{what, fix, true}) }
+
+// checkProblems logs every problem found so far and exits unless they are
+// all optional and -ignore-optional-failures is set.
+func checkProblems() {
+	if len(problems) == 0 {
+		return
+	}
+	required := 0
+	for _, p := range problems {
+		kind := "error"
+		if p.optional {
+			kind = "optional"
+		} else {
+			required++
+		}
+		log.Printf("%s: %s\n\t%s", kind, p.what, p.fix)
+	}
+	switch {
+	case required > 0:
+		log.Printf("%d startup problem(s), %d of them blocking", len(problems), required)
+		os.Exit(1)
+	case !cfg().IgnoreOptional:
+		log.Printf("%d startup problem(s); fix them, or start with -ignore-optional-failures to run without the features they affect", len(problems))
+		os.Exit(1)
+	}
+	log.Printf("starting degraded: %d optional feature(s) off", len(problems))
+	problems = nil
+}
@@ -0,0 +1,328 @@
+//go:build !minimal && !nolocal
+
+package main
+
+import "strings"
+
+// A tiny QR encoder, just enough to put the local-mode URL on a terminal:
+// byte mode, error correction level L, versions 1-5 (single RS block, up to
+// 106 bytes).
+var qrDataCodewords = [...]int{0, 19, 34, 55, 80, 108}
+var qrECCodewords = [...]int{0, 7, 10, 15, 20, 26}
+
+type qrCode struct {
+	size int
+	mod  [][]bool
+	fn   [][]bool
+}
+
+func qrEncode(s string) *qrCode {
+	ver := 0
+	for v := 1; v < len(qrDataCodewords); v++ {
+		if len(s) <= (qrDataCodewords[v]*8-12)/8 {
+			ver = v
+			break
+		}
+	}
+	if ver == 0 {
+		return nil
+	}
+	n := qrDataCodewords[ver]
+	var bits []bool
+	put := func(v, w int) {
+		for i := w - 1; i >= 0; i-- {
+			bits = append(bits, v>>i&1 == 1)
+		}
+	}
+	put(4, 4)
+	put(len(s), 8)
+	for i := 0; i < len(s); i++ {
+		put(int(s[i]), 8)
+	}
+	for i := 0; i < 4 && len(bits) < n*8; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	data := make([]byte, 0, n+qrECCodewords[ver])
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << (7 - j)
+			}
+		}
+		data = append(data, b)
+	}
+	for pad := byte(0xEC); len(data) < n; pad ^= 0xEC ^ 0x11 {
+		data = append(data, pad)
+	}
+	data = append(data, rsRemainder(data, qrECCodewords[ver])...)
+
+	q := &qrCode{size: 17 + 4*ver}
+	q.mod = make([][]bool, q.size)
+	q.fn = make([][]bool, q.size)
+	for i := range q.mod {
+		q.mod[i] = make([]bool, q.size)
+		q.fn[i] = make([]bool, q.size)
+	}
+	q.functionPatterns(ver)
+	q.codewords(data)
+	best, bestPen := 0, -1
+	for m := 0; m < 8; m++ {
+		q.mask(m)
+		q.format(m)
+		if p := q.penalty(); bestPen < 0 || p < bestPen {
+			best, bestPen = m, p
+		}
+		q.mask(m)
+	}
+	q.mask(best)
+	q.format(best)
+	return q
+}
+
+func (q *qrCode) set(x, y int, dark bool) {
+	q.mod[y][x] = dark
+	q.fn[y][x] = true
+}
+
+func (q *qrCode) functionPatterns(ver int) {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	finder := func(cx, cy int) {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := cx+dx, cy+dy
+				if x < 0 || y < 0 || x >= q.size || y >= q.size {
+					continue
+				}
+				d := max(abs(dx), abs(dy))
+				q.set(x, y, d != 2 && d != 4)
+			}
+		}
+	}
+	finder(3, 3)
+	finder(q.size-4, 3)
+	finder(3, q.size-4)
+	if ver > 1 {
+		c := q.size - 7
+		for dy := -2; dy <= 2; dy++ {
+			for dx := -2; dx <= 2; dx++ {
+				q.set(c+dx, c+dy, max(abs(dx), abs(dy)) != 1)
+			}
+		}
+	}
+	q.format(0)
+}
+
+func (q *qrCode) format(mask int) {
+	data := 1<<3 | mask // level L
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+func (q *qrCode) codewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.fn[y][x] && i < len(data)*8 {
+					q.mod[y][x] = data[i>>3]>>(7-i&7)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *qrCode) mask(m int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var inv bool
+			switch m {
+			case 0:
+				inv = (x+y)%2 == 0
+			case 1:
+				inv = y%2 == 0
+			case 2:
+				inv = x%3 == 0
+			case 3:
+				inv = (x+y)%3 == 0
+			case 4:
+				inv = (x/3+y/2)%2 == 0
+			case 5:
+				inv = x*y%2+x*y%3 == 0
+			case 6:
+				inv = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				inv = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if inv && !q.fn[y][x] {
+				q.mod[y][x] = !q.mod[y][x]
+			}
+		}
+	}
+}
+
+func (q *qrCode) penalty() int {
+	p, dark := 0, 0
+	at := func(x, y int, col bool) bool {
+		if col {
+			return q.mod[x][y]
+		}
+		return q.mod[y][x]
+	}
+	finderLike := [][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+	for _, col := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			run := 1
+			for x := 1; x <= q.size; x++ {
+				if x < q.size && at(x, y, col) == at(x-1, y, col) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					p += run - 2
+				}
+				run = 1
+			}
+			for x := 0; x+11 <= q.size; x++ {
+				for _, pat := range finderLike {
+					ok := true
+					for k, v := range pat {
+						if at(x+k, y, col) != v {
+							ok = false
+							break
+						}
+					}
+					if ok {
+						p += 40
+					}
+				}
+			}
+		}
+	}
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.mod[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				c := q.mod[y][x]
+				if q.mod[y-1][x] == c && q.mod[y][x-1] == c && q.mod[y-1][x-1] == c {
+					p += 3
+				}
+			}
+		}
+	}
+	total := q.size * q.size
+	k := (abs(dark*20-total*10) + total - 1) / total
+	return p + (k-1)*10
+}
+
+// String draws the code with half-block characters, two rows per line, light
+// modules in the foreground colour so it scans on dark terminals.
+func (q *qrCode) String() string {
+	const quiet = 2
+	light := func(x, y int) bool {
+		if x < 0 || y < 0 || x >= q.size || y >= q.size {
+			return true
+		}
+		return !q.mod[y][x]
+	}
+	var b strings.Builder
+	for y := -quiet; y < q.size+quiet; y += 2 {
+		for x := -quiet; x < q.size+quiet; x++ {
+			t, u := light(x, y), y+1 < q.size+quiet && light(x, y+1)
+			switch {
+			case t && u:
+				b.WriteString("█")
+			case t:
+				b.WriteString("▀")
+			case u:
+				b.WriteString("▄")
+			default:
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func rsRemainder(data []byte, n int) []byte {
+	gen := make([]byte, n)
+	gen[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			gen[j] = gfMul(gen[j], root)
+			if j+1 < n {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	res := make([]byte, n)
+	for _, b := range data {
+		f := b ^ res[0]
+		copy(res, res[1:])
+		res[n-1] = 0
+		for j := range res {
+			res[j] ^= gfMul(gen[j], f)
+		}
+	}
+	return res
+}
+
+func gfMul(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		hi := z >> 7
+		z = z<<1 ^ hi*0x1D
+		z ^= (y >> i & 1) * x
+	}
+	return z
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
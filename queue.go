@@ -0,0 +1,168 @@
+package main
+
+import (
+	"html"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	leaseIdle  = 15 * time.Second
+	waitStale  = 10 * time.Second
+	waitReload = 3
+)
+
+// A lease is one client's claim on a measurement slot. It stays held while
+// requests are in flight and for leaseIdle after the last one, so the gaps
+// between ping, download and upload don't let a waiting client sneak in.
+type lease struct {
+	n   int
+	exp time.Time
+}
+
+type waiter struct {
+	ip   string
+	seen time.Time
+}
+
+type slots struct {
+	mu   sync.Mutex
+	held map[string]*lease
+	line []waiter
+}
+
+var q = &slots{held: map[string]*lease{}}
+
+func (s *slots) prune(now time.Time) {
+	for ip, l := range s.held {
+		if l.n == 0 && now.After(l.exp) {
+			delete(s.held, ip)
+		}
+	}
+	line := s.line[:0]
+	for _, w := range s.line {
+		if now.Sub(w.seen) < waitStale {
+			line = append(line, w)
+		}
+	}
+	s.line = line
+}
+
+// pos returns 0 if ip may run a test now, otherwise its place in line.
+func (s *slots) pos(ip string) int {
+	if cfg().MaxTests <= 0 {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.prune(now)
+	if l := s.held[ip]; l != nil {
+		l.exp = now.Add(leaseIdle)
+		return 0
+	}
+	i := -1
+	for j, w := range s.line {
+		if w.ip == ip {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		s.line = append(s.line, waiter{ip: ip})
+		i = len(s.line) - 1
+	}
+	s.line[i].seen = now
+	free := cfg().MaxTests - len(s.held)
+	if i < free {
+		s.line = append(s.line[:i], s.line[i+1:]...)
+		s.held[ip] = &lease{exp: now.Add(leaseIdle)}
+		return 0
+	}
+	return i - free + 1
+}
+
+// take claims a slot for one measurement request. Callers must pair a
+// successful take with put.
+func (s *slots) take(ip string) bool {
+	if cfg().MaxTests <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.prune(now)
+	l := s.held[ip]
+	if l == nil {
+		if len(s.held) >= cfg().MaxTests || len(s.line) > 0 {
+			return false
+		}
+		l = &lease{}
+		s.held[ip] = l
+	}
+	l.n++
+	l.exp = now.Add(leaseIdle)
+	return true
+}
+
+func (s *slots) put(ip string) {
+	if cfg().MaxTests <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l := s.held[ip]; l != nil {
+		l.n--
+		l.exp = time.Now().Add(leaseIdle)
+	}
+}
+
+// done releases ip's lease once its test has finished.
+func (s *slots) done(ip string) {
+	if cfg().MaxTests <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l := s.held[ip]; l != nil && l.n == 0 {
+		delete(s.held, ip)
+	}
+}
+
+func busy(w http.ResponseWriter) {
+	refusals.busy.Add(1)
+	w.Header().Set("Retry-After", strconv.Itoa(waitReload))
+	http.Error(w, "busy", http.StatusServiceUnavailable)
+}
+
+func queuePage(w http.ResponseWriter, r *http.Request, n int) {
+	b := brandFor(r)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if textUI(r) {
+		io.WriteString(w, textHead+b.name()+` (queued)</title></head><body>
+<h1>`+b.name()+`</h1>
+<p>Other tests are running, and simultaneous tests skew each other's results. You are #`+strconv.Itoa(n)+` in line.</p>
+<p><a href="/`+html.EscapeString(textQuery(r, "?"))+`">Check again</a> in `+strconv.Itoa(waitReload)+` seconds or so.</p>
+</body></html>`)
+		return
+	}
+	io.WriteString(w, `<!doctype html>
+<html><head><meta charset="utf-8"><meta http-equiv="refresh" content="`+strconv.Itoa(waitReload)+`"><title>`+b.name()+` (queued)</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Arial;max-width:760px;margin:1rem}</style>
+</head><body>
+<h2>`+b.heading(b.name())+`</h2>
+<p>Other tests are running. Simultaneous tests skew each other's results, so you've been put in line.</p>
+<p><strong>You are #`+strconv.Itoa(n)+` in line.</strong> This page refreshes by itself; keep it open.</p>
+</body></html>`)
+}
+
+func (s *slots) stats() (active, waiting int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	return len(s.held), len(s.line)
+}
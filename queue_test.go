@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+	withConfig(t, func(c *config) { c.MaxTests = 1 })
+	s := &slots{held: map[string]*lease{}}
+	if s.pos("a") != 0 {
+		t.Fatal("a has to wait with the slot free")
+	}
+	// a holds the slot; b and c line up behind it in order
+	if p := s.pos("b"); p != 1 {
+		t.Errorf("b is #%d, want #1", p)
+	}
+	if p := s.pos("c"); p != 2 {
+		t.Errorf("c is #%d, want #2", p)
+	}
+	if s.pos("b") != 1 {
+		t.Error("asking again moved b")
+	}
+	if s.take("c") {
+		t.Error("c took a slot past the line")
+	}
+	if !s.take("a") {
+		t.Fatal("a can't use its own slot")
+	}
+	s.put("a")
+	s.done("a")
+	if s.pos("b") != 0 || s.pos("c") != 1 {
+		t.Error("the line didn't move up when a finished")
+	}
+}
+
+func TestQueueLease(t *testing.T) {
+	withConfig(t, func(c *config) { c.MaxTests = 1 })
+	s := &slots{held: map[string]*lease{}}
+	if !s.take("a") {
+		t.Fatal("first take refused")
+	}
+	// a request in flight keeps the lease however long it runs
+	s.held["a"].exp = time.Now().Add(-time.Second)
+	if s.take("b") {
+		t.Fatal("b took a's slot mid-request")
+	}
+	s.put("a")
+	// done leaves it alone while another request of a's is in flight
+	s.take("a")
+	s.done("a")
+	if s.held["a"] == nil {
+		t.Fatal("done dropped a lease still in use")
+	}
+	s.put("a")
+	// idle past leaseIdle, the slot goes to whoever asks
+	s.held["a"].exp = time.Now().Add(-time.Second)
+	if !s.take("b") {
+		t.Error("an expired lease still held the slot")
+	}
+}
+
+func TestQueueStaleWaiter(t *testing.T) {
+	withConfig(t, func(c *config) { c.MaxTests = 1 })
+	s := &slots{held: map[string]*lease{}}
+	s.pos("a")
+	s.pos("b")
+	s.pos("c")
+	// b stopped refreshing its waiting page
+	s.line[0].seen = time.Now().Add(-waitStale - time.Second)
+	if p := s.pos("c"); p != 1 {
+		t.Errorf("c is #%d behind a gone waiter, want #1", p)
+	}
+}
+
+func TestQueueUnlimited(t *testing.T) {
+	withConfig(t, func(c *config) { c.MaxTests = 0 })
+	s := &slots{held: map[string]*lease{}}
+	for i := 0; i < 5; i++ {
+		if s.pos("a") != 0 || !s.take("b") {
+			t.Fatal("refused with no -max-tests")
+		}
+	}
+	if len(s.held) != 0 {
+		t.Error("leases kept with no -max-tests")
+	}
+}
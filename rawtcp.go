@@ -0,0 +1,252 @@
+//go:build !minimal && !norawtcp
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -tcp-addr opens a second port for throughput tests without HTTP in the
+// way, for "blurr tcp". The protocol is one request line each way and then
+// the bytes:
+//
+//	client: BLURR DOWN <bytes>\n     server: OK <bytes>\n, then that many bytes
+//	client: BLURR UP <bytes>\n       server: OK <bytes>\n, then the client sends them
+//	                                 server: DONE <bytes> <seconds>\n
+//
+// The server may grant fewer bytes than asked (the OK line says how many),
+// and answers BUSY\n or ERR <reason>\n instead when it won't run the test.
+// Uploads are timed from their first byte to their last.
+func init() {
+	register(subsystem{
+		name: "rawtcp",
+		flags: func() {
+			flag.StringVar(&settings.TCPAddr, "tcp-addr", settings.TCPAddr, "also listen here for raw TCP tests (\"blurr tcp\"), e.g. :5201")
+		},
+		start: startRawTCP,
+		cmd:   "tcp",
+		run:   runTCP,
+	})
+}
+
+func startRawTCP() {
+	if cfg().TCPAddr == "" {
+		return
+	}
+	if cfg().siteAuth() {
+		// the protocol has no way to pass credentials, so the port would
+		// be a way around them
+		degraded("-tcp-addr: not opened, since basic auth (-auth-user or -auth-file) is on", "Drop -tcp-addr on an instance behind basic auth.")
+		return
+	}
+	l, err := listen(cfg().TCPAddr)
+	if err != nil {
+		degraded("-tcp-addr: "+err.Error(), "Pick another -tcp-addr or stop whatever holds the port.")
+		return
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				log.Println("tcp:", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			tuneConn(c)
+			go rawTest(c)
+		}
+	}()
+}
+
+func rawTest(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	br := bufio.NewReaderSize(c, 256)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return
+	}
+	f := strings.Fields(line)
+	var n int64
+	if len(f) == 3 {
+		n, _ = strconv.ParseInt(f[2], 10, 64)
+	}
+	if n <= 0 || f[0] != "BLURR" || f[1] != "DOWN" && f[1] != "UP" {
+		io.WriteString(c, "ERR expected BLURR DOWN|UP <bytes>\n")
+		return
+	}
+	ip, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	if a, err := netip.ParseAddr(ip); err != nil || !mayTestFrom(a.Unmap()) {
+		io.WriteString(c, "ERR this instance doesn't run tests for your network\n")
+		return
+	}
+	ip = anonIP(ip)
+	if budget.exhausted() || !q.take(ip) {
+		refusals.busy.Add(1)
+		io.WriteString(c, "BUSY\n")
+		return
+	}
+	defer q.put(ip)
+	// a download and the upload right after it make one test against
+	// -tests-per-hour; anything else counts by itself
+	if !(f[1] == "UP" && rawPaired(ip)) && !perIP.allow(ip) {
+		io.WriteString(c, "ERR too many tests, try again in "+perIP.wait(ip).Round(time.Second).String()+"\n")
+		return
+	}
+	if f[1] == "DOWN" {
+		rawDown(ip)
+	}
+	// -transfer-timeout 0 is no limit, as for HTTP transfers
+	var until time.Time
+	if cfg().TransferTimeout > 0 {
+		until = time.Now().Add(cfg().TransferTimeout)
+	}
+	c.SetDeadline(until)
+	var start time.Time
+	if f[1] == "DOWN" {
+		n = min(n, maxDownload())
+		fmt.Fprintf(c, "OK %d\n", n)
+		start = time.Now()
+		p, off, left := payload(), payloadStart(), n
+		for left > 0 {
+			k, err := c.Write(p[off:min(len(p), off+int(min(left, int64(chunkSize()))))])
+			left -= int64(k)
+			if off += k; off == len(p) {
+				off = 0
+			}
+			if err != nil {
+				break
+			}
+		}
+		n -= left
+	} else {
+		defer q.done(ip)
+		n = min(n, maxUpload())
+		fmt.Fprintf(c, "OK %d\n", n)
+		if _, err := br.Peek(1); err != nil {
+			return
+		}
+		start = time.Now()
+		n, _ = drain(io.LimitReader(br, n))
+		fmt.Fprintf(c, "DONE %d %.6f\n", n, time.Since(start).Seconds())
+	}
+	budget.add(n)
+	el := time.Since(start).Seconds()
+	log.Printf("tcp %s ip=%s bytes=%d elapsed=%.3f bps=%.3fMiB/s", strings.ToLower(f[1]), ip, n, el, float64(n)/el/1024/1024)
+}
+
+// rawDowns holds when each address last started a raw download, so the
+// upload "blurr tcp" sends next goes free, once.
+var rawDowns = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: map[string]time.Time{}}
+
+// rawPairWindow is how long after its download an upload still pairs
+// with it; "blurr tcp" moves 100M each way by default.
+const rawPairWindow = 10 * time.Minute
+
+// rawDown notes a download from ip that got past the limit.
+func rawDown(ip string) {
+	rawDowns.Lock()
+	defer rawDowns.Unlock()
+	now := time.Now()
+	for k, t := range rawDowns.m {
+		if now.Sub(t) > rawPairWindow {
+			delete(rawDowns.m, k)
+		}
+	}
+	rawDowns.m[ip] = now
+}
+
+// rawPaired reports whether an upload from ip follows a download of its
+// own, using the download up.
+func rawPaired(ip string) bool {
+	rawDowns.Lock()
+	defer rawDowns.Unlock()
+	t, ok := rawDowns.m[ip]
+	delete(rawDowns.m, ip)
+	return ok && time.Since(t) <= rawPairWindow
+}
+
+// runTCP is "blurr tcp": a download and an upload against another
+// server's -tcp-addr.
+func runTCP(args []string) {
+	fs := flag.NewFlagSet("tcp", flag.ExitOnError)
+	size := byteSize(100 << 20)
+	fs.Var(&size, "size", "bytes to move each way (default 100M)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: blurr tcp [-size 100M] host:port")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	for _, dir := range []string{"DOWN", "UP"} {
+		n, secs, err := tcpClient(fs.Arg(0), dir, int64(size))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, strings.ToLower(dir)+":", err)
+			os.Exit(1)
+		}
+		name := map[string]string{"DOWN": "download", "UP": "upload"}[dir]
+		fmt.Printf("%-8s %10s in %6.2fs  %8.1f Mbit/s\n", name, fmtBytes(n), secs, float64(n)*8/secs/1e6)
+	}
+}
+
+func tcpClient(addr, dir string, size int64) (int64, float64, error) {
+	c, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Minute))
+	fmt.Fprintf(c, "BLURR %s %d\n", dir, size)
+	br := bufio.NewReader(c)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return 0, 0, err
+	}
+	var n int64
+	if _, err := fmt.Sscanf(line, "OK %d\n", &n); err != nil {
+		return 0, 0, errors.New("server said " + strings.TrimSpace(line))
+	}
+	if dir == "DOWN" {
+		start := time.Now()
+		got, err := drain(io.LimitReader(br, n))
+		if err == nil && got < n {
+			err = io.ErrUnexpectedEOF
+		}
+		return got, time.Since(start).Seconds(), err
+	}
+	p, left := payload(), n
+	for left > 0 {
+		k, err := c.Write(p[:min(int64(len(p)), left)])
+		if err != nil {
+			return n - left, 0, err
+		}
+		left -= int64(k)
+	}
+	line, err = br.ReadString('\n')
+	if err != nil {
+		return 0, 0, err
+	}
+	var secs float64
+	if _, err := fmt.Sscanf(line, "DONE %d %g\n", &n, &secs); err != nil {
+		return 0, 0, errors.New("server said " + strings.TrimSpace(line))
+	}
+	return n, secs, nil
+}
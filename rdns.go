@@ -0,0 +1,84 @@
+//go:build !minimal && !nordns
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"html"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -rdns the server looks up the client's PTR record while the test
+// runs, so people can check they're going out through the ISP or VPN they
+// expect. It's off by default because the lookup tells the DNS server who
+// tested.
+const rdnsWait = 2 * time.Second
+
+// When the resolver keeps failing (not just a missing PTR record), lookups
+// pause for a while so every test doesn't wait on a dead server.
+var rdnsPause struct {
+	sync.Mutex
+	failures int
+	until    time.Time
+}
+
+func init() {
+	register(subsystem{
+		name: "rdns",
+		flags: func() {
+			flag.BoolVar(&settings.RDNS, "rdns", settings.RDNS, "show the reverse DNS name of the client's address on the result page")
+		},
+		begin:  rdnsSession,
+		result: rdnsRow,
+	})
+}
+
+func rdnsSession(s *session) {
+	if !cfg().RDNS {
+		return
+	}
+	ip := s.addr
+	if net.ParseIP(ip) == nil {
+		return
+	}
+	rdnsPause.Lock()
+	paused := time.Now().Before(rdnsPause.until)
+	rdnsPause.Unlock()
+	if paused {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), rdnsWait)
+		defer cancel()
+		names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+		var de *net.DNSError
+		if errors.As(err, &de) && de.IsNotFound {
+			err = nil
+		}
+		rdnsPause.Lock()
+		if err != nil {
+			rdnsPause.failures++
+			rdnsPause.until = time.Now().Add(backoff(rdnsPause.failures, 10*time.Second, 10*time.Minute))
+		} else {
+			rdnsPause.failures = 0
+		}
+		rdnsPause.Unlock()
+		setHealth("rdns", err)
+		if len(names) == 0 {
+			return
+		}
+		s.update(func(r *result) { r.PTR = clip(strings.TrimSuffix(names[0], "."), 253) })
+	}()
+}
+
+func rdnsRow(res *result) string {
+	if res.PTR == "" {
+		return ""
+	}
+	return "<p>Reverse DNS: " + html.EscapeString(res.PTR) + "</p>\n"
+}
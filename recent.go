@@ -0,0 +1,74 @@
+package main
+
+import "sync"
+
+// resultRing keeps the last finished results, without their per-request
+// detail, in a fixed-size ring. Sessions expire after an hour; this is
+// what the admin view and the statistics draw on, so an instance with no
+// storage at all still has some recent history.
+type resultRing struct {
+	mu   sync.Mutex
+	buf  []result
+	next int
+	n    int
+}
+
+var recent resultRing
+
+func recentCap() int {
+	if cfg().Recent > 0 {
+		return min(cfg().Recent, maxRecent)
+	}
+	if cfg().LowMem {
+		return 50
+	}
+	return 500
+}
+
+func (g *resultRing) add(r result) {
+	r.Pings, r.LoadPings, r.ProbeTTFB, r.Timings, r.DownSeries, r.UpSeries = nil, nil, nil, nil, nil, nil
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.buf == nil {
+		g.buf = make([]result, recentCap())
+	}
+	g.buf[g.next] = r
+	g.next = (g.next + 1) % len(g.buf)
+	g.n = min(g.n+1, len(g.buf))
+}
+
+// drop removes the results keep rejects and returns their IDs.
+func (g *resultRing) drop(keep func(*result) bool) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var kept []result
+	var gone []string
+	for i := g.n; i >= 1; i-- {
+		r := g.buf[(g.next-i+len(g.buf))%len(g.buf)]
+		if keep(&r) {
+			kept = append(kept, r)
+		} else {
+			gone = append(gone, r.ID)
+		}
+	}
+	if len(gone) == 0 {
+		return nil
+	}
+	clear(g.buf)
+	g.next, g.n = copy(g.buf, kept)%len(g.buf), len(kept)
+	return gone
+}
+
+// last returns up to n results, newest first (all of them if n <= 0).
+func (g *resultRing) last(n int) []result {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if n <= 0 || n > g.n {
+		n = g.n
+	}
+	out := make([]result, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, g.buf[(g.next-i+len(g.buf))%len(g.buf)])
+	}
+	return out
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// SIGHUP (or a POST to /admin/reload) re-reads the -config file and applies
+// whatever can change under a running server: sizes, limits, the test's
+// shape and the names shown with results. Everything else (listeners,
+// subsystems that set themselves up at startup) keeps its value and is
+// logged as needing a restart. Tests already running carry on with what
+// they started with; flags given on the command line still win, and a
+// setting taken out of the file keeps its value until a restart.
+var reloadable = map[string]bool{
+	"max-tests": true, "streams": true, "target-time": true, "duration": true, "warmup": true,
+	"loss-probes": true, "pings": true, "ping-gap": true, "fresh-conns": true, "pace": true,
+	"allow": true, "deny": true, "tests-per-hour": true, "demo-per-minute": true, "daily-bytes": true,
+	"max-size": true, "max-upload": true, "chunk": true, "flush-every": true, "form-upload": true,
+	"hostname": true, "site-name": true, "contact": true, "footer": true, "disclaimer": true, "unit": true, "pop": true, "notify-below": true, "stats": true,
+}
+
+var configPath string
+
+func watchReload() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			reloadConfig()
+		}
+	}()
+}
+
+// reloadConfig applies the -config file again and returns the settings it
+// changed and the ones that only a restart would. The file is read into
+// the settings, checked like at startup and only then published, so
+// requests keep the old config until the new one is whole.
+func reloadConfig() (changed, restart []string, err error) {
+	if configPath == "" {
+		err = errors.New("no -config file to reload")
+		log.Printf("reload: %v", err)
+		return nil, nil, err
+	}
+	cfgMu.Lock()
+	defer cfgMu.Unlock()
+	before := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) { before[f.Name] = f.Value.String() })
+	old := settings
+	settings.Phases, settings.Hosts = nil, nil
+	err = loadConfig(configPath)
+	if err == nil {
+		checkConfig(&settings, func(what, _ string) {
+			if err == nil {
+				err = errors.New(what)
+			}
+		})
+	}
+	if err != nil {
+		// put back whatever was set before the error
+		flag.VisitAll(func(f *flag.Flag) {
+			if f.Value.String() != before[f.Name] {
+				f.Value.Set(before[f.Name])
+			}
+		})
+		settings = old
+		log.Printf("reload: %s: %v; keeping the running config", configPath, err)
+		return nil, nil, err
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		now := f.Value.String()
+		switch {
+		case now == before[f.Name]:
+		case reloadable[f.Name]:
+			changed = append(changed, f.Name+"="+now)
+		default:
+			f.Value.Set(before[f.Name])
+			restart = append(restart, f.Name)
+		}
+	})
+	// a reloaded max-tests or max-size of 0 is -lowmem's cap again
+	profiles(&settings)
+	checkConfig(&settings, func(string, string) {})
+	if !reflect.DeepEqual(old.Phases, settings.Phases) {
+		changed = append(changed, "phases")
+	}
+	if !reflect.DeepEqual(old.Hosts, settings.Hosts) {
+		changed = append(changed, "hosts")
+	}
+	publish()
+	eachSubsystem(func(s subsystem) {
+		if s.reload != nil {
+			s.reload()
+		}
+	})
+	sort.Strings(changed)
+	sort.Strings(restart)
+	log.Printf("reload: %s: changed %s", configPath, listOrNone(changed))
+	if len(restart) > 0 {
+		log.Printf("reload: needs a restart to change: %s", strings.Join(restart, ", "))
+	}
+	return changed, restart, nil
+}
+
+func listOrNone(s []string) string {
+	if len(s) == 0 {
+		return "nothing"
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+var flagsOnce sync.Once
+
+// withReload registers the flags as main does and points -config at a
+// file for the test, returning a function that rewrites it.
+func withReload(t *testing.T) func(string) {
+	flagsOnce.Do(func() {
+		args := os.Args
+		os.Args = args[:1]
+		parseFlags()
+		os.Args = args
+	})
+	withConfig(t, func(*config) {})
+	path := filepath.Join(t.TempDir(), "blurr.json")
+	old, out := configPath, log.Writer()
+	configPath = path
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		configPath = old
+		log.SetOutput(out)
+	})
+	return func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	write := withReload(t)
+	write(`{"site-name": "One", "streams": 3, "phases": [{"name": "big", "size": "1M"}]}`)
+	changed, restart, err := reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"phases", "site-name=One", "streams=3"}; !slices.Equal(changed, want) || len(restart) != 0 {
+		t.Errorf("changed %v, restart %v; want %v and none", changed, restart, want)
+	}
+	if cfg().SiteName != "One" || cfg().Streams != 3 || len(cfg().Phases) != 1 {
+		t.Errorf("published %q, %d streams, %d phases", cfg().SiteName, cfg().Streams, len(cfg().Phases))
+	}
+	// the same file again changes nothing, phases included
+	if changed, _, _ := reloadConfig(); len(changed) != 0 {
+		t.Errorf("reloading the same file changed %v", changed)
+	}
+}
+
+func TestReloadRestartOnly(t *testing.T) {
+	write := withReload(t)
+	addr := cfg().Addr
+	write(`{"site-name": "Two", "addr": ":1"}`)
+	changed, restart, err := reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(changed, []string{"site-name=Two"}) || !slices.Equal(restart, []string{"addr"}) {
+		t.Errorf("changed %v, restart %v", changed, restart)
+	}
+	if cfg().Addr != addr || settings.Addr != addr {
+		t.Errorf("-addr went from %q to %q live", addr, cfg().Addr)
+	}
+}
+
+func TestReloadRollback(t *testing.T) {
+	write := withReload(t)
+	write(`{"site-name": "Good"}`)
+	if _, _, err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{
+		`{"site-name": "Bad", "unit": "furlongs"}`,
+		`{"site-name": "Bad", "timezone": "Mars/Olympus"}`,
+		`{"site-name": "Bad", "streams": "many"}`,
+		`{"site-name": "Bad", "phases": [{"name": "x", "size": "huge"}]}`,
+		`{"site-name": "Bad", "no-such-flag": 1}`,
+		`{"site-name": "Bad"`,
+	} {
+		write(bad)
+		if _, _, err := reloadConfig(); err == nil {
+			t.Errorf("%s: reloaded", bad)
+		}
+		if cfg().SiteName != "Good" || settings.SiteName != "Good" || cfg().Unit != settings.Unit || cfg().zone() != settings.zone() {
+			t.Errorf("%s: left site-name %q (settings %q)", bad, cfg().SiteName, settings.SiteName)
+		}
+	}
+}
+
+func TestReloadProfiles(t *testing.T) {
+	write := withReload(t)
+	withConfig(t, func(c *config) { c.LowMem = true })
+	write(`{"max-tests": 0, "max-size": "0"}`)
+	if _, _, err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg().MaxTests != 1 || cfg().MaxSize != 64<<20 {
+		t.Errorf("-lowmem caps lost on reload: max-tests %d, max-size %d", cfg().MaxTests, cfg().MaxSize)
+	}
+}
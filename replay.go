@@ -0,0 +1,106 @@
+//go:build !minimal && !noreplay
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+)
+
+func init() {
+	register(subsystem{name: "replay", cmd: "replay", run: runReplay})
+}
+
+// runReplay is "blurr replay": it feeds a session exported from
+// /api/v1/result/<id> back through the same statistics code, reports every
+// figure that comes out different and can render the page it produces, for
+// looking into "my result looks wrong" reports.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	page := fs.String("html", "", "also write the replayed result page to this file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: blurr replay [-html page.html] result.json")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	b, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var in result
+	if err := json.Unmarshal(b, &in); err != nil {
+		fmt.Fprintln(os.Stderr, fs.Arg(0)+":", err)
+		os.Exit(1)
+	}
+	out := replay(&in)
+	if len(in.Timings) >= maxTimings {
+		fmt.Printf("note: the timing log is full (%d entries), later requests weren't recorded\n", maxTimings)
+	}
+	// live figures come from the monotonic clock and the log has wall-clock
+	// timestamps, so tiny differences are expected
+	row := func(name string, a, b float64) {
+		mark := ""
+		if math.Abs(a-b) > 1e-4*math.Max(math.Abs(a), 1) {
+			mark = "  <- differs"
+		}
+		fmt.Printf("%-22s %18.3f %18.3f%s\n", name, a, b, mark)
+	}
+	fmt.Printf("%-22s %18s %18s\n", "", "stored", "replayed")
+	row("ping_ms", in.Ping, out.Ping)
+	row("jitter_ms", in.Jitter, out.Jitter)
+	row("loaded_ping_ms", in.LoadPing, out.LoadPing)
+	row("download_bps", in.Down, out.Down)
+	row("server_download_bps", in.ServerDown, out.ServerDown)
+	row("download_bytes", float64(in.DownBytes), float64(out.DownBytes))
+	row("upload_bps", in.Up, out.Up)
+	row("client_upload_bps", in.ClientUp, out.ClientUp)
+	row("upload_bytes", float64(in.UpBytes), float64(out.UpBytes))
+	row("probes_seen", float64(in.ProbesSeen), float64(out.ProbesSeen))
+	for i, p := range out.Phases {
+		if i < len(in.Phases) {
+			row(p.Name, in.Phases[i].ServerDown, p.ServerDown)
+		}
+	}
+	if *page != "" {
+		f, err := os.Create(*page)
+		if err == nil {
+			writeResult(f, &out)
+			err = f.Close()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// replay rebuilds a result from what was recorded about it: the server's
+// timing log and the browser's report.
+func replay(in *result) result {
+	s := &session{res: result{ID: in.ID, Time: in.Time, IP: in.IP, Streams: in.Streams, Label: in.Label, Wizard: in.Wizard, Pair: in.Pair, Group: in.Group}}
+	s.mu.Lock()
+	for _, t := range in.Timings {
+		s.record(t)
+	}
+	s.downS.b, s.upS.b = in.DownSeries, in.UpSeries
+	s.mu.Unlock()
+	rep := report{Pings: in.Pings, Loaded: in.LoadPings, Down: in.Down, Up: in.ClientUp, Phases: map[string]float64{}}
+	rep.Probes.Sent, rep.Probes.OK, rep.Probes.DeadlineMs = in.Probes, in.ProbesOK, in.ProbeMs
+	rep.Conn.TCP, rep.Conn.TLS, rep.Conn.HTTP = in.TCPMs, in.TLSMs, in.HTTPMs
+	rep.TTFB.Probes, rep.TTFB.Down = in.ProbeTTFB, in.DownTTFB
+	var phases []phase
+	for _, p := range in.Phases {
+		phases = append(phases, phase{Name: p.Name, Streams: p.Streams})
+		rep.Phases[p.Name] = p.Down
+	}
+	s.finish(&rep, phases)
+	return s.snapshot()
+}
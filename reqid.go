@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Every request gets an ID: the one a proxy sent as X-Request-ID, if it
+// looks like one, or a new one. It's sent back in the same header, logged
+// with the transfers, stored with each request in a result's timings and
+// added to plain-text error answers, so a report like "my upload shows 0"
+// can be matched to the server's side of it.
+type reqIDKey struct{}
+
+var (
+	reqIDOK     = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+	reqIDPrefix = func() string {
+		b := make([]byte, 4)
+		rand.Read(b)
+		return hex.EncodeToString(b)
+	}()
+	reqIDSeq atomic.Uint64
+)
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(reqIDKey{}).(string)
+	return id
+}
+
+func requestIDs(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !reqIDOK.MatchString(id) {
+			id = reqIDPrefix + "-" + strconv.FormatUint(reqIDSeq.Add(1), 36)
+		}
+		w.Header().Set("X-Request-ID", id)
+		ew := &idWriter{ResponseWriter: w}
+		h.ServeHTTP(ew, r.WithContext(context.WithValue(r.Context(), reqIDKey{}, id)))
+		if ew.plainError {
+			io.WriteString(w, "Request ID: "+id+"\n")
+		}
+	})
+}
+
+// idWriter spots http.Error's answers, to put the request ID under them.
+type idWriter struct {
+	http.ResponseWriter
+	wrote, plainError bool
+}
+
+func (w *idWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.wrote = true
+		w.plainError = code >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *idWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom passes io.Copy on to the connection, for sendfile.
+func (w *idWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.wrote = true
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{w.ResponseWriter}, r)
+}
+
+func (w *idWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *idWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,1236 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A result is one test run. The browser starts it with POST /start, tags
+// its download and upload requests with the returned id, and finishes with
+// POST /done carrying the ping samples only it can measure. Throughput is
+// taken on the receiving side: the browser's figure for the download (the
+// server's write speed can run ahead of what arrived), the server's for
+// the upload. Both sides are kept.
+type result struct {
+	ID         string        `json:"id"`
+	Time       time.Time     `json:"time"`
+	IP         string        `json:"ip"`
+	POP        string        `json:"pop,omitempty"`
+	Server     string        `json:"server,omitempty"`
+	PTR        string        `json:"ptr,omitempty"`
+	ASN        int           `json:"asn,omitempty"`
+	ISP        string        `json:"isp,omitempty"`
+	Pings      []float64     `json:"pings_ms,omitempty"`
+	Ping       float64       `json:"ping_ms"`
+	Jitter     float64       `json:"jitter_ms"`
+	JitterRFC  float64       `json:"jitter_rfc3550_ms,omitempty"`
+	PingStats  *spread       `json:"ping_stats,omitempty"`
+	LoadPings  []float64     `json:"loaded_pings_ms,omitempty"`
+	LoadPing   float64       `json:"loaded_ping_ms,omitempty"`
+	LoadStats  *spread       `json:"loaded_ping_stats,omitempty"`
+	TCPMs      float64       `json:"tcp_handshake_ms,omitempty"`
+	TLSMs      float64       `json:"tls_handshake_ms,omitempty"`
+	HTTPMs     float64       `json:"first_request_ms,omitempty"`
+	AcceptMs   []float64     `json:"accept_to_first_byte_ms,omitempty"`
+	ICMP       []float64     `json:"icmp_ms,omitempty"`
+	ICMPLost   int           `json:"icmp_lost,omitempty"`
+	Probes     int           `json:"probes_sent,omitempty"`
+	ProbesOK   int           `json:"probes_answered,omitempty"`
+	ProbesSeen int           `json:"probes_seen,omitempty"`
+	ProbeMs    float64       `json:"probe_deadline_ms,omitempty"`
+	ProbeTTFB  []float64     `json:"probe_ttfb_ms,omitempty"`
+	DownTTFB   []float64     `json:"download_ttfb_ms,omitempty"`
+	Down       float64       `json:"download_bps"`
+	Up         float64       `json:"upload_bps"`
+	ServerDown float64       `json:"server_download_bps"`
+	ClientUp   float64       `json:"client_upload_bps"`
+	WallDown   float64       `json:"wall_download_bps,omitempty"`
+	WallSecs   float64       `json:"wall_download_secs,omitempty"`
+	DownBytes  int64         `json:"download_bytes"`
+	Streams    int           `json:"streams"`
+	Phases     []phaseResult `json:"phases,omitempty"`
+	Timings    []timing      `json:"timings"`
+	SampleMs   int           `json:"sample_ms,omitempty"`
+	DownSeries []int64       `json:"download_samples,omitempty"`
+	UpSeries   []int64       `json:"upload_samples,omitempty"`
+	UpBytes    int64         `json:"upload_bytes"`
+	Label      string        `json:"label,omitempty"`
+	Wizard     string        `json:"wizard,omitempty"`
+	Pair       string        `json:"pair,omitempty"`
+	Group      string        `json:"group,omitempty"`
+	Method     string        `json:"methodology,omitempty"`
+	Fresh      bool          `json:"fresh_connections,omitempty"`
+	Tor        bool          `json:"tor,omitempty"`
+	Paced      bitRate       `json:"paced_bps,omitempty"`
+	Done       bool          `json:"done"`
+
+	unit  unit    // the unit the page showing it uses
+	loc   *locale // and how it writes numbers and times
+	brand *brand  // and whose name it goes by
+}
+
+// phaseResult is one operator-defined extra download phase.
+type phaseResult struct {
+	Name       string  `json:"name"`
+	Streams    int     `json:"streams"`
+	Bytes      int64   `json:"bytes"`
+	Down       float64 `json:"download_bps"`
+	ServerDown float64 `json:"server_download_bps"`
+	Via        string  `json:"via,omitempty"`
+}
+
+// A timing is one request as the server saw it, for clients that want to
+// redo the analysis: Kind is "ping", "download" or "upload", Phase names a
+// custom download phase and Round the adaptive-sizing attempt. Bytes is
+// the payload; Wire what the socket moved in the same direction while the
+// handler ran, response headers and framing included, which is what the
+// server-side speeds are worked out from when it's known. On Linux a
+// download also has Acked, the bytes the client acknowledged from Start
+// to AckedSecs later, and the speed is worked out from that instead.
+type timing struct {
+	Kind  string    `json:"kind"`
+	Phase string    `json:"phase,omitempty"`
+	Round int       `json:"round,omitempty"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Bytes int64     `json:"bytes"`
+	Wire  int64     `json:"wire_bytes,omitempty"`
+	TCP   *tcpStat  `json:"tcp_info,omitempty"`
+
+	Acked     int64   `json:"acked_bytes,omitempty"`
+	AckedSecs float64 `json:"acked_secs,omitempty"`
+
+	Conn   uint64 `json:"conn,omitempty"`
+	Reused bool   `json:"reused,omitempty"`
+	Req    string `json:"request_id,omitempty"`
+
+	WarmupSecs  float64 `json:"warmup_secs,omitempty"`
+	WarmupBytes int64   `json:"warmup_bytes,omitempty"`
+}
+
+const maxTimings = 512
+
+// tcpStat is the kernel's view of a download connection when it ended
+// (Linux only): smoothed RTT, segments retransmitted over its lifetime,
+// congestion window in segments and the last delivery rate in bytes/s.
+// ECN says whether the connection negotiated ECN, ECTSeen whether packets
+// from the client arrived with their ECN bits intact and DeliveredCE how
+// many of our segments the client reported congestion-marked (an AQM on
+// the path marking instead of dropping).
+type tcpStat struct {
+	RTTMs       float64 `json:"rtt_ms"`
+	RTTVarMs    float64 `json:"rttvar_ms"`
+	MinRTTMs    float64 `json:"min_rtt_ms,omitempty"`
+	Cwnd        int     `json:"cwnd"`
+	Retrans     int     `json:"retransmits"`
+	SegsOut     int     `json:"segments_out,omitempty"`
+	DeliveryBps float64 `json:"delivery_rate_bps,omitempty"`
+	ECN         bool    `json:"ecn"`
+	ECTSeen     bool    `json:"ecn_ect_seen,omitempty"`
+	DeliveredCE int     `json:"delivered_ce,omitempty"`
+	BytesAcked  uint64  `json:"bytes_acked,omitempty"`
+	hasAcked    bool    // the kernel reports BytesAcked
+}
+
+// A span adds up transfers that may run in parallel: total bytes over the
+// time from the first start to the last end.
+type span struct {
+	start, end time.Time
+	bytes      int64
+}
+
+func (p *span) add(start, end time.Time, n int64) {
+	if p.start.IsZero() || start.Before(p.start) {
+		p.start = start
+	}
+	if end.After(p.end) {
+		p.end = end
+	}
+	p.bytes += n
+}
+
+func (p *span) bps() float64 {
+	return float64(p.bytes) / math.Max(p.end.Sub(p.start).Seconds(), 1e-9)
+}
+
+// A meter follows one transfer as it runs and notes where the -warmup part
+// ends, so TCP slow start doesn't drag down the speed of short transfers.
+// It's an io.Writer so a TeeReader can feed it.
+type meter struct {
+	start, end, from time.Time
+	n, fromN         int64
+	warm             time.Duration
+	warmN            int64
+	samples          []int64
+	wire             int64
+	tcp              *tcpStat
+	acked            int64
+	ackedAt          time.Time
+	atFirstByte      bool // restart the clock when the first bytes arrive
+	conn             uint64
+	reused           bool
+	req              string
+}
+
+// Transfers are sampled as bytes per sampleEvery, for the first maxSamples
+// intervals.
+const (
+	sampleEvery = 100 * time.Millisecond
+	maxSamples  = 1200
+)
+
+func newMeter(size int64, dur time.Duration) *meter {
+	m := &meter{start: time.Now()}
+	m.warm, m.warmN = cfg().Warmup.cut(size, dur)
+	if m.warm == 0 && m.warmN == 0 {
+		m.from = m.start
+	}
+	return m
+}
+
+func (m *meter) Write(p []byte) (int, error) {
+	m.add(len(p))
+	return len(p), nil
+}
+
+func (m *meter) add(n int) {
+	now := time.Now()
+	if m.atFirstByte {
+		if m.from.Equal(m.start) {
+			m.from = now
+		}
+		m.start, m.atFirstByte = now, false
+	}
+	m.n += int64(n)
+	if i := int(now.Sub(m.start) / sampleEvery); i < maxSamples {
+		for len(m.samples) <= i {
+			m.samples = append(m.samples, 0)
+		}
+		m.samples[i] += int64(n)
+	}
+	if m.from.IsZero() && m.n >= m.warmN && now.Sub(m.start) >= m.warm {
+		m.from, m.fromN = now, m.n
+	}
+}
+
+func (m *meter) stop() { m.end = time.Now() }
+
+// measured is the part of the transfer that counts: everything after the
+// warm-up, or all of it if the transfer was over before the warm-up was.
+func (m *meter) measured() (time.Time, int64) {
+	if m.from.IsZero() || m.fromN == m.n {
+		return m.start, m.n
+	}
+	return m.from, m.n - m.fromN
+}
+
+func (m *meter) bps() float64 {
+	start, n := m.measured()
+	end := m.end
+	if m.acked > 0 {
+		n, end = m.acked-(m.n-n), m.ackedAt
+	}
+	return float64(n) / math.Max(end.Sub(start).Seconds(), 1e-9)
+}
+
+// ackWait is how long a download waits, after its last write, for the
+// client to acknowledge what's still in flight.
+const ackWait = 2 * time.Second
+
+// waitAcked follows TCP_INFO's bytes_acked on r's connection until the
+// client has acknowledged want bytes beyond what it had at from, or
+// ackWait is up, and notes how much got acknowledged by when. A write
+// returns as soon as the bytes are in the socket buffer, so on a short
+// transfer the write speed says more about the buffer than the link;
+// the acknowledgements say what actually arrived.
+func (m *meter) waitAcked(r *http.Request, from *tcpStat, want int64) {
+	if from == nil || !from.hasAcked || want <= 0 {
+		return
+	}
+	deadline := time.Now().Add(ackWait)
+	for {
+		t := tcpInfo(r)
+		if t == nil || t.BytesAcked < from.BytesAcked {
+			return
+		}
+		got := int64(t.BytesAcked - from.BytesAcked)
+		if now := time.Now(); got >= want || now.After(deadline) {
+			m.acked, m.ackedAt, m.tcp = got, now, t
+			return
+		}
+		time.Sleep(ackPoll(got, want, time.Since(m.start)))
+	}
+}
+
+// ackPoll is how long waitAcked sleeps before it looks again: about the
+// time the rest needs at the rate seen so far, between 1 and 10ms, so a
+// few streams waiting at once don't cost thousands of syscalls a second.
+func ackPoll(got, want int64, since time.Duration) time.Duration {
+	if got <= 0 || since <= 0 {
+		return 5 * time.Millisecond
+	}
+	d := time.Duration(float64(want-got) / float64(got) * float64(since))
+	return min(max(d, time.Millisecond), 10*time.Millisecond)
+}
+
+func (m *meter) timing(kind, phase string, round int) timing {
+	t := timing{Kind: kind, Phase: phase, Round: round, Start: m.start, End: m.end, Bytes: m.n, Wire: m.wire, TCP: m.tcp, Conn: m.conn, Reused: m.reused, Req: m.req}
+	if m.acked > 0 {
+		t.Acked, t.AckedSecs = m.acked, m.ackedAt.Sub(m.start).Seconds()
+	}
+	if start, _ := m.measured(); start != m.start {
+		t.WarmupSecs, t.WarmupBytes = start.Sub(m.start).Seconds(), m.fromN
+	}
+	return t
+}
+
+// A series adds up the samples of transfers running side by side.
+type series struct {
+	start time.Time
+	b     []int64
+}
+
+func (p *series) add(m *meter) {
+	if p.start.IsZero() {
+		p.start = m.start
+	}
+	off := int(m.start.Sub(p.start) / sampleEvery)
+	if off < 0 {
+		p.b = append(make([]int64, -off), p.b...)[:min(len(p.b)-off, maxSamples)]
+		p.start = p.start.Add(time.Duration(off) * sampleEvery)
+		off = 0
+	}
+	for i, v := range m.samples {
+		j := off + i
+		if j >= maxSamples {
+			break
+		}
+		for len(p.b) <= j {
+			p.b = append(p.b, 0)
+		}
+		p.b[j] += v
+	}
+}
+
+type session struct {
+	mu         sync.Mutex
+	res        result
+	down       span
+	round      int
+	up         span
+	downS, upS series
+	phases     map[string]*span
+	noJS       bool      // run without script, so only follow-up requests tell when the download arrived
+	dispatched time.Time // when the first main download request came in
+	paceDown   *pacer
+	paceUp     *pacer
+	wake       chan struct{} // closed on the next change, for await
+	addr       string        // the client's real address (testerAddr), for pings and lookups; res.IP may be anonymized
+}
+
+var sessions = struct {
+	sync.Mutex
+	m map[string]*session
+}{m: map[string]*session{}}
+
+func sessionTTL() time.Duration {
+	if cfg().LowMem {
+		return 10 * time.Minute
+	}
+	return time.Hour
+}
+
+func sessionCap() int {
+	if cfg().LowMem {
+		return 100
+	}
+	return 10000
+}
+
+func newSession(r *http.Request) *session {
+	var b [8]byte
+	rand.Read(b[:])
+	q := r.URL.Query()
+	s := &session{addr: testerAddr(r).String(), res: result{
+		ID:     hex.EncodeToString(b[:]),
+		Time:   time.Now(),
+		IP:     getIP(r),
+		POP:    cfg().POP,
+		Server: cfg().Hostname,
+		Label:  clip(q.Get("label"), 40),
+		Wizard: clip(q.Get("wizard"), 20),
+		Pair:   clip(q.Get("pair"), 16),
+		Group:  clip(strings.ToUpper(q.Get("group")), 8),
+	}}
+	s.res.Streams = streams(r)
+	s.res.Fresh, s.res.Tor = cfg().FreshConns, cfg().Tor
+	s.res.Paced = cfg().Pace
+	s.paceDown, s.paceUp = newPacer(cfg().Pace), newPacer(cfg().Pace)
+	s.res.Method = methodology(r, s.res.Streams)
+	sessions.Lock()
+	ttl := sessionTTL()
+	for id, o := range sessions.m {
+		if time.Since(o.res.Time) > ttl {
+			delete(sessions.m, id)
+		}
+	}
+	if len(sessions.m) >= sessionCap() {
+		var old *session
+		for _, o := range sessions.m {
+			if old == nil || o.res.Time.Before(old.res.Time) {
+				old = o
+			}
+		}
+		delete(sessions.m, old.res.ID)
+	}
+	sessions.m[s.res.ID] = s
+	sessions.Unlock()
+	eachSubsystem(func(x subsystem) {
+		if x.begin != nil {
+			x.begin(s)
+		}
+	})
+	return s
+}
+
+func getSession(id string) *session {
+	if id == "" {
+		return nil
+	}
+	sessions.Lock()
+	defer sessions.Unlock()
+	return sessions.m[id]
+}
+
+// snapshot returns a copy of the session's result that is safe to read.
+// update changes the result under the session lock, for subsystems that
+// measure something of their own.
+func (s *session) update(f func(*result)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(&s.res)
+	s.changed()
+}
+
+// changed wakes everyone waiting on the session; callers hold s.mu.
+func (s *session) changed() {
+	if s.wake != nil {
+		close(s.wake)
+		s.wake = nil
+	}
+}
+
+// await waits until ready holds for the result, ctx is done or d has
+// passed, and returns the result as it stands. Waiters sleep on a channel
+// that the next change closes, so they cost nothing while nothing happens.
+func (s *session) await(ctx context.Context, d time.Duration, ready func(*result) bool) result {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	for {
+		s.mu.Lock()
+		if ready(&s.res) {
+			s.mu.Unlock()
+			return s.snapshot()
+		}
+		if s.wake == nil {
+			s.wake = make(chan struct{})
+		}
+		wake := s.wake
+		s.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return s.snapshot()
+		case <-t.C:
+			return s.snapshot()
+		}
+	}
+}
+
+func (s *session) snapshot() result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.res
+	r.Pings = append([]float64(nil), r.Pings...)
+	r.LoadPings = append([]float64(nil), r.LoadPings...)
+	r.ICMP = append([]float64(nil), r.ICMP...)
+	r.Timings = append([]timing(nil), r.Timings...)
+	r.DownSeries = append([]int64(nil), s.downS.b...)
+	r.UpSeries = append([]int64(nil), s.upS.b...)
+	if !r.Done && r.Down <= 0 {
+		// no script to report the download (the no-JS and text tests), or
+		// not yet: the server's side of it is all there is
+		r.Down = r.ServerDown
+	}
+	if len(r.DownSeries)+len(r.UpSeries) > 0 {
+		r.SampleMs = int(sampleEvery / time.Millisecond)
+	}
+	return r
+}
+
+// recordDown and recordUp add one transfer to the session; phase names an
+// operator-defined download phase, "" the main download. When the browser
+// sizes the download adaptively, each attempt is a new round and only the
+// last one counts.
+func (s *session) recordDown(phase string, round int, m *meter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record(m.timing("download", phase, round))
+	if phase == "" && round == s.round {
+		s.downS.add(m)
+		if s.dispatched.IsZero() || m.start.Before(s.dispatched) {
+			s.dispatched = m.start
+		}
+	}
+}
+
+// noteFollowUp takes the first request a no-JS test's browser makes after
+// its download (the upload form, the text test's next step, a click
+// through to the result) as the moment the download had arrived. From
+// the download's dispatch to then is a wall-clock figure as the client
+// saw it: slower than the truth by however long the user took, but never
+// flattered by the socket buffers the server's write speed can run ahead
+// into.
+func (s *session) noteFollowUp(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.noJS || s.res.WallSecs > 0 || s.dispatched.IsZero() || !t.After(s.down.end) {
+		return
+	}
+	secs := t.Sub(s.dispatched).Seconds()
+	s.res.WallSecs, s.res.WallDown = secs, float64(s.down.bytes)/secs
+	s.changed()
+}
+
+func (s *session) recordUp(m *meter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record(m.timing("upload", "", 0))
+	s.upS.add(m)
+}
+
+// record logs t and adds it to the session's figures; callers hold s.mu.
+// It's everything the server knows about a request, so replaying a stored
+// session's timings rebuilds the same server-side numbers.
+func (s *session) record(t timing) {
+	defer s.changed()
+	if len(s.res.Timings) < maxTimings {
+		s.res.Timings = append(s.res.Timings, t)
+	}
+	start, n, end := t.Start.Add(time.Duration(t.WarmupSecs*float64(time.Second))), t.Bytes-t.WarmupBytes, t.End
+	if t.Wire > 0 {
+		n = t.Wire - t.WarmupBytes
+	}
+	if t.Acked > 0 {
+		n, end = t.Acked-t.WarmupBytes, t.Start.Add(time.Duration(t.AckedSecs*float64(time.Second)))
+	}
+	switch t.Kind {
+	case "probe":
+		s.res.ProbesSeen++
+	case "upload":
+		s.up.add(start, end, n)
+		s.res.UpBytes = s.up.bytes
+		s.res.Up = s.up.bps()
+	case "download":
+		s.recordDownload(t.Phase, t.Round, start, end, n)
+	}
+}
+
+func (s *session) recordDownload(phase string, round int, start, end time.Time, n int64) {
+	if phase != "" {
+		if s.phases == nil {
+			s.phases = map[string]*span{}
+		}
+		p := s.phases[phase]
+		if p == nil {
+			p = &span{}
+			s.phases[phase] = p
+		}
+		p.add(start, end, n)
+		return
+	}
+	if round < s.round {
+		return
+	}
+	if round > s.round {
+		s.down, s.downS, s.round = span{}, series{}, round
+	}
+	s.down.add(start, end, n)
+	s.res.DownBytes = s.down.bytes
+	s.res.ServerDown = s.down.bps()
+}
+
+// admit applies the budget, queue and per-IP limits to a new test and
+// answers the request itself if the test can't run.
+func admit(w http.ResponseWriter, r *http.Request) bool {
+	ip := limitIP(r)
+	if budget.exhausted() || q.pos(ip) > 0 {
+		busy(w)
+		return false
+	}
+	if !perIP.allow(limitIP(r)) {
+		tooMany(w, perIP.wait(limitIP(r)))
+		return false
+	}
+	return true
+}
+
+// recordPing notes a ping arriving: kind is "ping", "loaded-ping" for
+// the ones sent while the download saturates the link, or "probe" for the
+// loss probe burst.
+func (s *session) recordPing(r *http.Request, t time.Time, kind string) {
+	id, reused := connStat(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record(timing{Kind: kind, Start: t, End: t, Conn: id, Reused: reused, Req: requestID(r)})
+}
+
+// recentResults returns the tests still running and the last n finished
+// ones (from the ring, so they outlive their sessions), newest first,
+// without the bulky per-request detail.
+func recentResults(n int) (running, done []result) {
+	sessions.Lock()
+	all := make([]*session, 0, len(sessions.m))
+	for _, s := range sessions.m {
+		all = append(all, s)
+	}
+	sessions.Unlock()
+	for _, s := range all {
+		if r := s.snapshot(); !r.Done && time.Since(r.Time) < 5*time.Minute {
+			r.Pings, r.LoadPings, r.ProbeTTFB, r.Timings, r.DownSeries, r.UpSeries = nil, nil, nil, nil, nil, nil
+			running = append(running, r)
+		}
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].Time.After(running[j].Time) })
+	return running, recent.last(n)
+}
+
+func startTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !admit(w, r) {
+		return
+	}
+	s := newSession(r)
+	n, gap := pingPlan(r)
+	if cfg().FreshConns {
+		// so the first ping doesn't ride on this connection either
+		w.Header().Set("Connection", "close")
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"id": s.res.ID, "pings": n, "ping_gap_ms": gap.Milliseconds()})
+}
+
+// methodology fingerprints everything that shapes a test's numbers (which
+// test, streams, sizing, warm-up, pings, probes, phases) as a short hash,
+// so results from differently configured instances, or from the same one
+// before and after a change, don't pass for like with like.
+func methodology(r *http.Request, streams int) string {
+	n, gap := pingPlan(r)
+	s := fmt.Sprintf("v1 %s streams=%d target=%s duration=%s max=%d warmup=%s pings=%d gap=%s probes=%d chunk=%d flush=%d fresh=%t",
+		r.URL.Path, streams, targetTime(r), min(cfg().Duration, maxDuration), maxDownload(), &cfg().Warmup,
+		n, gap, max(0, min(cfg().LossProbes, maxProbes)), chunkSize(), cfg().FlushEvery, cfg().FreshConns)
+	for _, p := range cfg().Phases {
+		s += fmt.Sprintf(" phase=%q/%d/%d/%g", p.Name, p.Size, p.Streams, float64(p.Pacing))
+	}
+	if cfg().Tor {
+		s += " tor"
+	}
+	if cfg().Pace > 0 {
+		s += fmt.Sprintf(" pace=%g", float64(cfg().Pace))
+	}
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:6])
+}
+
+func torNote(res *result) string {
+	if !res.Tor {
+		return ""
+	}
+	return " · measured through Tor"
+}
+
+func methodNote(res *result) string {
+	if res.Method == "" {
+		return ""
+	}
+	return " · method " + res.Method
+}
+
+// pingPlan is how many idle pings the test sends and how far apart: the
+// -pings and -ping-gap defaults, or what the client asked for with
+// ?pings= and ?ping_gap=.
+func pingPlan(r *http.Request) (int, time.Duration) {
+	n, gap := cfg().Pings, cfg().PingGap
+	if v, err := strconv.Atoi(r.URL.Query().Get("pings")); err == nil {
+		n = v
+	}
+	if v, err := time.ParseDuration(r.URL.Query().Get("ping_gap")); err == nil {
+		gap = v
+	}
+	return max(1, min(n, maxPings)), max(0, min(gap, maxPingGap))
+}
+
+// doneTest takes the browser's side of the measurement and closes the
+// result.
+func doneTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	s := getSession(r.URL.Query().Get("sid"))
+	if s == nil {
+		http.NotFound(w, r)
+		return
+	}
+	var body report
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&body); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	closeTest(r, s, &body)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// closeTest finishes s with the browser's report and, the first time,
+// hands the result to the recent ring and the subsystems' done hooks.
+// The no-JavaScript tests have no report and pass an empty one.
+func closeTest(r *http.Request, s *session, body *report) {
+	if s.finish(body, cfg().Phases) {
+		res := s.snapshot()
+		recent.add(res)
+		eachSubsystem(func(x subsystem) {
+			if x.done != nil {
+				x.done(r, &res)
+			}
+		})
+	}
+}
+
+// report is the browser's side of a test, posted to /done.
+type report struct {
+	Pings  []float64 `json:"pings"`
+	Loaded []float64 `json:"loaded"`
+	Probes struct {
+		Sent       int     `json:"sent"`
+		OK         int     `json:"ok"`
+		DeadlineMs float64 `json:"deadline_ms"`
+	} `json:"probes"`
+	Conn struct {
+		TCP  float64 `json:"tcp_ms"`
+		TLS  float64 `json:"tls_ms"`
+		HTTP float64 `json:"http_ms"`
+	} `json:"conn"`
+	TTFB struct {
+		Probes []float64 `json:"probes"`
+		Down   []float64 `json:"download"`
+	} `json:"ttfb"`
+	Down   float64            `json:"down"`
+	Up     float64            `json:"up"`
+	Phases map[string]float64 `json:"phases"`
+}
+
+// finish combines the browser's report with the server's figures into the
+// final result and reports whether this closed the session.
+func (s *session) finish(body *report, phases []phase) bool {
+	body.Pings, body.Loaded = body.Pings[:min(len(body.Pings), 1000)], body.Loaded[:min(len(body.Loaded), 1000)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.changed()
+	s.res.Pings = body.Pings
+	s.res.Ping, s.res.Jitter = meanSD(body.Pings)
+	s.res.JitterRFC = interarrivalJitter(body.Pings)
+	s.res.PingStats = spreadOf(body.Pings)
+	s.res.LoadPings = body.Loaded
+	s.res.LoadPing, _ = meanSD(body.Loaded)
+	s.res.LoadStats = spreadOf(body.Loaded)
+	if p := body.Probes; p.Sent > 0 && p.Sent <= maxProbes && p.OK >= 0 && p.OK <= p.Sent {
+		s.res.Probes, s.res.ProbesOK, s.res.ProbeMs = p.Sent, p.OK, p.DeadlineMs
+	}
+	if c := body.Conn; c.TCP >= 0 && c.TLS >= 0 && c.HTTP >= 0 {
+		s.res.TCPMs, s.res.TLSMs, s.res.HTTPMs = c.TCP, c.TLS, c.HTTP
+	}
+	s.res.ProbeTTFB, s.res.DownTTFB = nonNegative(body.TTFB.Probes, maxProbes), nonNegative(body.TTFB.Down, 64)
+	s.res.Down = body.Down
+	if s.res.Down <= 0 {
+		s.res.Down = s.res.ServerDown
+	}
+	s.res.ClientUp = body.Up
+	if s.res.Up <= 0 {
+		s.res.Up = body.Up
+	}
+	s.res.Phases = nil
+	for _, p := range phases {
+		sp := s.phases[p.Name]
+		if sp == nil {
+			continue
+		}
+		pr := phaseResult{Name: p.Name, Streams: p.Streams, Bytes: sp.bytes, Down: body.Phases[p.Name], ServerDown: sp.bps(), Via: p.Via}
+		if pr.Down <= 0 {
+			pr.Down = pr.ServerDown
+		}
+		s.res.Phases = append(s.res.Phases, pr)
+	}
+	first := !s.res.Done
+	s.res.Done = true
+	return first
+}
+
+// nonNegative returns at most the first n of v, or nil if any is negative.
+func nonNegative(v []float64, n int) []float64 {
+	v = v[:min(len(v), n)]
+	for _, x := range v {
+		if x < 0 || math.IsNaN(x) {
+			return nil
+		}
+	}
+	return v
+}
+
+// maxWait caps how long a result request may wait for the test to finish.
+const maxWait = 30 * time.Second
+
+func resultJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		deleteResult(w, r, strings.TrimPrefix(r.URL.Path, "/api/v1/result/"))
+		return
+	}
+	s := getSession(strings.TrimPrefix(r.URL.Path, "/api/v1/result/"))
+	if s == nil {
+		http.NotFound(w, r)
+		return
+	}
+	// ?wait=30s holds the answer until the test is done (or the time is
+	// up), so a script can start a test and fetch its result in one go
+	var res result
+	if d, err := time.ParseDuration(r.URL.Query().Get("wait")); err == nil && d > 0 {
+		if cfg().RequestTimeout > 0 {
+			holdOpen(w, maxWait+cfg().RequestTimeout)
+		}
+		res = s.await(r.Context(), min(d, maxWait), func(r *result) bool { return r.Done })
+	} else {
+		res = s.snapshot()
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&res)
+}
+
+// resultCard draws /r/<id>.png when the card subsystem is built in.
+var resultCard func(http.ResponseWriter, *http.Request, *result)
+
+func resultPage(w http.ResponseWriter, r *http.Request) {
+	if id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/r/"), "/delete"); ok {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		deleteResult(w, r, id)
+		return
+	}
+	id, card := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/r/"), ".png")
+	s := getSession(id)
+	if s == nil || card && resultCard == nil {
+		http.Error(w, "No such result (results are kept for "+sessionTTL().String()+").", http.StatusNotFound)
+		return
+	}
+	if r.URL.Query().Get("auto") == "" {
+		// the no-JS page's timed refresh says nothing about the download
+		s.noteFollowUp(time.Now())
+	}
+	res := s.snapshot()
+	res.unit, res.loc, res.brand = speedUnit(w, r), pageLocale(r), brandFor(r)
+	if card {
+		resultCard(w, r, &res)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if !res.Done && res.DownBytes == 0 && time.Since(res.Time) < pendingFor() {
+		pendingPage(w, r, &res)
+		return
+	}
+	if textUI(r) {
+		writeTextResult(w, r, &res)
+		return
+	}
+	writeResult(w, &res)
+}
+
+// pendingFor is how long after a test starts its result page keeps
+// saying it's still measuring, rather than show an empty result.
+func pendingFor() time.Duration {
+	if cfg().Tor {
+		return 5 * time.Minute
+	}
+	return 2 * time.Minute
+}
+
+// pendingPage stands in for a result whose download hasn't been recorded
+// yet. It refreshes itself instead of the handler holding the request
+// open, which proxies with short timeouts would cut off.
+func pendingPage(w http.ResponseWriter, r *http.Request, res *result) {
+	b := brandFor(r)
+	if textUI(r) {
+		// terminal browsers get the link alone
+		io.WriteString(w, textHead+b.name()+` (measuring)</title></head><body>
+<h1>`+b.name()+`</h1>
+<p>Still measuring. <a href="/r/`+res.ID+html.EscapeString(textQuery(r, "?"))+`">Check again</a></p>
+</body></html>`)
+		return
+	}
+	w.Header().Set("Refresh", "2")
+	io.WriteString(w, `<!doctype html>
+<html><head><meta charset="utf-8"><title>`+b.name()+` (measuring)</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Arial;max-width:760px;margin:1rem}</style>
+</head><body>
+<h2>`+b.heading(b.name())+`</h2>
+<p>Still measuring. This page refreshes by itself and shows the result once the download is in.</p>
+<p><a href="/r/`+res.ID+`">Refresh now</a></p>
+</body></html>`)
+}
+
+func writeResult(w io.Writer, res *result) {
+	extra := ""
+	eachSubsystem(func(sub subsystem) {
+		if sub.result != nil {
+			extra += sub.result(res)
+		}
+	})
+	title := res.brand.name() + " result"
+	if res.Label != "" {
+		title += ": " + html.EscapeString(res.Label)
+	}
+	io.WriteString(w, `<!doctype html>
+<html><head><meta charset="utf-8"><meta name="robots" content="noindex"><title>`+title+`</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Arial;max-width:760px;margin:1rem}td{padding:0 1rem 0 0}</style>
+</head><body>
+<h2>`+res.brand.heading(title)+`</h2>
+<p>`+hostNote(res.IP, " · ")+res.loc.when(res.Time)+servedBy(res)+torNote(res)+pacedNote(res)+methodNote(res)+`</p>
+`+resultTable(res)+extra+unitSwitch(res.unit)+`<p><a href="/">Run another test</a> · <a href="/api/v1/result/`+res.ID+`">Raw data (JSON)</a></p>
+<form method="post" action="/r/`+res.ID+`/delete"><button>Delete this result</button> <small>from this server, for good</small></form>
+`+res.brand.about()+`</body></html>`)
+}
+
+// servedBy names the site and server that ran the test, for deployments
+// behind anycast or GeoDNS.
+func servedBy(res *result) string {
+	switch {
+	case res.POP != "" && res.Server != "":
+		return " · served by " + html.EscapeString(res.POP) + " (" + html.EscapeString(res.Server) + ")"
+	case res.POP != "" || res.Server != "":
+		return " · served by " + html.EscapeString(res.POP+res.Server)
+	}
+	return ""
+}
+
+// bloatGrade rates how much the latency rises while the download fills the
+// link (bufferbloat), from A+ (barely) to F.
+func bloatGrade(idle, loaded float64) string {
+	d := loaded - idle
+	for _, g := range []struct {
+		ms    float64
+		grade string
+	}{{5, "A+"}, {30, "A"}, {60, "B"}, {200, "C"}, {400, "D"}} {
+		if d < g.ms {
+			return g.grade
+		}
+	}
+	return "F"
+}
+
+func rfcJitter(r *result) string {
+	if len(r.Pings) < 2 {
+		return ""
+	}
+	return " (RFC 3550: " + r.loc.num(r.JitterRFC, 2) + " ms)"
+}
+
+// spreadRow shows the ping's distribution, which a couple of outliers
+// can't skew the way they do the mean.
+func spreadRow(r *result) string {
+	p := r.PingStats
+	if p == nil {
+		return ""
+	}
+	f := func(v float64) string { return r.loc.num(v, 2) }
+	return `<tr><td>Ping spread</td><td>min ` + f(p.Min) + `, median ` + f(p.Median) + `, p95 ` + f(p.P95) + `, p99 ` + f(p.P99) + `, max ` + f(p.Max) + ` ms</td></tr>
+`
+}
+
+// connRow splits the page load's connection setup from the HTTP latency
+// the ping measures over the already open connection.
+func connRow(r *result) string {
+	if r.TCPMs <= 0 && r.HTTPMs <= 0 {
+		return ""
+	}
+	ms := func(v float64) string { return r.loc.num(v, 2) + " ms" }
+	s := "TCP handshake " + ms(r.TCPMs)
+	if r.TLSMs > 0 {
+		s += ", TLS handshake " + ms(r.TLSMs)
+	}
+	return `<tr><td>Connection setup</td><td>` + s + `, first request ` + ms(r.HTTPMs) + `</td></tr>
+`
+}
+
+// acceptRow is the server's view of the same connections: how long each
+// took from being accepted to sending its first byte.
+func acceptRow(r *result) string {
+	if len(r.AcceptMs) == 0 {
+		return ""
+	}
+	avg, _ := meanSD(r.AcceptMs)
+	hi := 0.0
+	for _, v := range r.AcceptMs {
+		hi = max(hi, v)
+	}
+	n := strconv.Itoa(len(r.AcceptMs)) + " connections"
+	if len(r.AcceptMs) == 1 {
+		n = "1 connection"
+	}
+	return `<tr><td>Accept to first byte</td><td>` + r.loc.num(avg, 2) + ` ms average, ` + r.loc.num(hi, 2) + ` ms max (` + n + `, seen by the server)</td></tr>
+`
+}
+
+// tcpRow sums up the kernel's figures for the main download's connections,
+// whose retransmits explain a lot of low speeds.
+func tcpRow(r *result) string {
+	round := 0
+	for _, t := range r.Timings {
+		if t.Kind == "download" && t.Phase == "" {
+			round = max(round, t.Round)
+		}
+	}
+	var n, retrans, segs, ecn, marked int
+	var rtt, minRTT float64
+	for _, t := range r.Timings {
+		if t.Kind != "download" || t.Phase != "" || t.Round != round || t.TCP == nil {
+			continue
+		}
+		n++
+		rtt += t.TCP.RTTMs
+		if t.TCP.MinRTTMs > 0 && (minRTT == 0 || t.TCP.MinRTTMs < minRTT) {
+			minRTT = t.TCP.MinRTTMs
+		}
+		retrans += t.TCP.Retrans
+		segs += t.TCP.SegsOut
+		if t.TCP.ECN {
+			ecn++
+		}
+		marked += t.TCP.DeliveredCE
+	}
+	if n == 0 {
+		return ""
+	}
+	ms := func(v float64) string { return r.loc.num(v, 2) + " ms" }
+	s := "RTT " + ms(rtt/float64(n))
+	if minRTT > 0 {
+		s += " (min " + ms(minRTT) + ")"
+	}
+	s += ", " + strconv.Itoa(retrans) + " segments retransmitted"
+	if segs > 0 {
+		s += " of " + strconv.Itoa(segs) + " (" + r.loc.num(float64(retrans)*100/float64(segs), 2) + "%)"
+	}
+	if n > 1 {
+		s += " over " + strconv.Itoa(n) + " connections"
+	}
+	switch {
+	case marked > 0:
+		s += ", ECN on with " + strconv.Itoa(marked) + " segments congestion-marked (a queue on the path marks instead of dropping)"
+	case ecn > 0:
+		s += ", ECN on, no congestion marks"
+	default:
+		s += ", ECN not negotiated"
+	}
+	return `<tr><td>TCP (server side)</td><td>` + s + `</td></tr>
+`
+}
+
+func bloatRow(r *result) string {
+	if len(r.LoadPings) == 0 {
+		return ""
+	}
+	d := r.loc.num(max(r.LoadPing-r.Ping, 0), 2)
+	return `<tr><td>Ping under load</td><td>` + r.loc.num(r.LoadPing, 2) + ` ms (+` + d + ` ms, bufferbloat grade <strong>` + bloatGrade(r.Ping, r.LoadPing) + `</strong>)</td></tr>
+`
+}
+
+func probeRow(r *result) string {
+	if r.Probes == 0 {
+		return ""
+	}
+	lost := r.Probes - r.ProbesOK
+	s := strconv.Itoa(r.ProbesOK) + " of " + strconv.Itoa(r.Probes) + " answered within " + r.loc.num(r.ProbeMs, 0) + " ms (" + r.loc.num(float64(lost)*100/float64(r.Probes), 0) + "% lost or late"
+	if r.ProbesSeen < r.Probes {
+		s += ", " + strconv.Itoa(r.Probes-r.ProbesSeen) + " never reached the server"
+	}
+	return `<tr><td>Small requests</td><td>` + s + `)</td></tr>
+`
+}
+
+// ttfbRow shows how long requests waited for their first byte, which is
+// what makes browsing feel slow even when the bandwidth is fine.
+func ttfbRow(r *result) string {
+	var parts []string
+	for _, v := range []struct {
+		name string
+		ms   []float64
+	}{{"small requests", r.ProbeTTFB}, {"download", r.DownTTFB}} {
+		if len(v.ms) == 0 {
+			continue
+		}
+		lo, hi := v.ms[0], v.ms[0]
+		for _, x := range v.ms {
+			lo, hi = min(lo, x), max(hi, x)
+		}
+		avg, _ := meanSD(v.ms)
+		f := func(x float64) string { return r.loc.num(x, 2) }
+		parts = append(parts, v.name+" "+f(lo)+" / "+f(avg)+" / "+f(hi)+" ms")
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return `<tr><td>Time to first byte</td><td>` + strings.Join(parts, ", ") + ` (min / avg / max)</td></tr>
+`
+}
+
+func resultTable(r *result) string {
+	ms := func(v float64) string { return r.loc.num(v, 2) + " ms" }
+	return `<table>
+<tr><td>Ping</td><td>` + ms(r.Ping) + pingConnNote(r) + `</td></tr>
+<tr><td>Jitter</td><td>` + ms(r.Jitter) + rfcJitter(r) + `</td></tr>
+` + spreadRow(r) + connRow(r) + acceptRow(r) + bloatRow(r) + probeRow(r) + ttfbRow(r) + `<tr><td>Download</td><td>` + r.loc.speed(r.unit, r.Down) + streamNote(r) + `</td></tr>
+` + wallRow(r) + tcpRow(r) + phaseRows(r) + `<tr><td>Upload</td><td>` + r.loc.speed(r.unit, r.Up) + `</td></tr>
+</table>
+` + pathNote(r)
+}
+
+// pingConnNote says how the pings reached the server when it isn't the
+// usual keep-alive connection: with -fresh-conns a new one each time,
+// which puts the handshake in every ping, or partly new ones when the
+// browser opened more.
+func pingConnNote(r *result) string {
+	if r.Fresh {
+		return " (a new connection for each)"
+	}
+	n, fresh := 0, 0
+	for _, t := range r.Timings {
+		if t.Kind == "ping" && t.Conn != 0 {
+			n++
+			if !t.Reused {
+				fresh++
+			}
+		}
+	}
+	if fresh == 0 {
+		return ""
+	}
+	return " (" + strconv.Itoa(fresh) + " of " + strconv.Itoa(n) + " on a new connection)"
+}
+
+func phaseRows(r *result) string {
+	s := ""
+	for _, p := range r.Phases {
+		s += "<tr><td>" + html.EscapeString(p.Name) + "</td><td>" + r.loc.speed(r.unit, p.Down)
+		if p.Streams > 1 {
+			s += " (" + strconv.Itoa(p.Streams) + " streams)"
+		}
+		if p.Via != "" {
+			s += " via " + html.EscapeString(p.Via)
+		}
+		s += "</td></tr>\n"
+	}
+	return s
+}
+
+// pathNote compares the phases sent over different uplinks, fastest first.
+func pathNote(r *result) string {
+	var ps []phaseResult
+	for _, p := range r.Phases {
+		if p.Via != "" {
+			ps = append(ps, p)
+		}
+	}
+	if len(ps) < 2 {
+		return ""
+	}
+	sort.SliceStable(ps, func(i, j int) bool { return ps[i].Down > ps[j].Down })
+	s := "<p>Transit paths: " + html.EscapeString(ps[0].Name) + " is fastest"
+	for _, p := range ps[1:] {
+		if p.Down > 0 {
+			s += ", " + r.loc.num((ps[0].Down/p.Down-1)*100, 0) + "% ahead of " + html.EscapeString(p.Name)
+		}
+	}
+	return s + ".</p>\n"
+}
+
+// phasesJSON lists the custom phases for the test page script.
+func phasesJSON() string {
+	type p struct {
+		Name    string `json:"name"`
+		Streams int    `json:"streams"`
+		Base    string `json:"base,omitempty"`
+	}
+	ps := []p{}
+	for _, x := range cfg().Phases {
+		ps = append(ps, p{x.Name, x.Streams, x.base()})
+	}
+	b, _ := json.Marshal(ps)
+	return string(b)
+}
+
+// streams is the number of parallel download streams r asks for.
+func streams(r *http.Request) int {
+	n, err := strconv.Atoi(r.URL.Query().Get("streams"))
+	if err != nil || n < 1 {
+		n = defaultStreams(r)
+	}
+	return max(1, min(n, 16))
+}
+
+// defaultStreams is -streams, or r's vhost's.
+func defaultStreams(r *http.Request) int {
+	if v := hostOf(r); v != nil && v.Streams > 0 {
+		return v.Streams
+	}
+	return cfg().Streams
+}
+
+// wallRow is the no-JS test's client-side figure next to the server's.
+func wallRow(r *result) string {
+	if r.WallSecs <= 0 {
+		return ""
+	}
+	return `<tr><td>Download, as received</td><td>at least ` + r.loc.speed(r.unit, r.WallDown) + ` (` + r.loc.num(r.WallSecs, 1) + ` s from the download's start to your next click)</td></tr>
+`
+}
+
+func streamNote(r *result) string {
+	if r.Streams > 1 {
+		return " (" + strconv.Itoa(r.Streams) + " streams)"
+	}
+	return ""
+}
+
+func clip(s string, n int) string {
+	if len(s) > n {
+		return strings.ToValidUTF8(s[:n], "")
+	}
+	return s
+}
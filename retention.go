@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Blurr keeps results only in memory, so a restart forgets them all.
+// Short of that the longest-lived copies (the recent ring, history,
+// household groups) can outlast what an operator is allowed to keep:
+// -retention-days drops every result older than that once an hour, and
+// purge does it on demand, from /admin or for a single result its owner
+// deletes.
+
+func startRetention() {
+	if cfg().RetentionDays <= 0 {
+		return
+	}
+	go func() {
+		for {
+			if n := purgeOlder(cfg().RetentionDays); n > 0 {
+				log.Printf("retention: dropped %d results older than %d days", n, cfg().RetentionDays)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// purgeOlder drops the results older than days (all of them if days is 0).
+func purgeOlder(days int) int {
+	cut := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	return purge(func(r *result) bool { return days > 0 && r.Time.After(cut) })
+}
+
+// purge drops, everywhere they're kept, the results keep says no to, and
+// returns how many tests that was.
+func purge(keep func(*result) bool) int {
+	gone := map[string]bool{}
+	sessions.Lock()
+	for id, s := range sessions.m {
+		if r := s.snapshot(); !keep(&r) {
+			delete(sessions.m, id)
+			gone[id] = true
+		}
+	}
+	sessions.Unlock()
+	for _, id := range recent.drop(keep) {
+		gone[id] = true
+	}
+	eachSubsystem(func(s subsystem) {
+		if s.purge != nil {
+			for _, id := range s.purge(keep) {
+				gone[id] = true
+			}
+		}
+	})
+	return len(gone)
+}
+
+// deleteResult answers DELETE /api/v1/result/<id> and the delete button
+// on the result page. The ID is all it takes, as it is to see the result.
+func deleteResult(w http.ResponseWriter, r *http.Request, id string) {
+	b := brandFor(r)
+	n := 0
+	if id != "" {
+		n = purge(func(res *result) bool { return res.ID != id })
+	}
+	if n == 0 {
+		http.Error(w, "No such result.", http.StatusNotFound)
+		return
+	}
+	log.Printf("result %s deleted on request req=%s", id, requestID(r))
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(`<!doctype html>
+<html><head><meta charset="utf-8"><title>` + b.name() + ` (deleted)</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Arial;max-width:760px;margin:1rem}</style>
+</head><body>
+<h2>` + b.heading(b.name()) + `</h2>
+<p>The result has been deleted from this server.</p>
+<p><a href="/">Run another test</a></p>
+</body></html>`))
+}
@@ -0,0 +1,73 @@
+//go:build !minimal && !norobots
+
+package main
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"regexp"
+)
+
+// Crawlers that follow every link would start real tests and fetch
+// multi-megabyte downloads. robots.txt keeps the well-behaved ones away from
+// the tests and results, X-Robots-Tag keeps results out of search indexes, and
+// -block-agents turns away the rest by User-Agent.
+const robotsTxt = `User-agent: *
+Disallow: /download
+Disallow: /upload
+Disallow: /ping
+Disallow: /multi
+Disallow: /pair
+Disallow: /start
+Disallow: /demo.bin
+Disallow: /api/
+Disallow: /ndt/
+Disallow: /r/
+Disallow: /history
+Disallow: /household
+Disallow: /compare
+Disallow: /admin
+`
+
+var blockAgents *regexp.Regexp
+
+func init() {
+	register(subsystem{
+		name: "robots",
+		flags: func() {
+			flag.StringVar(&settings.BlockAgents, "block-agents", settings.BlockAgents, "refuse tests to clients whose User-Agent matches this regular expression, e.g. \"(?i)bot|crawl|spider\"")
+		},
+		start: func() {
+			if cfg().BlockAgents == "" {
+				return
+			}
+			re, err := regexp.Compile(cfg().BlockAgents)
+			if err != nil {
+				mustFix("-block-agents: "+err.Error(), "Fix the regular expression, e.g. \"(?i)bot|crawl|spider\".")
+				return
+			}
+			blockAgents = re
+		},
+		routes: func(m *http.ServeMux) {
+			m.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				io.WriteString(w, robotsTxt)
+			})
+		},
+		wrap: robotsWrap,
+	})
+}
+
+func robotsWrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/robots.txt" {
+			w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+		}
+		if blockAgents != nil && blockAgents.MatchString(r.UserAgent()) && isTestPath(r.URL.Path) {
+			http.Error(w, "Automated clients can't run tests here.", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,157 @@
+//go:build !minimal && !noservice
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// "blurr service install [flags]" registers Blurr with the Windows service
+// manager, to start with the machine on a spare box; start, stop and
+// uninstall do what they say. The service runs "blurr service run
+// [flags]", which talks to the service manager itself (advapi32 through
+// syscall, as the standard library has no package for it) and stops the
+// server the same way Ctrl+C does.
+const svcName = "Blurr"
+
+func init() {
+	register(subsystem{name: "service", cmd: "service", run: runService})
+}
+
+func runService(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: blurr service install [flags] | uninstall | start | stop")
+		os.Exit(2)
+	}
+	var err error
+	switch args[0] {
+	case "install":
+		err = svcInstall(args[1:])
+	case "uninstall":
+		err = sc("delete", svcName)
+	case "start", "stop":
+		err = sc(args[0], svcName)
+	case "run":
+		os.Args = append(os.Args[:1], args[1:]...)
+		err = svcDispatch()
+	default:
+		err = fmt.Errorf("unknown service command %q", args[0])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "service:", err)
+		os.Exit(1)
+	}
+}
+
+func sc(args ...string) error {
+	cmd := exec.Command("sc.exe", args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// svcInstall registers the service with flags as its command line. With
+// no console to write to, the log goes next to the binary unless -log says
+// otherwise.
+func svcInstall(flags []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	hasLog := false
+	for _, f := range flags {
+		hasLog = hasLog || f == "-log" || f == "--log" || strings.HasPrefix(f, "-log=") || strings.HasPrefix(f, "--log=")
+	}
+	if !hasLog {
+		flags = append(flags, "-log", filepath.Join(filepath.Dir(exe), "blurr.log"))
+	}
+	line := []string{syscall.EscapeArg(exe), "service", "run"}
+	for _, f := range flags {
+		line = append(line, syscall.EscapeArg(f))
+	}
+	if err := sc("create", svcName, "binPath=", strings.Join(line, " "), "start=", "auto", "DisplayName=", "Blurr speed test"); err != nil {
+		return err
+	}
+	return sc("description", svcName, "Blurr network speed test server")
+}
+
+var (
+	advapi32                = syscall.NewLazyDLL("advapi32.dll")
+	procStartDispatcher     = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterCtrlHandler = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus    = advapi32.NewProc("SetServiceStatus")
+)
+
+const (
+	svcOwnProcess   = 0x10
+	svcStopped      = 1
+	svcStartPending = 2
+	svcStopPending  = 3
+	svcRunning      = 4
+	svcAcceptStop   = 1
+	svcAcceptShut   = 4
+	svcCtlStop      = 1
+	svcCtlShutdown  = 5
+
+	errNoServiceManager = 1063 // ERROR_FAILED_SERVICE_CONTROLLER_CONNECT
+)
+
+type svcStatus struct {
+	Type, State, Accepts, ExitCode, SpecificExitCode, CheckPoint, WaitHint uint32
+}
+
+type svcTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+var svcHandle uintptr
+
+func svcSet(state, accepts, waitMs uint32) {
+	st := svcStatus{Type: svcOwnProcess, State: state, Accepts: accepts, WaitHint: waitMs}
+	procSetServiceStatus.Call(svcHandle, uintptr(unsafe.Pointer(&st)))
+}
+
+// svcDispatch hands the process to the service manager, which calls
+// svcMain; it returns once the service has stopped.
+func svcDispatch() error {
+	name, _ := syscall.UTF16PtrFromString(svcName)
+	table := []svcTableEntry{{name, syscall.NewCallback(svcMain)}, {}}
+	if ok, _, err := procStartDispatcher.Call(uintptr(unsafe.Pointer(&table[0]))); ok == 0 {
+		if errors.Is(err, syscall.Errno(errNoServiceManager)) {
+			return errors.New(`"run" is for the service manager; use "blurr service start", or run blurr without "service" in a console`)
+		}
+		return err
+	}
+	return nil
+}
+
+func svcMain(argc, argv uintptr) uintptr {
+	name, _ := syscall.UTF16PtrFromString(svcName)
+	svcHandle, _, _ = procRegisterCtrlHandler.Call(uintptr(unsafe.Pointer(name)), syscall.NewCallback(svcControl), 0)
+	svcSet(svcStartPending, 0, 10000)
+	done := make(chan struct{})
+	go func() {
+		runServer()
+		close(done)
+	}()
+	svcSet(svcRunning, svcAcceptStop|svcAcceptShut, 0)
+	<-done
+	svcSet(svcStopped, 0, 0)
+	return 0
+}
+
+func svcControl(ctrl, event, data, context uintptr) uintptr {
+	switch ctrl {
+	case svcCtlStop, svcCtlShutdown:
+		svcSet(svcStopPending, 0, uint32(cfg().ShutdownGrace.Milliseconds())+5000)
+		stop()
+	}
+	return 0
+}
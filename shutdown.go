@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Ctrl+C, SIGTERM (systemd, docker stop) or the Windows service manager
+// stop the server gracefully: it stops accepting connections and gives the
+// requests under way, the tests in them included, -shutdown-grace to
+// finish before closing what's left.
+var (
+	stopping = make(chan struct{})
+	stopOnce sync.Once
+)
+
+func stop() { stopOnce.Do(func() { close(stopping) }) }
+
+func watchSignals() {
+	c := make(chan os.Signal, 1)
+	// SIGTERM never arrives on Windows, but the name exists there too
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		stop()
+	}()
+}
+
+func shutdown(srv *http.Server) {
+	active, _ := q.stats()
+	log.Printf("shutting down: waiting up to %v for %d running test(s)", cfg().ShutdownGrace, active)
+	ctx, cancel := context.Background(), func() {}
+	if cfg().ShutdownGrace > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cfg().ShutdownGrace)
+	}
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v; closing the remaining connections", err)
+		srv.Close()
+	}
+	log.Println("stopped")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// A sink delivers messages to one outside destination: a chat room, a
+// mailbox, a webhook. Each has its own small queue worked by its own
+// goroutine, so a destination that's down never holds up a test or the
+// other destinations. A failed send is retried with backoff (30s doubling
+// to an hour) until it goes through or newer messages push it out, and
+// the outcome is reported to /readyz under the sink's name.
+type sink struct {
+	name   string
+	send   func(string) error
+	failed func(error) // called after each failed attempt, if set
+	mu     sync.Mutex
+	queue  []string
+	wake   chan struct{}
+}
+
+const sinkQueue = 20
+
+func newSink(name string, send func(string) error, failed func(error)) *sink {
+	s := &sink{name: name, send: send, failed: failed, wake: make(chan struct{}, 1)}
+	go s.run()
+	return s
+}
+
+// post queues msg, dropping the oldest message if the queue is full.
+func (s *sink) post(msg string) {
+	s.mu.Lock()
+	s.queue = append(s.queue, msg)
+	if len(s.queue) > sinkQueue {
+		s.queue = s.queue[1:]
+	}
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *sink) run() {
+	failures := 0
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			<-s.wake
+			continue
+		}
+		msg := s.queue[0]
+		s.mu.Unlock()
+		err := s.send(msg)
+		setHealth(s.name, err)
+		if err == nil {
+			failures = 0
+			s.mu.Lock()
+			if len(s.queue) > 0 && s.queue[0] == msg {
+				s.queue = s.queue[1:]
+			}
+			s.mu.Unlock()
+			continue
+		}
+		failures++
+		if s.failed != nil {
+			s.failed(err)
+		}
+		wait := backoff(failures, 30*time.Second, time.Hour)
+		log.Printf("%s: %v (retrying in %s)", s.name, err, wait)
+		time.Sleep(wait)
+	}
+}
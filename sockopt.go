@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"net"
+)
+
+// The kernel's default socket buffers and congestion control are tuned for
+// ordinary traffic and can cap a single stream well below what a long, fat
+// path carries. -sndbuf and -rcvbuf size the buffers, -congestion picks the
+// algorithm (Linux only) and -tcp-nodelay says whether small writes go out
+// at once. They apply to every listener, the -tcp-addr one included.
+
+// listen opens a tuned TCP listener on addr. Where the system lets the
+// listening socket pass its options on to the connections it accepts
+// (Linux), they're set here, before the handshake, so the window scale
+// can grow with the receive buffer; elsewhere tuneConn sets them on each
+// connection.
+func listen(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: tuneListener}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// tuneConn applies the options an accepted connection doesn't inherit.
+func tuneConn(c net.Conn) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tc.SetNoDelay(cfg().NoDelay)
+	if inheritsBuffers {
+		return
+	}
+	if cfg().SndBuf > 0 {
+		tc.SetWriteBuffer(int(cfg().SndBuf))
+	}
+	if cfg().RcvBuf > 0 {
+		tc.SetReadBuffer(int(cfg().RcvBuf))
+	}
+}
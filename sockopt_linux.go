@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+)
+
+const inheritsBuffers = true
+
+// tuneListener sets the buffers and congestion control on a listening
+// socket; accepted connections inherit them. The kernel doubles a buffer
+// size for its own bookkeeping and caps it at net.core.wmem_max or
+// net.core.rmem_max.
+func tuneListener(network, address string, c syscall.RawConn) error {
+	var err error
+	c.Control(func(fd uintptr) {
+		if cfg().SndBuf > 0 {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, int(cfg().SndBuf))
+		}
+		if cfg().RcvBuf > 0 && err == nil {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, int(cfg().RcvBuf))
+		}
+		if cfg().Congestion != "" && err == nil {
+			err = syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, cfg().Congestion)
+		}
+	})
+	return err
+}
+
+// checkCongestion turns -congestion off, as an optional problem, when the
+// kernel won't let this process pick the algorithm.
+func checkCongestion(c *config) {
+	if c.Congestion == "" {
+		return
+	}
+	b, err := os.ReadFile("/proc/sys/net/ipv4/tcp_allowed_congestion_control")
+	if err != nil {
+		return
+	}
+	allowed := strings.Fields(string(b))
+	for _, a := range allowed {
+		if a == c.Congestion {
+			return
+		}
+	}
+	if os.Geteuid() == 0 && available(c.Congestion) {
+		return
+	}
+	degraded("-congestion "+c.Congestion+": not allowed here (allowed: "+strings.Join(allowed, " ")+")",
+		"Load it (e.g. modprobe tcp_"+c.Congestion+") and add it to the net.ipv4.tcp_allowed_congestion_control sysctl, or pick an allowed one.")
+	c.Congestion = ""
+}
+
+func available(name string) bool {
+	b, _ := os.ReadFile("/proc/sys/net/ipv4/tcp_available_congestion_control")
+	for _, a := range strings.Fields(string(b)) {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+const inheritsBuffers = false
+
+func tuneListener(network, address string, c syscall.RawConn) error { return nil }
+
+func checkCongestion(c *config) {
+	if c.Congestion != "" {
+		degraded("-congestion: only supported on Linux", "Leave -congestion out, or set the system's default congestion control instead.")
+		c.Congestion = ""
+	}
+}
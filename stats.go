@@ -0,0 +1,303 @@
+//go:build !minimal && !nostats
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -stats publishes /stats: aggregates of the results in the recent ring
+// (tests per day, median speeds, how speeds are spread), so a public
+// instance can show its community what's typical. Nothing on it points
+// to a single test: no IDs, addresses or times finer than a day, and a
+// day with fewer than statsMinTests tests is left out.
+const (
+	statsDays     = 30
+	statsMinTests = 3
+)
+
+// statsBuckets are the histogram's upper bounds in MiB/s.
+var statsBuckets = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500}
+
+type statsDay struct {
+	Day   string  `json:"day"`
+	Tests int     `json:"tests"`
+	Down  float64 `json:"median_download_bps"`
+	Up    float64 `json:"median_upload_bps"`
+	Ping  float64 `json:"median_ping_ms"`
+	downs []float64
+	ups   []float64
+	pings []float64
+}
+
+type statsSummary struct {
+	Tests int        `json:"tests"`
+	Since time.Time  `json:"since,omitempty"`
+	Down  float64    `json:"median_download_bps"`
+	Up    float64    `json:"median_upload_bps"`
+	Ping  float64    `json:"median_ping_ms"`
+	Days  []statsDay `json:"days"`
+	// DownHist and UpHist count tests per statsBuckets bucket, the last
+	// one open-ended.
+	DownHist []int `json:"download_histogram"`
+	UpHist   []int `json:"upload_histogram"`
+}
+
+func init() {
+	register(subsystem{
+		name: "stats",
+		flags: func() {
+			flag.BoolVar(&settings.Stats, "stats", settings.Stats, "publish aggregate statistics of recent tests on /stats")
+		},
+		routes: func(m *http.ServeMux) {
+			m.HandleFunc("/stats", statsPage)
+			m.HandleFunc("/api/stats", statsJSON)
+		},
+		index: func(*http.Request) string {
+			if !cfg().Stats {
+				return ""
+			}
+			return `<p><a href="/stats">Typical speeds</a> measured here</p>` + "\n"
+		},
+	})
+}
+
+// statsOf sums up the finished results in the ring.
+func statsOf() *statsSummary {
+	st := &statsSummary{DownHist: make([]int, len(statsBuckets)+1), UpHist: make([]int, len(statsBuckets)+1)}
+	days := map[string]*statsDay{}
+	var downs, ups, pings []float64
+	for _, r := range recent.last(0) {
+		if !r.Done || r.Down <= 0 {
+			continue
+		}
+		st.Tests++
+		if st.Since.IsZero() || r.Time.Before(st.Since) {
+			st.Since = r.Time.UTC().Truncate(24 * time.Hour)
+		}
+		d := r.Time.In(cfg().zone()).Format("2006-01-02")
+		if days[d] == nil {
+			days[d] = &statsDay{Day: d}
+		}
+		day := days[d]
+		day.Tests++
+		day.downs, downs = append(day.downs, r.Down), append(downs, r.Down)
+		st.DownHist[statsBucket(r.Down)]++
+		if r.Up > 0 {
+			day.ups, ups = append(day.ups, r.Up), append(ups, r.Up)
+			st.UpHist[statsBucket(r.Up)]++
+		}
+		if r.Ping > 0 {
+			day.pings, pings = append(day.pings, r.Ping), append(pings, r.Ping)
+		}
+	}
+	st.Down, st.Up, st.Ping = medianOr0(downs), medianOr0(ups), medianOr0(pings)
+	for _, d := range days {
+		if d.Tests < statsMinTests {
+			continue
+		}
+		d.Down, d.Up, d.Ping = medianOr0(d.downs), medianOr0(d.ups), medianOr0(d.pings)
+		st.Days = append(st.Days, *d)
+	}
+	sort.Slice(st.Days, func(i, j int) bool { return st.Days[i].Day > st.Days[j].Day })
+	if len(st.Days) > statsDays {
+		st.Days = st.Days[:statsDays]
+	}
+	return st
+}
+
+func medianOr0(v []float64) float64 {
+	if len(v) == 0 {
+		return 0
+	}
+	return median(v)
+}
+
+func statsBucket(bps float64) int {
+	m := bps / 1024 / 1024
+	for i, b := range statsBuckets {
+		if m < b {
+			return i
+		}
+	}
+	return len(statsBuckets)
+}
+
+// statsHist draws a histogram as rows of bars, widest = busiest.
+func statsHist(counts []int, u unit, l *locale) string {
+	top := 1
+	for _, c := range counts {
+		top = max(top, c)
+	}
+	var b strings.Builder
+	b.WriteString("<table>\n")
+	for i, c := range counts {
+		// the buckets are in MiB/s
+		bound := func(v float64) string { return l.dec(strconv.FormatFloat(u.num(v*(1<<20)), 'g', 3, 64)) }
+		label := "over " + bound(statsBuckets[len(statsBuckets)-1])
+		if i < len(statsBuckets) {
+			lo := 0.0
+			if i > 0 {
+				lo = statsBuckets[i-1]
+			}
+			label = bound(lo) + "–" + bound(statsBuckets[i])
+		}
+		fmt.Fprintf(&b, "<tr><td>%s "+u.label()+"</td><td><span style=\"display:inline-block;background:#4a90d9;height:.8em;width:%dpx\"></span> %d</td></tr>\n", label, c*300/top, c)
+	}
+	b.WriteString("</table>\n")
+	return b.String()
+}
+
+func statsPage(w http.ResponseWriter, r *http.Request) {
+	if !cfg().Stats {
+		http.NotFound(w, r)
+		return
+	}
+	st, u, l := statsOf(), speedUnit(w, r), pageLocale(r)
+	var body strings.Builder
+	if st.Tests == 0 {
+		body.WriteString("<p>No finished tests yet.</p>\n")
+	} else {
+		fmt.Fprintf(&body, "<p>%d tests since %s. Half of them measured more than %s down and %s up; the median ping was %s ms.</p>\n",
+			st.Tests, l.day(st.Since), l.speed(u, st.Down), l.speed(u, st.Up), l.num(st.Ping, 1))
+		if len(st.Days) > 0 {
+			body.WriteString("<h3>By day</h3>\n<table>\n<tr><th>Day (" + cfg().zone().String() + ")</th><th>Tests</th><th>Median download</th><th>Median upload</th><th>Median ping</th></tr>\n")
+			for _, d := range st.Days {
+				day, _ := time.ParseInLocation("2006-01-02", d.Day, cfg().zone())
+				fmt.Fprintf(&body, "<tr><td>%s</td><td>%d</td><td>%s</td><td>%s</td><td>%s ms</td></tr>\n", l.day(day), d.Tests, l.speed(u, d.Down), l.speed(u, d.Up), l.num(d.Ping, 1))
+			}
+			body.WriteString("</table>\n")
+		}
+		body.WriteString("<h3>Download speeds</h3>\n" + statsHist(st.DownHist, u, l) + "<h3>Upload speeds</h3>\n" + statsHist(st.UpHist, u, l) + unitSwitch(u))
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Vary", "Cookie, Accept-Language")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, `<!doctype html>
+<html><head><meta charset="utf-8"><title>Blurr statistics</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Arial;max-width:760px;margin:1rem}td,th{padding:0 1rem 0 0;text-align:left}</style>
+</head><body>
+<h2>Speeds measured at `+html.EscapeString(cfg().Hostname)+`</h2>
+`+body.String()+`<p><small>From the last `+strconv.Itoa(recentCap())+` tests this server remembers. Days with fewer than `+strconv.Itoa(statsMinTests)+` tests aren't listed.</small></p>
+<p><a href="/">Run a test</a></p>
+</body></html>`)
+}
+
+// statsWindow is one window of /api/stats: the finished tests of the last
+// Window, and the spread of what they measured.
+type statsWindow struct {
+	Window string       `json:"window"`
+	Tests  int          `json:"tests"`
+	Down   *statsSpread `json:"download_bps,omitempty"`
+	Up     *statsSpread `json:"upload_bps,omitempty"`
+	Ping   *statsSpread `json:"ping_ms,omitempty"`
+}
+
+type statsSpread struct {
+	Min    float64 `json:"min"`
+	P5     float64 `json:"p5"`
+	P25    float64 `json:"p25"`
+	Median float64 `json:"median"`
+	P75    float64 `json:"p75"`
+	P95    float64 `json:"p95"`
+	Max    float64 `json:"max"`
+}
+
+func statsSpreadOf(v []float64) *statsSpread {
+	if len(v) == 0 {
+		return nil
+	}
+	s := append([]float64(nil), v...)
+	sort.Float64s(s)
+	return &statsSpread{s[0], percentile(s, 5), percentile(s, 25), percentile(s, 50), percentile(s, 75), percentile(s, 95), s[len(s)-1]}
+}
+
+// parseWindow reads a window as a Go duration, or a whole number of days
+// as "7d".
+func parseWindow(s string) (time.Duration, error) {
+	if n, ok := strings.CutSuffix(s, "d"); ok {
+		d, err := strconv.Atoi(n)
+		if err != nil || d <= 0 {
+			return 0, errors.New("bad window " + strconv.Quote(s))
+		}
+		return time.Duration(d) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errors.New("bad window " + strconv.Quote(s))
+	}
+	return d, nil
+}
+
+// statsJSON answers /api/stats?window=1h,24h,7d (24h, 7d and 30d by
+// default) with the count and the percentiles of each window, for
+// dashboards that chart the instance over time.
+func statsJSON(w http.ResponseWriter, r *http.Request) {
+	if !cfg().Stats {
+		http.NotFound(w, r)
+		return
+	}
+	spec := r.URL.Query().Get("window")
+	if spec == "" {
+		spec = "24h,7d,30d"
+	}
+	var wins []string
+	var durs []time.Duration
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		d, err := parseWindow(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		wins, durs = append(wins, s), append(durs, d)
+	}
+	if len(wins) > 10 {
+		http.Error(w, "at most 10 windows", http.StatusBadRequest)
+		return
+	}
+	done := recent.last(0)
+	now := time.Now()
+	out := struct {
+		Tests   int           `json:"tests"`
+		Kept    int           `json:"kept"`
+		Windows []statsWindow `json:"windows"`
+	}{Kept: recentCap()}
+	for i, d := range durs {
+		win := statsWindow{Window: wins[i]}
+		var downs, ups, pings []float64
+		for _, res := range done {
+			if !res.Done || res.Down <= 0 || now.Sub(res.Time) > d {
+				continue
+			}
+			win.Tests++
+			downs = append(downs, res.Down)
+			if res.Up > 0 {
+				ups = append(ups, res.Up)
+			}
+			if res.Ping > 0 {
+				pings = append(pings, res.Ping)
+			}
+		}
+		win.Down, win.Up, win.Ping = statsSpreadOf(downs), statsSpreadOf(ups), statsSpreadOf(pings)
+		out.Windows = append(out.Windows, win)
+	}
+	for _, res := range done {
+		if res.Done && res.Down > 0 {
+			out.Tests++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	json.NewEncoder(w).Encode(out)
+}
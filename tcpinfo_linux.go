@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/http"
+	"syscall"
+	"unsafe"
+)
+
+// tcpi_options bits
+const (
+	tcpiOptECN     = 8
+	tcpiOptECNSeen = 16
+)
+
+// tcpInfo reads the kernel's TCP_INFO for the connection carrying r. The
+// offsets are those of struct tcp_info in linux/tcp.h; fields a kernel is
+// too old to fill stay zero.
+func tcpInfo(r *http.Request) *tcpStat {
+	c := connOf(r)
+	if c == nil {
+		return nil
+	}
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var b [232]byte
+	n := uint32(len(b))
+	var errno syscall.Errno
+	raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO, uintptr(unsafe.Pointer(&b[0])), uintptr(unsafe.Pointer(&n)), 0)
+	})
+	if errno != 0 || n < 104 {
+		return nil
+	}
+	u32 := func(off int) uint32 { return binary.NativeEndian.Uint32(b[off:]) }
+	u64 := func(off int) uint64 { return binary.NativeEndian.Uint64(b[off:]) }
+	t := &tcpStat{
+		RTTMs:    float64(u32(68)) / 1000,
+		RTTVarMs: float64(u32(72)) / 1000,
+		Cwnd:     int(u32(80)),
+		Retrans:  int(u32(100)),
+		ECN:      b[5]&tcpiOptECN != 0,
+		ECTSeen:  b[5]&tcpiOptECNSeen != 0,
+	}
+	if n >= 148 {
+		t.SegsOut = int(u32(136))
+	}
+	if n >= 128 {
+		t.BytesAcked, t.hasAcked = u64(120), true
+	}
+	if n >= 152 {
+		t.MinRTTMs = float64(u32(148)) / 1000
+	}
+	if n >= 168 {
+		t.DeliveryBps = float64(u64(160))
+	}
+	if n >= 200 {
+		t.DeliveredCE = int(u32(196))
+	}
+	return t
+}
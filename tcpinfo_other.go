@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+import "net/http"
+
+func tcpInfo(*http.Request) *tcpStat { return nil }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Terminal browsers (lynx, w3m, links) run no JavaScript, fetch one thing
+// at a time and ignore hidden iframes, so they get a text UI of their own:
+// the test is a chain of plain links and one form, nothing refreshes by
+// itself, and the result is a preformatted table. It's picked by
+// User-Agent, or with ?ui=text (?ui=full for the normal pages).
+var textAgents = regexp.MustCompile(`(?i)^(lynx|w3m|e?links)\b`)
+
+func textUI(r *http.Request) bool {
+	switch r.URL.Query().Get("ui") {
+	case "text":
+		return true
+	case "full":
+		return false
+	}
+	return textAgents.MatchString(r.UserAgent())
+}
+
+// textQuery carries an explicit ?ui=text on to the next page.
+func textQuery(r *http.Request, sep string) string {
+	if r.URL.Query().Get("ui") == "text" {
+		return sep + "ui=text"
+	}
+	return ""
+}
+
+const textHead = `<!doctype html>
+<html><head><meta charset="utf-8"><meta name="robots" content="noindex"><title>`
+
+func textIndex(w http.ResponseWriter, r *http.Request, extra string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	b := brandFor(r)
+	io.WriteString(w, textHead+b.name()+`</title></head><body>
+<h1>`+b.name()+`</h1>
+`+hostPara(getIP(r))+`<p>The test downloads `+fmtBytes(textDownload)+`, then uploads `+fmtBytes(formUpload())+` with a form, and shows the result.</p>
+<p><a href="/multi?streams=1&amp;ui=text">Start the test</a></p>
+<p><a href="/?ui=full">Full version</a> (needs JavaScript)</p>
+`+extra+b.about()+`</body></html>`)
+}
+
+// textDownload is what the text test fetches, as one page.
+const textDownload = 8 << 20
+
+// textMulti runs the text test: the first visit sets it up and links to the
+// download, which ends with a link back here for the upload form.
+func textMulti(w http.ResponseWriter, r *http.Request, s *session) {
+	id := s.res.ID
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.URL.Query().Get("step") != "upload" {
+		io.WriteString(w, textHead+`Blurr (download)</title></head><body>
+<h1>Blurr</h1>
+<p>Step 1 of 2: follow the link and wait for the page to finish loading. It's `+fmtBytes(textDownload)+` of filler your browser won't show.</p>
+<p><a href="/download?sid=`+id+`&amp;size=`+strconv.Itoa(textDownload)+`&amp;ui=text">Download</a></p>
+</body></html>`)
+		return
+	}
+	io.WriteString(w, textHead+`Blurr (upload)</title></head><body>
+<h1>Blurr</h1>
+<p>Step 2 of 2: press Upload to send `+fmtBytes(formUpload())+` back, then you'll see your result.</p>
+<form method="post" action="/upload?sid=`+id+`&amp;form=1`+html.EscapeString(textQuery(r, "&"))+`"><input type="hidden" name="p" value="`+formFill()+`"><input type="submit" value="Upload"></form>
+<p><a href="/r/`+id+html.EscapeString(textQuery(r, "?"))+`">Skip the upload</a></p>
+</body></html>`)
+}
+
+// textWrap is what the text test's download page puts around the payload:
+// the bytes go in a comment (the payload is drawn from the base64
+// alphabet, so no "-->" can end it early) and a link on to the upload.
+func textWrap(sid string) (head, tail string) {
+	return textHead + `Blurr (downloading)</title></head><body>
+<p>Downloading...</p>
+<!--`, `-->
+<p>Download done. <a href="/multi?sid=` + html.EscapeString(sid) + `&amp;step=upload&amp;ui=text">Continue to the upload</a></p>
+</body></html>`
+}
+
+var (
+	textOnce  sync.Once
+	textBlock []byte
+)
+
+// textPayload is the payload mapped onto the base64 alphabet.
+func textPayload() []byte {
+	textOnce.Do(func() {
+		const abc = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+		p := payload()
+		textBlock = make([]byte, len(p))
+		for i, b := range p {
+			textBlock[i] = abc[b&63]
+		}
+	})
+	return textBlock
+}
+
+var (
+	textRow   = regexp.MustCompile(`(?s)<tr><td>(.*?)</td><td>(.*?)</td></tr>`)
+	textTag   = regexp.MustCompile(`<[^>]*>`)
+	textSpace = regexp.MustCompile(`\s+`)
+)
+
+// writeTextResult is writeResult for terminal browsers: the rows of
+// resultTable as an aligned, preformatted table.
+func writeTextResult(w io.Writer, r *http.Request, res *result) {
+	plain := func(s string) string {
+		return strings.TrimSpace(textSpace.ReplaceAllString(html.UnescapeString(textTag.ReplaceAllString(s, "")), " "))
+	}
+	var rows [][2]string
+	width := 0
+	for _, m := range textRow.FindAllStringSubmatch(resultTable(res), -1) {
+		if len(res.Pings) == 0 && (m[1] == "Ping" || m[1] == "Jitter") {
+			// without JavaScript nothing measures them
+			continue
+		}
+		rows = append(rows, [2]string{plain(m[1]), plain(m[2])})
+		width = max(width, len([]rune(rows[len(rows)-1][0])))
+	}
+	var b strings.Builder
+	line := "+" + strings.Repeat("-", width+2) + "+" + strings.Repeat("-", 40) + "\n"
+	b.WriteString(line)
+	for _, row := range rows {
+		b.WriteString("| " + row[0] + strings.Repeat(" ", width-len([]rune(row[0]))) + " | " + row[1] + "\n")
+	}
+	b.WriteString(line)
+	title := res.brand.name() + " result"
+	if res.Label != "" {
+		title += ": " + html.EscapeString(res.Label)
+	}
+	io.WriteString(w, textHead+title+`</title></head><body>
+<h1>`+title+`</h1>
+<p>`+hostNote(res.IP, ", ")+res.loc.when(res.Time)+torNote(res)+pacedNote(res)+`</p>
+<pre>
+`+html.EscapeString(b.String())+`</pre>
+<p><a href="/`+html.EscapeString(textQuery(r, "?"))+`">Run another test</a> | <a href="/api/v1/result/`+res.ID+`">Raw data (JSON)</a> | <a href="/r/`+res.ID+`?ui=full">Full version</a></p>
+`+res.brand.about()+`</body></html>`)
+}
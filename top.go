@@ -0,0 +1,80 @@
+//go:build !minimal && !noadmin
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// runTop is "blurr top": a live terminal view of an instance's /admin/api
+// for operators logged into the box.
+func runTop(args []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	base := fs.String("url", "http://localhost:8080", "Blurr instance to watch")
+	every := fs.Duration("every", 2*time.Second, "refresh interval")
+	token := fs.String("token", os.Getenv("BLURR_ADMIN_TOKEN"), "the instance's -admin-token (default $BLURR_ADMIN_TOKEN; for basic auth put user:password@ in -url)")
+	fs.Parse(args)
+	c := http.Client{Timeout: 10 * time.Second}
+	shown := *base
+	if u, err := url.Parse(*base); err == nil {
+		shown = u.Redacted()
+	}
+	var last int64
+	var lastAt time.Time
+	for {
+		var st adminStatus
+		err := func() error {
+			req, err := http.NewRequest("GET", strings.TrimSuffix(*base, "/")+"/admin/api", nil)
+			if err != nil {
+				return err
+			}
+			if *token != "" {
+				req.Header.Set("Authorization", "Bearer "+*token)
+			}
+			res, err := c.Do(req)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				return fmt.Errorf("/admin/api: %s", res.Status)
+			}
+			return json.NewDecoder(res.Body).Decode(&st)
+		}()
+		var b strings.Builder
+		b.WriteString("\x1b[H\x1b[2J")
+		fmt.Fprintf(&b, "blurr top — %s — %s\n\n", shown, time.Now().Format("15:04:05"))
+		if err != nil {
+			fmt.Fprintf(&b, "error: %v\n", err)
+		} else {
+			rate := "–"
+			if !lastAt.IsZero() && st.Today >= last {
+				rate = mibps(float64(st.Today-last) / time.Since(lastAt).Seconds())
+			}
+			last, lastAt = st.Today, time.Now()
+			today := fmtBytes(st.Today)
+			if st.Budget > 0 {
+				today += " of " + fmtBytes(st.Budget)
+			}
+			fmt.Fprintf(&b, "version %s   active %d   waiting %d   throughput %s   today %s\n\n", st.Version, st.Active, st.Waiting, rate, today)
+			fmt.Fprintf(&b, "RUNNING (%d)\n", len(st.Running))
+			for _, r := range st.Running {
+				fmt.Fprintf(&b, "  %s  %-39s  %-16s  started %s ago\n", r.ID, r.IP, clip(r.Label, 16), time.Since(r.Time).Round(time.Second))
+			}
+			b.WriteString("\nRECENT\n")
+			fmt.Fprintf(&b, "  %-8s  %-39s  %9s  %14s  %14s\n", "TIME", "IP", "PING", "DOWNLOAD", "UPLOAD")
+			for _, r := range st.Recent {
+				fmt.Fprintf(&b, "  %-8s  %-39s  %6.1f ms  %14s  %14s\n", r.Time.Local().Format("15:04:05"), r.IP, r.Ping, mibps(r.Down), mibps(r.Up))
+			}
+		}
+		os.Stdout.WriteString(b.String())
+		time.Sleep(*every)
+	}
+}
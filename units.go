@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// A unit is how pages show speeds: "mibps" (MiB/s), "mbps" (Mbit/s, what
+// ISPs sell) or "mbs" (MB/s). A visitor picks one with ?unit= on any page
+// and a cookie remembers it; -unit sets the default, and "" stands for
+// it. The JSON keeps bytes per second; the samples CSV adds columns in
+// the chosen unit.
+type unit string
+
+const unitCookie = "blurr_unit"
+
+var units = map[unit]struct {
+	label string
+	per   float64 // bytes/s in one unit
+}{
+	"mibps": {"MiB/s", 1 << 20},
+	"mbps":  {"Mbit/s", 1e6 / 8},
+	"mbs":   {"MB/s", 1e6},
+}
+
+// unitOrder is the order the unit switch lists them in.
+var unitOrder = []unit{"mbps", "mibps", "mbs"}
+
+func (u unit) or() unit {
+	if _, ok := units[u]; ok {
+		return u
+	}
+	if _, ok := units[unit(cfg().Unit)]; ok {
+		return unit(cfg().Unit)
+	}
+	return "mibps"
+}
+
+func (u unit) label() string { return units[u.or()].label }
+
+func (u unit) num(bps float64) float64 { return bps / units[u.or()].per }
+
+func (u unit) fmt(bps float64) string {
+	return strconv.FormatFloat(u.num(bps), 'f', 2, 64) + " " + u.label()
+}
+
+// speedUnit is the unit r asks for, remembering a ?unit= choice in a
+// cookie for the pages after it.
+func speedUnit(w http.ResponseWriter, r *http.Request) unit {
+	if u := unit(r.URL.Query().Get("unit")); units[u].per > 0 {
+		http.SetCookie(w, &http.Cookie{Name: unitCookie, Value: string(u), Path: "/", MaxAge: 365 * 24 * 3600, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		return u
+	}
+	if c, err := r.Cookie(unitCookie); err == nil && units[unit(c.Value)].per > 0 {
+		return unit(c.Value)
+	}
+	return ""
+}
+
+// unitSwitch links the page to itself in each unit.
+func unitSwitch(cur unit) string {
+	s := "<p><small>Speeds in"
+	for i, u := range unitOrder {
+		if i > 0 {
+			s += " ·"
+		}
+		if u == cur.or() {
+			s += " " + u.label()
+		} else {
+			s += ` <a href="?unit=` + string(u) + `">` + u.label() + `</a>`
+		}
+	}
+	return s + "</small></p>\n"
+}
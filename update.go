@@ -0,0 +1,204 @@
+//go:build !minimal && !noupdate
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The update manifest is a small JSON document published next to a detached
+// Ed25519 signature (manifest URL + ".sig", base64). Blurr only reports what
+// it finds; it never downloads or installs anything.
+type manifest struct {
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	Notes   string `json:"notes"`
+}
+
+type updateState struct {
+	mu      sync.Mutex
+	latest  manifest
+	checked time.Time
+	err     string
+}
+
+var upd updateState
+
+func init() {
+	register(subsystem{
+		name: "update",
+		flags: func() {
+			flag.StringVar(&settings.UpdateURL, "update-url", settings.UpdateURL, "signed version manifest to check for new releases (empty = never check)")
+			flag.StringVar(&settings.UpdateKey, "update-key", settings.UpdateKey, "base64 Ed25519 public key the update manifest must be signed with")
+			flag.DurationVar(&settings.UpdateEvery, "update-every", settings.UpdateEvery, "how often to check for updates")
+		},
+		start:   startUpdateCheck,
+		admin:   updateNotice,
+		metrics: updateMetrics,
+	})
+}
+
+func (u *updateState) get() (manifest, time.Time, string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.latest, u.checked, u.err
+}
+
+func (u *updateState) available() bool {
+	m, _, _ := u.get()
+	return m.Version != "" && newer(m.Version, version)
+}
+
+func startUpdateCheck() {
+	if cfg().UpdateURL == "" {
+		return
+	}
+	key, err := base64.StdEncoding.DecodeString(cfg().UpdateKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		degraded("update check: -update-key must be a base64 Ed25519 public key", "Use the release signing key from the project page, or drop -update-url.")
+		return
+	}
+	go func() {
+		for {
+			m, err := fetchManifest(cfg().UpdateURL, ed25519.PublicKey(key))
+			upd.mu.Lock()
+			upd.checked = time.Now()
+			setHealth("update", err)
+			if err != nil {
+				upd.err = err.Error()
+				log.Printf("update check: %v", err)
+			} else {
+				upd.latest, upd.err = m, ""
+				if newer(m.Version, version) {
+					log.Printf("update check: version %s available (running %s)", m.Version, version)
+				}
+			}
+			upd.mu.Unlock()
+			time.Sleep(cfg().UpdateEvery)
+		}
+	}()
+}
+
+func fetchManifest(url string, key ed25519.PublicKey) (manifest, error) {
+	var m manifest
+	body, err := fetchSmall(url)
+	if err != nil {
+		return m, err
+	}
+	sig, err := fetchSmall(url + ".sig")
+	if err != nil {
+		return m, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return m, fmt.Errorf("bad signature encoding: %v", err)
+	}
+	if !ed25519.Verify(key, body, raw) {
+		return m, errors.New("manifest signature does not verify")
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return m, fmt.Errorf("bad manifest: %v", err)
+	}
+	return m, nil
+}
+
+func fetchSmall(url string) ([]byte, error) {
+	c := http.Client{Timeout: 15 * time.Second}
+	res, err := c.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, 64*1024))
+}
+
+// newer reports whether dotted version a is greater than b. Versions that
+// don't parse (such as "dev") are never considered older.
+func newer(a, b string) bool {
+	pa, ok1 := parseVersion(a)
+	pb, ok2 := parseVersion(b)
+	if !ok1 || !ok2 {
+		return false
+	}
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+func parseVersion(s string) ([]int, bool) {
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	var out []int
+	for _, f := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, false
+		}
+		out = append(out, n)
+	}
+	return out, true
+}
+
+func updateNotice() string {
+	if cfg().UpdateURL == "" {
+		return ""
+	}
+	m, checked, err := upd.get()
+	switch {
+	case checked.IsZero():
+		return "<p>Update check pending.</p>\n"
+	case err != "":
+		return "<p>Update check failed: " + html.EscapeString(err) + "</p>\n"
+	case newer(m.Version, version):
+		s := `<p><strong>New version available: ` + html.EscapeString(m.Version) + `</strong>`
+		if m.URL != "" {
+			s += ` — <a href="` + html.EscapeString(m.URL) + `">release</a>`
+		}
+		if m.Notes != "" {
+			s += `<br>` + html.EscapeString(m.Notes)
+		}
+		return s + "</p>\n"
+	}
+	return "<p>Up to date (checked " + checked.UTC().Format(time.RFC3339) + ").</p>\n"
+}
+
+func updateMetrics(w io.Writer) {
+	if cfg().UpdateURL == "" {
+		return
+	}
+	_, checked, _ := upd.get()
+	avail := 0
+	if upd.available() {
+		avail = 1
+	}
+	fmt.Fprintf(w, "# TYPE blurr_update_available gauge\nblurr_update_available %d\n", avail)
+	fmt.Fprintf(w, "# TYPE blurr_update_check_timestamp_seconds gauge\nblurr_update_check_timestamp_seconds %d\n", checked.Unix())
+}
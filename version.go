@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// version, commit and buildDate can be set at build time with
+// -ldflags "-X main.version=1.2.0 -X main.commit=... -X main.buildDate=...".
+// Whatever isn't set is taken from the build info Go records itself: the
+// module version for "go install ...@v1.2.0", and the VCS revision and
+// time for a build from a git checkout.
+var (
+	version   = "dev"
+	commit    string
+	buildDate string
+	dirty     bool
+)
+
+func init() {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	vcs := false
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			vcs = true
+			if commit == "" {
+				commit = s.Value
+			}
+		case "vcs.time":
+			if buildDate == "" {
+				buildDate = s.Value
+			}
+		case "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	// a checkout's module version is a pseudo-version made of the commit,
+	// so only a module download has a real one
+	if v := bi.Main.Version; version == "dev" && !vcs && v != "" && v != "(devel)" {
+		version = strings.TrimPrefix(v, "v")
+	}
+}
+
+// versionLine is the version in one line, for -version and page footers.
+func versionLine() string {
+	s := version
+	if commit != "" {
+		s += " (" + commit[:min(len(commit), 12)]
+		if dirty {
+			s += "+dirty"
+		}
+		s += ")"
+	}
+	if buildDate != "" {
+		s += " built " + buildDate
+	}
+	return s
+}
+
+func versionFooter() string {
+	return `<p><small>Blurr ` + html.EscapeString(versionLine()) + `</small></p>` + "\n"
+}
+
+func versionJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Version   string `json:"version"`
+		Commit    string `json:"commit,omitempty"`
+		Modified  bool   `json:"modified,omitempty"`
+		BuildDate string `json:"build_date,omitempty"`
+		Go        string `json:"go"`
+	}{version, commit, dirty, buildDate, runtime.Version()})
+}
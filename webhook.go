@@ -0,0 +1,82 @@
+//go:build !minimal && !nowebhook
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// -webhook POSTs every finished result, as the same JSON /api/v1/result
+// serves, to a URL of the operator's choosing (Home Assistant, Node-RED,
+// an alerting pipeline). With -webhook-secret each request carries
+// X-Blurr-Signature: sha256=<hex HMAC of the body>, so the receiver can
+// tell it came from this server. Deliveries queue and retry like
+// notifications.
+var hook *sink
+
+func init() {
+	register(subsystem{
+		name: "webhook",
+		flags: func() {
+			flag.StringVar(&settings.Webhook, "webhook", settings.Webhook, "POST each finished result as JSON to this URL")
+			flag.StringVar(&settings.WebhookSecret, "webhook-secret", settings.WebhookSecret, "sign webhook bodies with HMAC-SHA256 under this key (X-Blurr-Signature header)")
+		},
+		start: startWebhook,
+		done:  webhookDone,
+	})
+}
+
+func startWebhook() {
+	if cfg().Webhook == "" {
+		return
+	}
+	if u, err := url.Parse(cfg().Webhook); err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+		degraded("-webhook "+cfg().Webhook+": not an http(s) URL", "Give the full address, e.g. https://example.net/hooks/blurr.")
+		return
+	}
+	hook = newSink("webhook", sendWebhook, nil)
+}
+
+func webhookDone(_ *http.Request, res *result) {
+	if hook == nil {
+		return
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		return
+	}
+	hook.post(string(b))
+}
+
+func sendWebhook(body string) error {
+	req, err := http.NewRequest(http.MethodPost, cfg().Webhook, bytes.NewReader([]byte(body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "blurr/"+version)
+	if cfg().WebhookSecret != "" {
+		m := hmac.New(sha256.New, []byte(cfg().WebhookSecret))
+		m.Write([]byte(body))
+		req.Header.Set("X-Blurr-Signature", "sha256="+hex.EncodeToString(m.Sum(nil)))
+	}
+	c := http.Client{Timeout: 15 * time.Second}
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return errors.New(res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+//go:build !minimal && !nowizard
+
+package main
+
+import (
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// A comparison wizard runs the test twice under different conditions,
+// links the second run to the first and shows what the condition costs.
+// test is the condition being judged, base the reference it's held against.
+type wizard struct {
+	key, title  string
+	test, base  string
+	how         map[string]string
+	penaltyName string
+}
+
+var wizards = []wizard{
+	{
+		key: "wifi", title: "Wi-Fi vs Ethernet",
+		test: "Wi-Fi", base: "Ethernet",
+		how: map[string]string{
+			"Wi-Fi":    "Unplug any network cable and make sure this device is on Wi-Fi.",
+			"Ethernet": "Plug this device into the router with a cable and turn Wi-Fi off.",
+		},
+		penaltyName: "Wireless penalty",
+	},
+	{
+		key: "vpn", title: "VPN on vs off",
+		test: "VPN on", base: "VPN off",
+		how: map[string]string{
+			"VPN on":  "Connect your VPN.",
+			"VPN off": "Disconnect your VPN.",
+		},
+		penaltyName: "VPN overhead",
+	},
+}
+
+func init() {
+	register(subsystem{
+		name:   "wizard",
+		routes: func(m *http.ServeMux) { m.HandleFunc("/compare", comparePage) },
+		index:  wizardStep,
+		result: wizardResult,
+	})
+}
+
+func findWizard(key string) *wizard {
+	for i := range wizards {
+		if wizards[i].key == key {
+			return &wizards[i]
+		}
+	}
+	return nil
+}
+
+func (z *wizard) other(label string) string {
+	if label == z.test {
+		return z.base
+	}
+	return z.test
+}
+
+func wizardLink(z *wizard, label, pair string) string {
+	v := url.Values{"wizard": {z.key}, "label": {label}}
+	if pair != "" {
+		v.Set("pair", pair)
+	}
+	return "/?" + v.Encode()
+}
+
+func comparePage(w http.ResponseWriter, r *http.Request) {
+	s := ""
+	for i := range wizards {
+		z := &wizards[i]
+		s += "<h3>" + html.EscapeString(z.title) + "</h3>\n<p>Run the test once with " + html.EscapeString(z.test) + " and once with " + html.EscapeString(z.base) + ", in either order, and see the difference side by side.</p>\n<ul>\n"
+		for _, l := range []string{z.test, z.base} {
+			s += `<li><a href="` + html.EscapeString(wizardLink(z, l, "")) + `">Start with ` + html.EscapeString(l) + "</a></li>\n"
+		}
+		s += "</ul>\n"
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, `<!doctype html>
+<html><head><meta charset="utf-8"><title>Blurr (compare)</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Arial;max-width:760px;margin:1rem}</style>
+</head><body>
+<h2>Blurr comparisons</h2>
+`+s+`<p><a href="/">Back</a></p>
+</body></html>`)
+}
+
+func wizardStep(r *http.Request) string {
+	v := r.URL.Query()
+	z := findWizard(v.Get("wizard"))
+	if z == nil {
+		return `<p><a href="/compare">Compare connections</a> (Wi-Fi vs Ethernet, VPN on vs off) with a guided pair of tests.</p>` + "\n"
+	}
+	label := v.Get("label")
+	if label != z.test && label != z.base {
+		return ""
+	}
+	step := "1"
+	if v.Get("pair") != "" {
+		step = "2"
+	}
+	return `<p style="border:1px solid #ccc;padding:.5rem"><strong>` + html.EscapeString(z.title) + `, step ` + step + ` of 2: ` + html.EscapeString(label) + `.</strong> ` + html.EscapeString(z.how[label]) + ` Then press Start.</p>` + "\n"
+}
+
+func wizardResult(res *result) string {
+	z := findWizard(res.Wizard)
+	if z == nil || (res.Label != z.test && res.Label != z.base) {
+		return ""
+	}
+	if res.Pair == "" {
+		next := z.other(res.Label)
+		return `<p style="border:1px solid #ccc;padding:.5rem"><strong>Step 2 of 2:</strong> ` + html.EscapeString(z.how[next]) + ` Then <a href="` + html.EscapeString(wizardLink(z, next, res.ID)) + `">run the ` + html.EscapeString(next) + ` test</a>.</p>` + "\n"
+	}
+	ps := getSession(res.Pair)
+	if ps == nil {
+		return "<p>The first run of this comparison has expired, so there's nothing to compare against.</p>\n"
+	}
+	first := ps.snapshot()
+	first.unit, first.loc = res.unit, res.loc
+	t, b := res, &first
+	if res.Label == z.base {
+		t, b = &first, res
+	}
+	if t.Label != z.test || b.Label != z.base {
+		return ""
+	}
+	return compareTable(z, t, b)
+}
+
+func compareTable(z *wizard, t, b *result) string {
+	pct := func(tv, bv float64) string {
+		if bv <= 0 {
+			return "–"
+		}
+		s := t.loc.num((tv-bv)/bv*100, 0) + "%"
+		if tv > bv {
+			s = "+" + s
+		}
+		return s
+	}
+	ms := func(v float64) string { return t.loc.num(v, 2) + " ms" }
+	dms := func(v float64) string {
+		s := ms(v)
+		if v >= 0 {
+			s = "+" + s
+		}
+		return s
+	}
+	warn := ""
+	if t.Method != b.Method {
+		warn = "<p>The two runs used different test settings (the method differs), so the difference isn't only the " + html.EscapeString(z.test) + ".</p>\n"
+	}
+	return `<h3>` + html.EscapeString(z.title) + `</h3>
+` + warn + `<p><strong>` + html.EscapeString(z.penaltyName) + `:</strong> download ` + pct(t.Down, b.Down) + `, upload ` + pct(t.Up, b.Up) + `, ping ` + dms(t.Ping-b.Ping) + ` on ` + html.EscapeString(z.test) + ` compared with ` + html.EscapeString(z.base) + `.</p>
+<table>
+<tr><th></th><th>` + html.EscapeString(z.test) + `</th><th>` + html.EscapeString(z.base) + `</th><th>Difference</th></tr>
+<tr><td>Ping</td><td>` + ms(t.Ping) + `</td><td>` + ms(b.Ping) + `</td><td>` + dms(t.Ping-b.Ping) + `</td></tr>
+<tr><td>Jitter</td><td>` + ms(t.Jitter) + `</td><td>` + ms(b.Jitter) + `</td><td>` + pct(t.Jitter, b.Jitter) + `</td></tr>
+<tr><td>Download</td><td>` + t.loc.speed(t.unit, t.Down) + `</td><td>` + t.loc.speed(t.unit, b.Down) + `</td><td>` + pct(t.Down, b.Down) + `</td></tr>
+<tr><td>Upload</td><td>` + t.loc.speed(t.unit, t.Up) + `</td><td>` + t.loc.speed(t.unit, b.Up) + `</td><td>` + pct(t.Up, b.Up) + `</td></tr>
+</table>
+<p><a href="` + html.EscapeString(wizardLink(z, z.test, "")) + `">Start a new comparison</a></p>
+`
+}